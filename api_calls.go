@@ -2,6 +2,7 @@ package maz
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -20,7 +21,12 @@ type strMapT map[string]string
 
 // ApiCall alias to do a GET
 func ApiGet(url string, z Bundle, params strMapT) (result jsonT, rsc int, err error) {
-	return ApiCall("GET", url, z, nil, params, false) // false = quiet, for normal ops
+	return ApiGetCtx(context.Background(), url, z, params)
+}
+
+// Context-aware version of ApiGet
+func ApiGetCtx(ctx context.Context, url string, z Bundle, params strMapT) (result jsonT, rsc int, err error) {
+	return ApiCallCtx(ctx, "GET", url, z, nil, params, false) // false = quiet, for normal ops
 }
 
 // ApiCall alias to do a GET with debugging on
@@ -30,7 +36,12 @@ func ApiGetDebug(url string, z Bundle, params strMapT) (result jsonT, rsc int, e
 
 // ApiCall alias to do a POST
 func ApiPost(url string, z Bundle, payload jsonT, params strMapT) (result jsonT, rsc int, err error) {
-	return ApiCall("POST", url, z, payload, params, false) // false = quiet, for normal ops
+	return ApiPostCtx(context.Background(), url, z, payload, params)
+}
+
+// Context-aware version of ApiPost
+func ApiPostCtx(ctx context.Context, url string, z Bundle, payload jsonT, params strMapT) (result jsonT, rsc int, err error) {
+	return ApiCallCtx(ctx, "POST", url, z, payload, params, false) // false = quiet, for normal ops
 }
 
 // ApiCall alias to do a POST with debugging on
@@ -40,7 +51,12 @@ func ApiPostDebug(url string, z Bundle, payload jsonT, params strMapT) (result j
 
 // ApiCall alias to do a PUT
 func ApiPut(url string, z Bundle, payload jsonT, params strMapT) (result jsonT, rsc int, err error) {
-	return ApiCall("PUT", url, z, payload, params, false) // false = quiet, for normal ops
+	return ApiPutCtx(context.Background(), url, z, payload, params)
+}
+
+// Context-aware version of ApiPut
+func ApiPutCtx(ctx context.Context, url string, z Bundle, payload jsonT, params strMapT) (result jsonT, rsc int, err error) {
+	return ApiCallCtx(ctx, "PUT", url, z, payload, params, false) // false = quiet, for normal ops
 }
 
 // ApiCall alias to do a PUT with debugging on
@@ -50,7 +66,12 @@ func ApiPutDebug(url string, z Bundle, payload jsonT, params strMapT) (result js
 
 // ApiCall alias to do a DELETE
 func ApiDelete(url string, z Bundle, params strMapT) (result jsonT, rsc int, err error) {
-	return ApiCall("DELETE", url, z, nil, params, false) // false = quiet, for normal ops
+	return ApiDeleteCtx(context.Background(), url, z, params)
+}
+
+// Context-aware version of ApiDelete
+func ApiDeleteCtx(ctx context.Context, url string, z Bundle, params strMapT) (result jsonT, rsc int, err error) {
+	return ApiCallCtx(ctx, "DELETE", url, z, nil, params, false) // false = quiet, for normal ops
 }
 
 // ApiCall alias to do a DELETE with debugging on
@@ -61,94 +82,155 @@ func ApiDeleteDebug(url string, z Bundle, params strMapT) (result jsonT, rsc int
 // Makes API calls and returns JSON object, Response StatusCode, and error. For a more clear
 // explanation of how to interpret the JSON responses see https://eager.io/blog/go-and-json/
 // This function is the cornerstone of the maz package, extensively handling all API interactions.
+// Any non-2xx response is returned as an *ApiError, along with whatever JSON the API returned.
 func ApiCall(method, url string, z Bundle, payload jsonT, params strMapT, verbose bool) (result jsonT, rsc int, err error) {
+	return ApiCallCtx(context.Background(), method, url, z, payload, params, verbose)
+}
+
+// Context-aware version of ApiCall
+func ApiCallCtx(ctx context.Context, method, url string, z Bundle, payload jsonT, params strMapT, verbose bool) (result jsonT, rsc int, err error) {
 	if !strings.HasPrefix(url, "http") {
-		utl.Die(utl.Trace() + "Error: Bad URL, " + url + "\n")
+		return nil, 0, fmt.Errorf("%w: %s", ErrBadUrl, url)
 	}
 
-	// Map headers to corresponding API endpoint
+	// Map headers, and token scope, to corresponding API endpoint
 	var headers strMapT = nil
-	if strings.HasPrefix(url, ConstMgUrl) {
+	var scopes []string = nil
+	if urlUnder(url, z.MgUrl(), false) {
 		headers = z.MgHeaders
-	} else if strings.HasPrefix(url, ConstAzUrl) {
+		scopes = []string{z.mgScope()}
+	} else if urlUnder(url, z.AzUrl(), false) {
 		headers = z.AzHeaders
+		scopes = []string{z.azScope()}
+	} else if api, ok := z.apiResourceFor(url); ok {
+		if z.TokenProvider == nil {
+			return nil, 0, fmt.Errorf("%s %s: no token provider for %s API, call SetupApiTokens first", method, url, api.Name)
+		}
+		headers = api.headers()
+		scopes = []string{api.Scope}
+	}
+	if z.TokenProvider == nil {
+		scopes = nil // Nothing to refresh, so stick with the static token in the headers
 	}
 
-	// Set up new HTTP request client
-	client := &http.Client{Timeout: time.Second * 60} // One minute timeout
-	var req *http.Request = nil
-	switch strings.ToUpper(method) {
-	case "GET":
-		req, err = http.NewRequest("GET", url, nil)
-	case "POST":
-		jsonData, err := json.Marshal(payload)
-		if err != nil {
-			panic(err.Error())
-		}
-		req, _ = http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	case "PUT":
-		jsonData, err := json.Marshal(payload)
+	// Use the bundle's HTTP client, or the shared default one
+	client := z.httpClient()
+	var jsonData []byte = nil
+	method = strings.ToUpper(method)
+	switch method {
+	case "GET", "DELETE":
+	case "POST", "PUT":
+		jsonData, err = json.Marshal(payload)
 		if err != nil {
-			panic(err.Error())
+			return nil, 0, fmt.Errorf("%s %s: encoding payload: %w", method, url, err)
 		}
-		req, _ = http.NewRequest("PUT", url, bytes.NewBuffer(jsonData))
-	case "DELETE":
-		req, err = http.NewRequest("DELETE", url, nil)
 	default:
-		utl.Die(utl.Trace() + "Error: Unsupported HTTP method\n")
-	}
-	if err != nil {
-		panic(err.Error())
+		return nil, 0, fmt.Errorf("%w: %s", ErrUnsupportedMethod, method)
 	}
 
-	// Set up the headers
-	for h, v := range headers {
-		req.Header.Add(h, v)
-	}
+	// Throttled or temporarily unavailable calls are retried according to the bundle's policy
+	policy := z.retryPolicy()
+	var r *http.Response
+	var resBody []byte
+	reauthenticated := false // A 401 is retried only once, with a freshly acquired token
+	for attempt := 1; ; attempt++ {
+		var body io.Reader = nil
+		if jsonData != nil {
+			body = bytes.NewReader(jsonData) // A fresh reader for each attempt
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, body)
+		if err != nil {
+			return nil, 0, err
+		}
 
-	// Set up the query parameters and encode
-	reqParams := req.URL.Query()
-	for p, v := range params {
-		reqParams.Add(p, v)
-	}
-	req.URL.RawQuery = reqParams.Encode()
+		// Set up the headers
+		for h, v := range headers {
+			req.Header.Add(h, v)
+		}
+		if scopes != nil {
+			token, err := z.TokenProvider.GetToken(ctx, scopes, false) // Refreshed if about to expire
+			if err != nil {
+				return nil, 0, fmt.Errorf("%s %s: getting token: %w", method, url, err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token.Token)
+		}
 
-	// === MAKE THE CALL ============
-	if verbose {
-		fmt.Println(utl.Blu("==== REQUEST ================================="))
-		fmt.Println(method + " " + url)
-		PrintHeaders(req.Header)
-		PrintParams(reqParams)
-		if payload != nil {
-			fmt.Println(utl.Blu("payload") + ":")
-			utl.PrintJsonColor(payload)
+		// Set up the query parameters and encode
+		reqParams := req.URL.Query()
+		for p, v := range params {
+			reqParams.Add(p, v)
+		}
+		req.URL.RawQuery = reqParams.Encode()
+
+		// === MAKE THE CALL ============
+		if verbose {
+			fmt.Println(utl.Blu("==== REQUEST ================================="))
+			fmt.Println(method + " " + url)
+			PrintHeaders(req.Header)
+			PrintParams(reqParams)
+			if payload != nil {
+				fmt.Println(utl.Blu("payload") + ":")
+				utl.PrintJsonColor(payload)
+			}
+		}
+		r, err = client.Do(req) // Make the call
+		if err != nil {
+			return nil, 0, err
+		}
+		resBody, err = io.ReadAll(r.Body) // Read the response body
+		r.Body.Close()
+		if err != nil {
+			return nil, r.StatusCode, fmt.Errorf("%s %s: reading response: %w", method, url, err)
+		}
+		if r.StatusCode == http.StatusUnauthorized && scopes != nil && !reauthenticated {
+			reauthenticated = true
+			if _, err := z.TokenProvider.GetToken(ctx, scopes, true); err == nil {
+				attempt-- // Doesn't count against the throttling retries
+				continue
+			}
+		}
+		if !retryableStatus(r.StatusCode) || attempt >= policy.MaxAttempts {
+			break
+		}
+		delay := policy.delay(attempt, r)
+		if verbose {
+			fmt.Printf("%s: %d %s, retrying in %s\n", utl.Yel("status"), r.StatusCode, http.StatusText(r.StatusCode), delay)
+		}
+		if policy.OnRetry != nil {
+			var errBody jsonT
+			json.Unmarshal(resBody, &errBody) // Best effort, only to enrich the event's error
+			policy.OnRetry(RetryEvent{
+				Method:     method,
+				Url:        url,
+				Attempt:    attempt,
+				StatusCode: r.StatusCode,
+				Delay:      delay,
+				Err:        newApiError(method, url, r, errBody),
+				Header:     r.Header,
+			})
+		}
+		select {
+		case <-ctx.Done():
+			return nil, r.StatusCode, ctx.Err()
+		case <-time.After(delay):
 		}
 	}
-	r, err := client.Do(req) // Make the call
-	if err != nil {
-		panic(err.Error())
-	}
-	defer r.Body.Close()
-	body, err := io.ReadAll(r.Body) // Read the response body
-	if err != nil {
-		panic(err.Error())
-	}
-	// This function caters to Microsoft Azure REST API calls. Note that variable 'body' is of type
+	// This function caters to Microsoft Azure REST API calls. Note that variable 'resBody' is of type
 	// []uint8, which is essentially a long string that evidently can be either: 1) a single integer
 	// number, or 2) a JSON object string that needs unmarshalling. Below conditional is based on
 	// this interpretation, but may need confirmation then better handling
 
 	// Create jsonResult variable object to be return
 	var jsonResult map[string]interface{} = nil
-	if intValue, err := strconv.ParseInt(string(body), 10, 64); err == nil {
+	if intValue, err := strconv.ParseInt(string(resBody), 10, 64); err == nil {
 		// It's an integer, probably an API object count value
 		jsonResult = make(map[string]interface{})
 		jsonResult["value"] = intValue
 	} else {
 		// It's a regular JSON result, or null
-		if len(body) > 0 { // Make sure we have something to unmarshal, else guaranteed panic
-			if err = json.Unmarshal([]byte(body), &jsonResult); err != nil {
-				panic(err.Error())
+		if len(resBody) > 0 { // Make sure we have something to unmarshal
+			if err = json.Unmarshal(resBody, &jsonResult); err != nil {
+				return nil, r.StatusCode, fmt.Errorf("%s %s: decoding response: %w", method, url, err)
 			}
 		}
 		// If it's null, returning r.StatusCode below will let caller know
@@ -158,14 +240,15 @@ func ApiCall(method, url string, z Bundle, payload jsonT, params strMapT, verbos
 		fmt.Printf("%s: %d %s\n", utl.Blu("status"), r.StatusCode, http.StatusText(r.StatusCode))
 		fmt.Println(utl.Blu("result") + ":")
 		utl.PrintJsonColor(jsonResult)
-		resHeaders, err := httputil.DumpResponse(r, false)
-		if err != nil {
-			panic(err.Error())
+		if resHeaders, err := httputil.DumpResponse(r, false); err == nil {
+			fmt.Println(utl.Blu("headers") + ":")
+			fmt.Println(string(resHeaders))
 		}
-		fmt.Println(utl.Blu("headers") + ":")
-		fmt.Println(string(resHeaders))
 	}
-	return jsonResult, r.StatusCode, err
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return jsonResult, r.StatusCode, newApiError(method, url, r, jsonResult)
+	}
+	return jsonResult, r.StatusCode, nil
 }
 
 // Prints useful error information if they occur
@@ -0,0 +1,90 @@
+package maz
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ApiResource describes an Azure API, other than MS Graph and Azure Resource Management, that
+// ApiCall can also call with the same authentication, retry and error handling. Requests go to
+// the resource whose base URL they are under, or whose host they are a subdomain of, so that
+// for instance "https://myvault.vault.azure.net/secrets" uses the "https://vault.azure.net" one.
+// The token for each resource is acquired on the first call to it, and refreshed as needed.
+type ApiResource struct {
+	Name    string            // Short name, e.g. "KeyVault"
+	Url     string            // Base URL, e.g. "https://vault.azure.net"
+	Scope   string            // Token scope, e.g. "https://vault.azure.net/.default"
+	Headers map[string]string // Headers sent with every request. Content-Type defaults to JSON
+}
+
+// Names of the API resources built into every cloud profile
+const (
+	ConstKeyVaultApi     = "KeyVault"
+	ConstLogAnalyticsApi = "LogAnalytics"
+	ConstStorageApi      = "Storage"
+)
+
+// Returns true if given request URL is for this resource
+func (r ApiResource) matches(rawUrl string) bool {
+	return urlUnder(rawUrl, r.Url, true)
+}
+
+// Returns true if given request URL is under given base URL, meaning it has the same scheme and
+// host, and its path is the base path or below it on a "/" boundary. If subdomains is true, hosts
+// that are subdomains of the base one also match.
+func urlUnder(rawUrl, baseUrl string, subdomains bool) bool {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	base, err := url.Parse(baseUrl)
+	if err != nil || base.Host == "" {
+		return false
+	}
+	if !strings.EqualFold(u.Scheme, base.Scheme) {
+		return false
+	}
+	host, baseHost := strings.ToLower(u.Host), strings.ToLower(base.Host)
+	if host != baseHost && !(subdomains && strings.HasSuffix(host, "."+baseHost)) {
+		return false
+	}
+	basePath := strings.TrimSuffix(base.Path, "/")
+	return basePath == "" || u.Path == basePath || strings.HasPrefix(u.Path, basePath+"/")
+}
+
+// Returns the API resources in effect for this bundle, the ones in z.Apis first, so they can
+// override the cloud's built-in ones
+func (z Bundle) apiResources() []ApiResource {
+	return append(append([]ApiResource{}, z.Apis...), z.cloud().Apis...)
+}
+
+// Returns the API resource with given name, ignoring case
+func (z Bundle) ApiResource(name string) (ApiResource, error) {
+	for _, r := range z.apiResources() {
+		if strings.EqualFold(r.Name, name) {
+			return r, nil
+		}
+	}
+	return ApiResource{}, fmt.Errorf("unknown API resource '%s'", name)
+}
+
+// Returns the API resource that given request URL is for, if any
+func (z Bundle) apiResourceFor(rawUrl string) (ApiResource, bool) {
+	for _, r := range z.apiResources() {
+		if r.matches(rawUrl) {
+			return r, true
+		}
+	}
+	return ApiResource{}, false
+}
+
+// Returns the headers for requests to given API resource, without the Authorization one, which
+// ApiCall sets on every request
+func (r ApiResource) headers() strMapT {
+	headers := strMapT{"Content-Type": "application/json"}
+	for h, v := range r.Headers {
+		headers[h] = v
+	}
+	return headers
+}
@@ -1,8 +1,9 @@
 package maz
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"path/filepath"
 	"strings"
 
 	"github.com/google/uuid"
@@ -23,7 +24,10 @@ func PrintRoleAssignment(x map[string]interface{}, z Bundle) {
 		fmt.Println("  < Missing properties? What's going? >")
 	}
 
-	xProp := x["properties"].(map[string]interface{})
+	xProp, ok := x["properties"].(map[string]interface{})
+	if !ok {
+		return
+	}
 
 	roleNameMap := GetIdMapRoleDefs(z) // Get all role definition id:name pairs
 	roleId := utl.LastElem(utl.Str(xProp["roleDefinitionId"]), "/")
@@ -77,10 +81,17 @@ func PrintRoleAssignmentReport(z Bundle) {
 	userNameMap := GetIdMapUsers(z)    // Get all users id:name pairs
 	spNameMap := GetIdMapSps(z)        // Get all SPs id:name pairs
 
-	assignments := GetAzRoleAssignments(z, false)
+	assignments, err := GetAzRoleAssignments(z, false)
+	if err != nil {
+		fmt.Println(utl.Red(err.Error()))
+		return
+	}
 	for _, i := range assignments {
-		x := i.(map[string]interface{})
-		xProp := x["properties"].(map[string]interface{})
+		x, _ := i.(map[string]interface{})
+		xProp, ok := x["properties"].(map[string]interface{})
+		if !ok {
+			continue // Skip malformed entries
+		}
 		Rid := utl.LastElem(utl.Str(xProp["roleDefinitionId"]), "/")
 		principalId := utl.Str(xProp["principalId"])
 		Type := utl.Str(xProp["principalType"])
@@ -108,11 +119,17 @@ func PrintRoleAssignmentReport(z Bundle) {
 }
 
 // Creates an RBAC role assignment as defined by give x object
-func CreateAzRoleAssignment(x map[string]interface{}, z Bundle) {
+func CreateAzRoleAssignment(x map[string]interface{}, z Bundle) error {
+	return CreateAzRoleAssignmentCtx(context.Background(), x, z)
+}
+
+// Context-aware version of CreateAzRoleAssignment
+func CreateAzRoleAssignmentCtx(ctx context.Context, x map[string]interface{}, z Bundle) error {
 	if x == nil {
-		return
+		return nil
 	}
-	xProp := x["properties"].(map[string]interface{})
+	// A missing or malformed 'properties' object is reported by the check below
+	xProp, _ := x["properties"].(map[string]interface{})
 	roleDefinitionId := utl.LastElem(utl.Str(xProp["roleDefinitionId"]), "/") // Note we only care about the UUID
 	principalId := utl.Str(xProp["principalId"])
 	scope := utl.Str(xProp["scope"])
@@ -120,12 +137,12 @@ func CreateAzRoleAssignment(x map[string]interface{}, z Bundle) {
 		scope = utl.Str(xProp["Scope"]) // Account for possibly capitalized key
 	}
 	if roleDefinitionId == "" || principalId == "" || scope == "" {
-		utl.Die("Specfile is missing required attributes. Need at least:\n\n" +
+		return fmt.Errorf("specfile is missing required attributes. Need at least:\n\n" +
 			"properties:\n" +
 			"    roleDefinitionId: <UUID or fully_qualified_roleDefinitionId>\n" +
 			"    principalId: <UUID>\n" +
 			"    scope: <resource_path_scope>\n\n" +
-			"See script '-k*' options to create properly formatted sample files.\n")
+			"See script '-k*' options to create properly formatted sample files")
 	}
 
 	// Note, there is no need to pre-check if assignment exists, since call will simply let us know
@@ -137,15 +154,13 @@ func CreateAzRoleAssignment(x map[string]interface{}, z Bundle) {
 		},
 	}
 	params := map[string]string{"api-version": "2022-04-01"} // roleAssignments
-	url := ConstAzUrl + scope + "/providers/Microsoft.Authorization/roleAssignments/" + newUuid
-	r, statusCode, _ := ApiPut(url, z, payload, params)
-	//ApiErrorCheck("PUT", url, utl.Trace(), r)
-	if statusCode == 200 || statusCode == 201 {
-		utl.PrintYaml(r)
-	} else {
-		e := r["error"].(map[string]interface{})
-		fmt.Println(e["message"].(string))
+	url := z.AzUrl() + scope + "/providers/Microsoft.Authorization/roleAssignments/" + newUuid
+	r, _, err := ApiPutCtx(ctx, url, z, payload, params)
+	if err != nil {
+		return err
 	}
+	utl.PrintYaml(r)
+	return nil
 }
 
 // Deletes an RBAC role assignment by its fully qualified object Id
@@ -153,136 +168,123 @@ func CreateAzRoleAssignment(x map[string]interface{}, z Bundle) {
 //
 //	/providers/Microsoft.Management/managementGroups/33550b0b-2929-4b4b-adad-cccc66664444 \
 //	  /providers/Microsoft.Authorization/roleAssignments/5d586a7b-3f4b-4b5c-844a-3fa8efe49ab3
-func DeleteAzRoleAssignmentByFqid(fqid string, z Bundle) map[string]interface{} {
+func DeleteAzRoleAssignmentByFqid(fqid string, z Bundle) error {
+	return DeleteAzRoleAssignmentByFqidCtx(context.Background(), fqid, z)
+}
+
+// Context-aware version of DeleteAzRoleAssignmentByFqid
+func DeleteAzRoleAssignmentByFqidCtx(ctx context.Context, fqid string, z Bundle) error {
 	params := map[string]string{"api-version": "2022-04-01"} // roleAssignments
-	url := ConstAzUrl + fqid
-	r, statusCode, _ := ApiDelete(url, z, params)
-	//ApiErrorCheck("DELETE", url, utl.Trace(), r)
-	if statusCode != 200 {
-		if statusCode == 204 {
-			fmt.Println("Role assignment already deleted or does not exist. Give Azure a minute to flush it out.")
-		} else {
-			e := r["error"].(map[string]interface{})
-			fmt.Println(e["message"].(string))
-		}
+	url := z.AzUrl() + fqid
+	_, statusCode, err := ApiDeleteCtx(ctx, url, z, params)
+	if err != nil {
+		return err
+	}
+	if statusCode == 204 {
+		fmt.Println("Role assignment already deleted or does not exist. Give Azure a minute to flush it out.")
 	}
 	return nil
 }
 
 // Retrieves count of all role assignment objects in local cache file
 func RoleAssignmentsCountLocal(z Bundle) int64 {
-	var cachedList []interface{} = nil
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_roleAssignments."+ConstCacheFileExtension)
-	if utl.FileUsable(cacheFile) {
-		rawList, _ := utl.LoadFileJsonGzip(cacheFile)
-		if rawList != nil {
-			cachedList = rawList.([]interface{})
-			return int64(len(cachedList))
-		}
-	}
-	return 0
+	return int64(len(getCachedObjects(z, "roleAssignments")))
 }
 
 // Calculates count of all role assignment objects in Azure
-func RoleAssignmentsCountAzure(z Bundle) int64 {
-	list := GetAzRoleAssignments(z, false) // false = quiet
-	return int64(len(list))
+func RoleAssignmentsCountAzure(z Bundle) (int64, error) {
+	return RoleAssignmentsCountAzureCtx(context.Background(), z)
+}
+
+// Context-aware version of RoleAssignmentsCountAzure
+func RoleAssignmentsCountAzureCtx(ctx context.Context, z Bundle) (int64, error) {
+	list, err := GetAzRoleAssignmentsCtx(ctx, z, false) // false = quiet
+	return int64(len(list)), err
 }
 
 // Gets all RBAC role assignments matching on 'filter'. Return entire list if filter is empty ""
-func GetMatchingRoleAssignments(filter string, force bool, z Bundle) (list []interface{}) {
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_roleAssignments."+ConstCacheFileExtension)
-	cacheFileAge := utl.FileAge(cacheFile)
-	if utl.InternetIsAvailable() && (force || cacheFileAge == 0 || cacheFileAge > ConstAzCacheFileAgePeriod) {
-		// If Internet is available AND (force was requested OR cacheFileAge is zero (meaning does not exist)
+func GetMatchingRoleAssignments(filter string, force bool, z Bundle) (list []interface{}, err error) {
+	return GetMatchingRoleAssignmentsCtx(context.Background(), filter, force, z)
+}
+
+// Context-aware version of GetMatchingRoleAssignments
+func GetMatchingRoleAssignmentsCtx(ctx context.Context, filter string, force bool, z Bundle) (list []interface{}, err error) {
+	cacheAge := getCacheAge(z, "roleAssignments")
+	if utl.InternetIsAvailable() && (force || cacheAge == 0 || cacheAge > ConstAzCacheFileAgePeriod) {
+		// If Internet is available AND (force was requested OR cacheAge is zero (meaning does not exist)
 		// OR it is older than ConstAzCacheFileAgePeriod) then query Azure directly to get all objects
 		// and show progress while doing so (true = verbose below)
-		list = GetAzRoleAssignments(z, true)
+		list, err = GetAzRoleAssignmentsCtx(ctx, z, true)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		// Use local cache for all other conditions
-		list = GetCachedObjects(cacheFile)
+		list = getCachedObjects(z, "roleAssignments")
 	}
 
 	if filter == "" {
-		return list
+		return list, nil
 	}
 	var matchingList []interface{} = nil
 	roleNameMap := GetIdMapRoleDefs(z) // Get all role definition id:name pairs
 	for _, i := range list {           // Parse every object
-		x := i.(map[string]interface{})
+		x, ok := i.(map[string]interface{})
+		if !ok {
+			continue // Skip malformed entries
+		}
 		// Match against relevant strings within roleAssigment JSON object (Note: Not all attributes are maintained)
-		xProp := x["properties"].(map[string]interface{})
+		xProp, _ := x["properties"].(map[string]interface{})
 		roleId := utl.Str(xProp["roleDefinitionId"])
 		roleName := roleNameMap[utl.LastElem(roleId, "/")]
 		if utl.SubString(roleName, filter) || utl.StringInJson(x, filter) {
 			matchingList = append(matchingList, x)
 		}
 	}
-	return matchingList
+	return matchingList, nil
 }
 
 // Gets all role assignments objects in current Azure tenant and save them to local cache file.
 // Option to be verbose (true) or quiet (false), since it can take a while.
+// Uses a Resource Graph query, unless z.RbacQuery says to walk all the scopes instead.
 // References:
 //
 //	https://learn.microsoft.com/en-us/azure/role-based-access-control/role-assignments-list-rest
 //	https://learn.microsoft.com/en-us/rest/api/authorization/role-assignments/list-for-subscription
-func GetAzRoleAssignments(z Bundle, verbose bool) (list []interface{}) {
-	list = nil             // We have to zero it out
-	var uniqueIds []string // Keep track of assignment objects
-	k := 1                 // Track number of API calls to provide progress
+func GetAzRoleAssignments(z Bundle, verbose bool) (list []interface{}, err error) {
+	return GetAzRoleAssignmentsCtx(context.Background(), z, verbose)
+}
 
-	var mgGroupNameMap, subNameMap map[string]string
-	if verbose {
-		mgGroupNameMap = GetIdMapMgGroups(z)
-		subNameMap = GetIdMapSubs(z)
+// Context-aware version of GetAzRoleAssignments
+func GetAzRoleAssignmentsCtx(ctx context.Context, z Bundle, verbose bool) (list []interface{}, err error) {
+	list, ok, err := getAzRbacObjectsFast(ctx, z, "roleAssignments", verbose)
+	if !ok {
+		list, err = getAzRbacObjectsByScopes(ctx, z, "roleAssignments", verbose)
 	}
-
-	scopes := GetAzRbacScopes(z)                             // Get all scopes
-	params := map[string]string{"api-version": "2022-04-01"} // roleAssignments
-	for _, scope := range scopes {
-		url := ConstAzUrl + scope + "/providers/Microsoft.Authorization/roleAssignments"
-		r, _, _ := ApiGet(url, z, params)
-		if r != nil && r["value"] != nil {
-			objectsUnderThisScope := r["value"].([]interface{})
-			count := 0
-			for _, i := range objectsUnderThisScope {
-				x := i.(map[string]interface{})
-				uuid := utl.Str(x["name"])
-				if utl.ItemInList(uuid, uniqueIds) {
-					continue // Skip this repeated one. This can happen due to inherited nesting
-				}
-				uniqueIds = append(uniqueIds, uuid) // Keep track of the UUIDs we are seeing
-				list = append(list, x)
-				count++
-			}
-			if verbose && count > 0 {
-				scopeName := scope
-				if strings.HasPrefix(scope, "/providers") {
-					scopeName = mgGroupNameMap[scope]
-				} else if strings.HasPrefix(scope, "/subscriptions") {
-					scopeName = subNameMap[utl.LastElem(scope, "/")]
-				}
-				fmt.Printf("API call %4d: %5d objects under %s\n", k, count, scopeName)
-			}
-		}
-		k++
+	if err != nil {
+		return nil, err
 	}
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_roleAssignments."+ConstCacheFileExtension)
-	utl.SaveFileJsonGzip(list, cacheFile) // Update the local cache
-	return list
+	if err := saveCachedObjects(z, "roleAssignments", list); err != nil { // Update the local cache
+		return nil, err
+	}
+	return list, nil
 }
 
 // Gets Azure resource RBAC role assignment object by matching given objects: roleId, principalId,
 // and scope (the 3 parameters which make a role assignment unique)
-func GetAzRoleAssignmentByObject(x map[string]interface{}, z Bundle) (y map[string]interface{}) {
+func GetAzRoleAssignmentByObject(x map[string]interface{}, z Bundle) (y map[string]interface{}, err error) {
+	return GetAzRoleAssignmentByObjectCtx(context.Background(), x, z)
+}
+
+// Context-aware version of GetAzRoleAssignmentByObject
+func GetAzRoleAssignmentByObjectCtx(ctx context.Context, x map[string]interface{}, z Bundle) (y map[string]interface{}, err error) {
 	// First, make sure x is a searchable role assignment object
 	if x == nil {
-		return nil
+		return nil, nil
 	}
-	xProp := x["properties"].(map[string]interface{})
+	xProp, _ := x["properties"].(map[string]interface{})
 	if xProp == nil {
-		return nil
+		return nil, nil
 	}
 
 	xRoleDefinitionId := utl.LastElem(utl.Str(xProp["roleDefinitionId"]), "/")
@@ -292,7 +294,7 @@ func GetAzRoleAssignmentByObject(x map[string]interface{}, z Bundle) (y map[stri
 		xScope = utl.Str(xProp["Scope"]) // Account for possibly capitalized key
 	}
 	if xScope == "" || xPrincipalId == "" || xRoleDefinitionId == "" {
-		return nil
+		return nil, nil
 	}
 
 	// Get all role assignments for xPrincipalId under xScope
@@ -300,9 +302,11 @@ func GetAzRoleAssignmentByObject(x map[string]interface{}, z Bundle) (y map[stri
 		"api-version": "2022-04-01", // roleAssignments
 		"$filter":     "principalId eq '" + xPrincipalId + "'",
 	}
-	url := ConstAzUrl + xScope + "/providers/Microsoft.Authorization/roleAssignments"
-	r, _, _ := ApiGet(url, z, params)
-	//ApiErrorCheck("GET", url, utl.Trace(), r)
+	url := z.AzUrl() + xScope + "/providers/Microsoft.Authorization/roleAssignments"
+	r, _, err := ApiGetCtx(ctx, url, z, params)
+	if err != nil {
+		return nil, err
+	}
 	if r != nil && r["value"] != nil {
 		results := r["value"].([]interface{})
 		//fmt.Println(len(results))
@@ -312,30 +316,58 @@ func GetAzRoleAssignmentByObject(x map[string]interface{}, z Bundle) (y map[stri
 			yScope := utl.Str(yProp["scope"])
 			yRoleDefinitionId := utl.LastElem(utl.Str(yProp["roleDefinitionId"]), "/")
 			if yScope == xScope && yRoleDefinitionId == xRoleDefinitionId {
-				return y // As soon as we find it
+				return y, nil // As soon as we find it
 			}
 		}
 	}
-	return nil // If we get here, we didn't fine it, so return nil
+	return nil, nil // If we get here, we didn't fine it, so return nil
 }
 
 // Gets RBAC role assignment by its Object UUID. Unfortunately we have to iterate
 // through the entire tenant scope hierarchy, which can take time.
-func GetAzRoleAssignmentByUuid(uuid string, z Bundle) map[string]interface{} {
-	scopes := GetAzRbacScopes(z)
+func GetAzRoleAssignmentByUuid(uuid string, z Bundle) (map[string]interface{}, error) {
+	return GetAzRoleAssignmentByUuidCtx(context.Background(), uuid, z)
+}
+
+// Context-aware version of GetAzRoleAssignmentByUuid
+func GetAzRoleAssignmentByUuidCtx(ctx context.Context, uuid string, z Bundle) (map[string]interface{}, error) {
+	scopes, err := GetAzRbacScopesCtx(ctx, z)
+	if err != nil {
+		return nil, err
+	}
 	params := map[string]string{"api-version": "2022-04-01"} // roleAssignments
-	for _, scope := range scopes {
-		url := ConstAzUrl + scope + "/providers/Microsoft.Authorization/roleAssignments"
-		r, _, _ := ApiGet(url, z, params)
+	fetch := func(ctx context.Context, z Bundle, scope string) (map[string]interface{}, error) {
+		url := z.AzUrl() + scope + "/providers/Microsoft.Authorization/roleAssignments"
+		r, _, err := ApiGetCtx(ctx, url, z, params)
+		return r, err
+	}
+	var match map[string]interface{} = nil
+	var lastErr error = nil // Remember failures, in case we find nothing
+	err = forEachScope(ctx, z, scopes, fetch, func(k int, scope string, r map[string]interface{}, err error) bool {
+		if err != nil {
+			lastErr = err
+			return true
+		}
 		if r != nil && r["value"] != nil {
 			assignmentsUnderThisScope := r["value"].([]interface{})
 			for _, i := range assignmentsUnderThisScope {
 				x := i.(map[string]interface{})
 				if utl.Str(x["name"]) == uuid {
-					return x // Return as soon as we find a match
+					match = x
+					return false // Stop as soon as we find a match
 				}
 			}
 		}
+		return true
+	})
+	if err != nil {
+		return nil, err // Only happens once cancelled
 	}
-	return nil
+	if match != nil {
+		return match, nil
+	}
+	if lastErr != nil && !errors.Is(lastErr, ErrNotFound) {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("role assignment %s: %w", uuid, ErrNotFound)
 }
@@ -1,8 +1,9 @@
 package maz
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"path/filepath"
 	"strings"
 
 	"github.com/google/uuid"
@@ -23,7 +24,10 @@ func PrintRoleDefinition(x map[string]interface{}, z Bundle) {
 		fmt.Println(utl.Red("  <Missing properties??>"))
 	}
 
-	xProp := x["properties"].(map[string]interface{})
+	xProp, ok := x["properties"].(map[string]interface{})
+	if !ok {
+		return
+	}
 
 	list := []string{"roleName", "description"}
 	for _, i := range list {
@@ -120,11 +124,14 @@ func PrintRoleDefinition(x map[string]interface{}, z Bundle) {
 }
 
 // Creates or updates an RBAC role definition as defined by give x object
-func UpsertAzRoleDefinition(force bool, x map[string]interface{}, z Bundle) {
+func UpsertAzRoleDefinition(force bool, x map[string]interface{}, z Bundle) error {
 	if x == nil {
-		return
+		return nil
+	}
+	xProp, ok := x["properties"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("specfile is missing the role definition 'properties' object")
 	}
-	xProp := x["properties"].(map[string]interface{})
 	xRoleName := utl.Str(xProp["roleName"])
 	// Below two are required in the API body call, but we don't need to burden
 	// the user with this requirement, and just update the values for them here.
@@ -142,18 +149,21 @@ func UpsertAzRoleDefinition(force bool, x map[string]interface{}, z Bundle) {
 	}
 	if xProp == nil || xScopes == nil || xRoleName == "" || xScope1 == "" ||
 		permSet == nil || len(permSet) < 1 {
-		utl.Die("Specfile is missing required attributes. The bare minimum is:\n\n" +
+		return fmt.Errorf("specfile is missing required attributes. The bare minimum is:\n\n" +
 			"properties:\n" +
 			"  roleName: \"My Role Name\"\n" +
 			"  assignableScopes:\n" +
 			"    - /providers/Microsoft.Management/managementGroups/3f550b9f-8888-7777-ad61-111199992222\n" +
 			"  permissions:\n" +
 			"    - actions:\n\n" +
-			"See script '-k*' options to create properly formatted sample files.\n")
+			"See script '-k*' options to create properly formatted sample files")
 	}
 
 	roleId := ""
-	existing := GetAzRoleDefinitionByName(xRoleName, z)
+	existing, err := GetAzRoleDefinitionByName(xRoleName, z)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
 	if existing == nil {
 		// Role definition doesn't exist, so we're creating a new one
 		roleId = uuid.New().String() // Generate a new global UUID in string format
@@ -163,7 +173,7 @@ func UpsertAzRoleDefinition(force bool, x map[string]interface{}, z Bundle) {
 		if !force {
 			msg := utl.Yel("Role already exists! UPDATE it? y/n ")
 			if utl.PromptMsg(msg) != 'y' {
-				utl.Die("Aborted.\n")
+				return ErrAborted
 			}
 		}
 		fmt.Println("Updating role ...")
@@ -172,32 +182,33 @@ func UpsertAzRoleDefinition(force bool, x map[string]interface{}, z Bundle) {
 
 	payload := x                                             // Obviously using x object as the payload
 	params := map[string]string{"api-version": "2022-04-01"} // roleDefinitions
-	url := ConstAzUrl + xScope1 + "/providers/Microsoft.Authorization/roleDefinitions/" + roleId
-	r, statusCode, _ := ApiPut(url, z, payload, params)
-	if statusCode == 201 {
-		PrintRoleDefinition(r, z) // Print the newly updated object
-	} else {
-		e := r["error"].(map[string]interface{})
-		fmt.Println(e["message"].(string))
+	url := z.AzUrl() + xScope1 + "/providers/Microsoft.Authorization/roleDefinitions/" + roleId
+	r, _, err := ApiPut(url, z, payload, params)
+	if err != nil {
+		return err
 	}
+	PrintRoleDefinition(r, z) // Print the newly updated object
+	return nil
 }
 
 // Deletes an RBAC role definition object by its fully qualified object Id
 // Example of a fully qualified Id string:
 //
 //	"/providers/Microsoft.Authorization/roleDefinitions/50a6ff7c-3ac5-4acc-b4f4-9a43aee0c80f"
-func DeleteAzRoleDefinitionByFqid(fqid string, z Bundle) map[string]interface{} {
+func DeleteAzRoleDefinitionByFqid(fqid string, z Bundle) error {
+	return DeleteAzRoleDefinitionByFqidCtx(context.Background(), fqid, z)
+}
+
+// Context-aware version of DeleteAzRoleDefinitionByFqid
+func DeleteAzRoleDefinitionByFqidCtx(ctx context.Context, fqid string, z Bundle) error {
 	params := map[string]string{"api-version": "2022-04-01"} // roleDefinitions
-	url := ConstAzUrl + fqid
-	r, statusCode, _ := ApiDelete(url, z, params)
-	//ApiErrorCheck("DELETE", url, utl.Trace(), r)
-	if statusCode != 200 {
-		if statusCode == 204 {
-			fmt.Println("Role definition already deleted or does not exist. Give Azure a minute to flush it out.")
-		} else {
-			e := r["error"].(map[string]interface{})
-			fmt.Println(e["message"].(string))
-		}
+	url := z.AzUrl() + fqid
+	_, statusCode, err := ApiDeleteCtx(ctx, url, z, params)
+	if err != nil {
+		return err
+	}
+	if statusCode == 204 {
+		fmt.Println("Role definition already deleted or does not exist. Give Azure a minute to flush it out.")
 	}
 	return nil
 }
@@ -205,12 +216,12 @@ func DeleteAzRoleDefinitionByFqid(fqid string, z Bundle) map[string]interface{}
 // Returns id:name map of all RBAC role definitions
 func GetIdMapRoleDefs(z Bundle) (nameMap map[string]string) {
 	nameMap = make(map[string]string)
-	roleDefs := GetMatchingRoleDefinitions("", false, z) // false = don't force going to Azure
+	roleDefs, _ := GetMatchingRoleDefinitions("", false, z) // false = don't force going to Azure
 	// By not forcing an Azure call we're opting for cache speed over id:name map accuracy
 	for _, i := range roleDefs {
-		x := i.(map[string]interface{})
+		x, _ := i.(map[string]interface{})
 		if x["name"] != nil {
-			xProp := x["properties"].(map[string]interface{})
+			xProp, _ := x["properties"].(map[string]interface{})
 			if xProp["roleName"] != nil {
 				nameMap[utl.Str(x["name"])] = utl.Str(xProp["roleName"])
 			}
@@ -223,59 +234,67 @@ func GetIdMapRoleDefs(z Bundle) (nameMap map[string]string) {
 func RoleDefinitionCountLocal(z Bundle) (builtin, custom int64) {
 	var customList []interface{} = nil
 	var builtinList []interface{} = nil
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_roleDefinitions."+ConstCacheFileExtension)
-	if utl.FileUsable(cacheFile) {
-		rawList, _ := utl.LoadFileJsonGzip(cacheFile)
-		if rawList != nil {
-			definitions := rawList.([]interface{})
-			for _, i := range definitions {
-				x := i.(map[string]interface{}) // Assert as JSON object type
-				xProp := x["properties"].(map[string]interface{})
-				if utl.Str(xProp["type"]) == "CustomRole" {
-					customList = append(customList, x)
-				} else {
-					builtinList = append(builtinList, x)
-				}
-			}
-			return int64(len(builtinList)), int64(len(customList))
+	definitions := getCachedObjects(z, "roleDefinitions")
+	for _, i := range definitions {
+		x, _ := i.(map[string]interface{}) // Assert as JSON object type
+		xProp, _ := x["properties"].(map[string]interface{})
+		if utl.Str(xProp["type"]) == "CustomRole" {
+			customList = append(customList, x)
+		} else {
+			builtinList = append(builtinList, x)
 		}
 	}
-	return 0, 0
+	return int64(len(builtinList)), int64(len(customList))
 }
 
 // Counts all role definition in Azure. Returns 2 lists: one of native custom roles, the other of built-in role
-func RoleDefinitionCountAzure(z Bundle) (builtin, custom int64) {
+func RoleDefinitionCountAzure(z Bundle) (builtin, custom int64, err error) {
+	return RoleDefinitionCountAzureCtx(context.Background(), z)
+}
+
+// Context-aware version of RoleDefinitionCountAzure
+func RoleDefinitionCountAzureCtx(ctx context.Context, z Bundle) (builtin, custom int64, err error) {
 	var customList []interface{} = nil
 	var builtinList []interface{} = nil
-	definitions := GetAzRoleDefinitions(z, false) // false = be silent
+	definitions, err := GetAzRoleDefinitionsCtx(ctx, z, false) // false = be silent
+	if err != nil {
+		return 0, 0, err
+	}
 	for _, i := range definitions {
-		x := i.(map[string]interface{}) // Assert as JSON object type
-		xProp := x["properties"].(map[string]interface{})
+		x, _ := i.(map[string]interface{}) // Assert as JSON object type
+		xProp, _ := x["properties"].(map[string]interface{})
 		if utl.Str(xProp["type"]) == "CustomRole" {
 			customList = append(customList, x)
 		} else {
 			builtinList = append(builtinList, x)
 		}
 	}
-	return int64(len(builtinList)), int64(len(customList))
+	return int64(len(builtinList)), int64(len(customList)), nil
 }
 
 // Gets all role definitions matching on 'filter'. Returns entire list if filter is empty ""
-func GetMatchingRoleDefinitions(filter string, force bool, z Bundle) (list []interface{}) {
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_roleDefinitions."+ConstCacheFileExtension)
-	cacheFileAge := utl.FileAge(cacheFile)
-	if utl.InternetIsAvailable() && (force || cacheFileAge == 0 || cacheFileAge > ConstAzCacheFileAgePeriod) {
-		// If Internet is available AND (force was requested OR cacheFileAge is zero (meaning does not exist)
+func GetMatchingRoleDefinitions(filter string, force bool, z Bundle) (list []interface{}, err error) {
+	return GetMatchingRoleDefinitionsCtx(context.Background(), filter, force, z)
+}
+
+// Context-aware version of GetMatchingRoleDefinitions
+func GetMatchingRoleDefinitionsCtx(ctx context.Context, filter string, force bool, z Bundle) (list []interface{}, err error) {
+	cacheAge := getCacheAge(z, "roleDefinitions")
+	if utl.InternetIsAvailable() && (force || cacheAge == 0 || cacheAge > ConstAzCacheFileAgePeriod) {
+		// If Internet is available AND (force was requested OR cacheAge is zero (meaning does not exist)
 		// OR it is older than ConstAzCacheFileAgePeriod) then query Azure directly to get all objects
 		// and show progress while doing so (true = verbose below)
-		list = GetAzRoleDefinitions(z, true)
+		list, err = GetAzRoleDefinitionsCtx(ctx, z, true)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		// Use local cache for all other conditions
-		list = GetCachedObjects(cacheFile)
+		list = getCachedObjects(z, "roleDefinitions")
 	}
 
 	if filter == "" {
-		return list
+		return list, nil
 	}
 	var matchingList []interface{} = nil
 	for _, i := range list { // Parse every object
@@ -285,105 +304,109 @@ func GetMatchingRoleDefinitions(filter string, force bool, z Bundle) (list []int
 			matchingList = append(matchingList, x)
 		}
 	}
-	return matchingList
+	return matchingList, nil
 }
 
 // Gets all role definitions in current Azure tenant and save them to local cache file
 // Option to be verbose (true) or quiet (false), since it can take a while.
+// Uses a Resource Graph query, unless z.RbacQuery says to walk all the scopes instead.
 // References:
 //
 //	https://learn.microsoft.com/en-us/azure/role-based-access-control/role-definitions-list
 //	https://learn.microsoft.com/en-us/rest/api/authorization/role-definitions/list
-func GetAzRoleDefinitions(z Bundle, verbose bool) (list []interface{}) {
-	list = nil             // We have to zero it out
-	var uniqueIds []string // Keep track of assignment objects
-	k := 1                 // Track number of API calls to provide progress
+func GetAzRoleDefinitions(z Bundle, verbose bool) (list []interface{}, err error) {
+	return GetAzRoleDefinitionsCtx(context.Background(), z, verbose)
+}
 
-	var mgGroupNameMap, subNameMap map[string]string
-	if verbose {
-		mgGroupNameMap = GetIdMapMgGroups(z)
-		subNameMap = GetIdMapSubs(z)
+// Context-aware version of GetAzRoleDefinitions
+func GetAzRoleDefinitionsCtx(ctx context.Context, z Bundle, verbose bool) (list []interface{}, err error) {
+	list, ok, err := getAzRbacObjectsFast(ctx, z, "roleDefinitions", verbose)
+	if !ok {
+		list, err = getAzRbacObjectsByScopes(ctx, z, "roleDefinitions", verbose)
 	}
-
-	scopes := GetAzRbacScopes(z)                             // Get all scopes
-	params := map[string]string{"api-version": "2022-04-01"} // roleDefinitions
-	for _, scope := range scopes {
-		url := ConstAzUrl + scope + "/providers/Microsoft.Authorization/roleDefinitions"
-		r, _, _ := ApiGet(url, z, params)
-		if r != nil && r["value"] != nil {
-			objectsUnderThisScope := r["value"].([]interface{})
-			count := 0
-			for _, i := range objectsUnderThisScope {
-				x := i.(map[string]interface{})
-				uuid := utl.Str(x["name"])
-				if utl.ItemInList(uuid, uniqueIds) {
-					continue // Skip this repeated one. This can happen due to inherited nesting
-				}
-				uniqueIds = append(uniqueIds, uuid) // Keep track of the UUIDs we are seeing
-				list = append(list, x)
-				count++
-			}
-			if verbose && count > 0 {
-				scopeName := scope
-				if strings.HasPrefix(scope, "/providers") {
-					scopeName = mgGroupNameMap[scope]
-				} else if strings.HasPrefix(scope, "/subscriptions") {
-					scopeName = subNameMap[utl.LastElem(scope, "/")]
-				}
-				fmt.Printf("API call %4d: %5d objects under %s\n", k, count, scopeName)
-			}
-		}
-		k++
+	if err != nil {
+		return nil, err
+	}
+	if err := saveCachedObjects(z, "roleDefinitions", list); err != nil { // Update the local cache
+		return nil, err
 	}
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_roleDefinitions."+ConstCacheFileExtension)
-	utl.SaveFileJsonGzip(list, cacheFile) // Update the local cache
-	return list
+	return list, nil
 }
 
 // Gets role definition by displayName
 // See https://learn.microsoft.com/en-us/rest/api/authorization/role-definitions/list
-func GetAzRoleDefinitionByName(roleName string, z Bundle) (y map[string]interface{}) {
+func GetAzRoleDefinitionByName(roleName string, z Bundle) (y map[string]interface{}, err error) {
+	return GetAzRoleDefinitionByNameCtx(context.Background(), roleName, z)
+}
+
+// Context-aware version of GetAzRoleDefinitionByName
+func GetAzRoleDefinitionByNameCtx(ctx context.Context, roleName string, z Bundle) (y map[string]interface{}, err error) {
 	y = nil
-	scopes := GetAzRbacScopes(z) // Get all scopes
+	scopes, err := GetAzRbacScopesCtx(ctx, z) // Get all scopes
+	if err != nil {
+		return nil, err
+	}
 	params := map[string]string{
 		"api-version": "2022-04-01", // roleDefinitions
 		"$filter":     "roleName eq '" + roleName + "'",
 	}
-	for _, scope := range scopes {
-		url := ConstAzUrl + scope + "/providers/Microsoft.Authorization/roleDefinitions"
-		r, _, _ := ApiGet(url, z, params)
-		ApiErrorCheck("GET", url, utl.Trace(), r) // DEBUG. Until ApiGet rewrite with nullable _ err
+	fetch := func(ctx context.Context, z Bundle, scope string) (map[string]interface{}, error) {
+		url := z.AzUrl() + scope + "/providers/Microsoft.Authorization/roleDefinitions"
+		r, _, err := ApiGetCtx(ctx, url, z, params)
+		return r, err
+	}
+	var lastErr error = nil // Remember failures, in case we find nothing
+	err = forEachScope(ctx, z, scopes, fetch, func(k int, scope string, r map[string]interface{}, err error) bool {
+		if err != nil {
+			lastErr = err
+			return true
+		}
 		if r != nil && r["value"] != nil {
 			results := r["value"].([]interface{})
 			if len(results) == 1 {
 				y = results[0].(map[string]interface{}) // Select first, only index entry
-				return y                                // We found it
+				return false                            // We found it
 			}
 		}
+		return true
+	})
+	if err != nil {
+		return nil, err // Only happens once cancelled
+	}
+	if y != nil {
+		return y, nil
 	}
 	// If above logic ever finds than 1, then we have serious issuses, just nil below
-	return nil
+	if lastErr != nil && !errors.Is(lastErr, ErrNotFound) {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("role definition '%s': %w", roleName, ErrNotFound)
 }
 
 // Gets role definition object if it exists exactly as x object (as per essential attributes).
 // Matches on: displayName and assignableScopes
-func GetAzRoleDefinitionByObject(x map[string]interface{}, z Bundle) (y map[string]interface{}) {
+func GetAzRoleDefinitionByObject(x map[string]interface{}, z Bundle) (y map[string]interface{}, err error) {
+	return GetAzRoleDefinitionByObjectCtx(context.Background(), x, z)
+}
+
+// Context-aware version of GetAzRoleDefinitionByObject
+func GetAzRoleDefinitionByObjectCtx(ctx context.Context, x map[string]interface{}, z Bundle) (y map[string]interface{}, err error) {
 	// First, make sure x is a searchable role definition object
 	if x == nil { // Don't look for empty objects
-		return nil
+		return nil, nil
 	}
-	xProp := x["properties"].(map[string]interface{})
+	xProp, _ := x["properties"].(map[string]interface{})
 	if xProp == nil {
-		return nil
+		return nil, nil
 	}
 
-	xScopes := xProp["assignableScopes"].([]interface{})
-	if utl.GetType(xScopes)[0] != '[' || len(xScopes) < 1 {
-		return nil // Return nil if assignableScopes not an array, or it's empty
+	xScopes, _ := xProp["assignableScopes"].([]interface{})
+	if len(xScopes) < 1 {
+		return nil, nil // Return nil if assignableScopes not an array, or it's empty
 	}
 	xRoleName := utl.Str(xProp["roleName"])
 	if xRoleName == "" {
-		return nil
+		return nil, nil
 	}
 
 	// Look for x under all its scopes
@@ -397,33 +420,63 @@ func GetAzRoleDefinitionByObject(x map[string]interface{}, z Bundle) (y map[stri
 			"api-version": "2022-04-01", // roleDefinitions
 			"$filter":     "roleName eq '" + xRoleName + "'",
 		}
-		url := ConstAzUrl + scope + "/providers/Microsoft.Authorization/roleDefinitions"
-		r, _, _ := ApiGet(url, z, params)
-		ApiErrorCheck("GET", url, utl.Trace(), r)
+		url := z.AzUrl() + scope + "/providers/Microsoft.Authorization/roleDefinitions"
+		r, _, err := ApiGetCtx(ctx, url, z, params)
+		if err != nil {
+			return nil, err
+		}
 		if r != nil && r["value"] != nil {
 			results := r["value"].([]interface{})
 			if len(results) == 1 {
 				y = results[0].(map[string]interface{}) // Select first index entry
-				return y                                // We found it
+				return y, nil                           // We found it
 			} else {
-				return nil // If there's more than one entry we have other problems, so just return nil
+				return nil, nil // If there's more than one entry we have other problems, so just return nil
 			}
 		}
 	}
-	return nil
+	return nil, nil
 }
 
 // Gets role definition by Object Id. Unfortunately we have to iterate
 // through the entire tenant scope hierarchy, which can take time.
-func GetAzRoleDefinitionByUuid(uuid string, z Bundle) map[string]interface{} {
-	scopes := GetAzRbacScopes(z)
+func GetAzRoleDefinitionByUuid(uuid string, z Bundle) (map[string]interface{}, error) {
+	return GetAzRoleDefinitionByUuidCtx(context.Background(), uuid, z)
+}
+
+// Context-aware version of GetAzRoleDefinitionByUuid
+func GetAzRoleDefinitionByUuidCtx(ctx context.Context, uuid string, z Bundle) (map[string]interface{}, error) {
+	scopes, err := GetAzRbacScopesCtx(ctx, z)
+	if err != nil {
+		return nil, err
+	}
 	params := map[string]string{"api-version": "2022-04-01"} // roleDefinitions
-	for _, scope := range scopes {
-		url := ConstAzUrl + scope + "/providers/Microsoft.Authorization/roleDefinitions/" + uuid
-		r, _, _ := ApiGet(url, z, params)
+	fetch := func(ctx context.Context, z Bundle, scope string) (map[string]interface{}, error) {
+		url := z.AzUrl() + scope + "/providers/Microsoft.Authorization/roleDefinitions/" + uuid
+		r, _, err := ApiGetCtx(ctx, url, z, params)
+		return r, err
+	}
+	var match map[string]interface{} = nil
+	var lastErr error = nil // Remember failures, in case we find nothing
+	err = forEachScope(ctx, z, scopes, fetch, func(k int, scope string, r map[string]interface{}, err error) bool {
+		if err != nil {
+			lastErr = err
+			return true
+		}
 		if r != nil && r["id"] != nil {
-			return r // Return as soon as we find a match
+			match = r
+			return false // Stop as soon as we find a match
 		}
+		return true
+	})
+	if err != nil {
+		return nil, err // Only happens once cancelled
 	}
-	return nil
+	if match != nil {
+		return match, nil
+	}
+	if lastErr != nil && !errors.Is(lastErr, ErrNotFound) {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("role definition %s: %w", uuid, ErrNotFound)
 }
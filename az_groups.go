@@ -1,8 +1,8 @@
 package maz
 
 import (
+	"context"
 	"fmt"
-	"path/filepath"
 
 	"github.com/queone/utl"
 )
@@ -12,7 +12,7 @@ func PrintMgGroup(x map[string]interface{}) {
 	if x == nil {
 		return
 	}
-	xProp := x["properties"].(map[string]interface{})
+	xProp, _ := x["properties"].(map[string]interface{})
 	fmt.Printf("%-12s: %s\n", utl.Blu("id"), utl.Gre(utl.Str(x["name"])))
 	fmt.Printf("%-12s: %s\n", utl.Blu("displayName"), utl.Gre(utl.Str(xProp["displayName"])))
 	fmt.Printf("%-12s: %s\n", utl.Blu("type"), utl.Gre(MgType(utl.Str(x["type"]))))
@@ -32,28 +32,24 @@ func MgType(typeIn string) string {
 
 // Returns count of management group objects in local cache file
 func MgGroupCountLocal(z Bundle) int64 {
-	var cachedList []interface{} = nil
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_managementGroups."+ConstCacheFileExtension)
-	if utl.FileUsable(cacheFile) {
-		rawList, _ := utl.LoadFileJsonGzip(cacheFile)
-		if rawList != nil {
-			cachedList = rawList.([]interface{})
-			return int64(len(cachedList))
-		}
-	}
-	return 0
+	return int64(len(getCachedObjects(z, "managementGroups")))
 }
 
 // Returns count of management groups in Azure
-func MgGroupCountAzure(z Bundle) int64 {
-	list := GetAzMgGroups(z)
-	return int64(len(list))
+func MgGroupCountAzure(z Bundle) (int64, error) {
+	return MgGroupCountAzureCtx(context.Background(), z)
+}
+
+// Context-aware version of MgGroupCountAzure
+func MgGroupCountAzureCtx(ctx context.Context, z Bundle) (int64, error) {
+	list, err := GetAzMgGroupsCtx(ctx, z)
+	return int64(len(list)), err
 }
 
 // Returns id:name map of management groups
 func GetIdMapMgGroups(z Bundle) (nameMap map[string]string) {
 	nameMap = make(map[string]string)
-	mgGroups := GetMatchingMgGroups("", false, z) // false = don't force a call to Azure
+	mgGroups, _ := GetMatchingMgGroups("", false, z) // false = don't force a call to Azure
 	// By not forcing an Azure call we're opting for cache speed over id:name map accuracy
 	for _, i := range mgGroups {
 		x := i.(map[string]interface{})
@@ -63,21 +59,28 @@ func GetIdMapMgGroups(z Bundle) (nameMap map[string]string) {
 }
 
 // Gets all Azure management groups matching on 'filter'. Returns entire list if filter is empty ""
-func GetMatchingMgGroups(filter string, force bool, z Bundle) (list []interface{}) {
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_managementGroups."+ConstCacheFileExtension)
-	cacheFileAge := utl.FileAge(cacheFile)
-	if utl.InternetIsAvailable() && (force || cacheFileAge == 0 || cacheFileAge > ConstAzCacheFileAgePeriod) {
-		// If Internet is available AND (force was requested OR cacheFileAge is zero (meaning does not exist)
+func GetMatchingMgGroups(filter string, force bool, z Bundle) (list []interface{}, err error) {
+	return GetMatchingMgGroupsCtx(context.Background(), filter, force, z)
+}
+
+// Context-aware version of GetMatchingMgGroups
+func GetMatchingMgGroupsCtx(ctx context.Context, filter string, force bool, z Bundle) (list []interface{}, err error) {
+	cacheAge := getCacheAge(z, "managementGroups")
+	if utl.InternetIsAvailable() && (force || cacheAge == 0 || cacheAge > ConstAzCacheFileAgePeriod) {
+		// If Internet is available AND (force was requested OR cacheAge is zero (meaning does not exist)
 		// OR it is older than ConstAzCacheFileAgePeriod) then query Azure directly to get all objects
 		// and show progress while doing so (true = verbose below)
-		list = GetAzMgGroups(z)
+		list, err = GetAzMgGroupsCtx(ctx, z)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		// Use local cache for all other conditions
-		list = GetCachedObjects(cacheFile)
+		list = getCachedObjects(z, "managementGroups")
 	}
 
 	if filter == "" {
-		return list
+		return list, nil
 	}
 	var matchingList []interface{} = nil
 	for _, i := range list { // Parse every object
@@ -87,23 +90,31 @@ func GetMatchingMgGroups(filter string, force bool, z Bundle) (list []interface{
 			matchingList = append(matchingList, x)
 		}
 	}
-	return matchingList
+	return matchingList, nil
 }
 
 // Gets all management groups in current Azure tenant, and saves them to local cache file
-func GetAzMgGroups(z Bundle) (list []interface{}) {
+func GetAzMgGroups(z Bundle) (list []interface{}, err error) {
+	return GetAzMgGroupsCtx(context.Background(), z)
+}
+
+// Context-aware version of GetAzMgGroups
+func GetAzMgGroupsCtx(ctx context.Context, z Bundle) (list []interface{}, err error) {
 	list = nil                                               // We have to zero it out
 	params := map[string]string{"api-version": "2020-05-01"} // managementGroups
-	url := ConstAzUrl + "/providers/Microsoft.Management/managementGroups"
-	r, _, _ := ApiGet(url, z, params)
-	ApiErrorCheck("GET", url, utl.Trace(), r)
+	url := z.AzUrl() + "/providers/Microsoft.Management/managementGroups"
+	r, _, err := ApiGetCtx(ctx, url, z, params)
+	if err != nil {
+		return nil, err
+	}
 	if r != nil && r["value"] != nil {
 		objects := r["value"].([]interface{})
 		list = append(list, objects...)
 	}
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_managementGroups."+ConstCacheFileExtension)
-	utl.SaveFileJsonGzip(list, cacheFile) // Update the local cache
-	return list
+	if err := saveCachedObjects(z, "managementGroups", list); err != nil { // Update the local cache
+		return nil, err
+	}
+	return list, nil
 }
 
 // Recursively print management groups and all its children MGs and subscriptions
@@ -134,14 +145,17 @@ func PrintMgChildren(indent int, children []interface{}) {
 // Gets current tenant management group tree, and recursively calls function
 // PrintMgChildren() to print the hierarchy
 func PrintMgTree(z Bundle) {
-	url := ConstAzUrl + "/providers/Microsoft.Management/managementGroups/" + z.TenantId
+	url := z.AzUrl() + "/providers/Microsoft.Management/managementGroups/" + z.TenantId
 	params := map[string]string{
 		"api-version": "2020-05-01", // managementGroups
 		"$expand":     "children",
 		"$recurse":    "true",
 	}
-	r, _, _ := ApiGet(url, z, params)
-	ApiErrorCheck("GET", url, utl.Trace(), r) // DEBUG: Need to see when this is failing for some users
+	r, _, err := ApiGet(url, z, params)
+	if err != nil {
+		fmt.Println(utl.Red(err.Error()))
+		return
+	}
 	if r["properties"] != nil {
 		// Print everything under the hierarchy
 		Prop := r["properties"].(map[string]interface{})
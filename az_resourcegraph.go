@@ -0,0 +1,168 @@
+package maz
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/queone/utl"
+)
+
+// Ways of listing RBAC role assignments and definitions, for Bundle.RbacQuery
+const (
+	ConstRbacQueryAuto          = "auto"          // Resource Graph, falling back to walking the scopes
+	ConstRbacQueryResourceGraph = "resourcegraph" // Resource Graph only, failing if it's not permitted
+	ConstRbacQueryScopes        = "scopes"        // Walk every management group and subscription scope
+
+	resourceGraphPageSize = 1000 // Maximum rows Resource Graph returns per call
+)
+
+// Returns how RBAC objects are to be listed, defaulting to ConstRbacQueryAuto
+func (z Bundle) rbacQuery() string {
+	switch z.RbacQuery {
+	case ConstRbacQueryResourceGraph, ConstRbacQueryScopes:
+		return z.RbacQuery
+	}
+	return ConstRbacQueryAuto
+}
+
+// Runs given Azure Resource Graph (KQL) query across the whole tenant, by way of its root
+// management group, and returns all resulting rows, following the paging as needed. If Resource
+// Graph truncated the results, returned fewer rows than the total it reported, or failed on a later
+// page, then the rows gotten so far are returned along with an error matching ErrIncomplete.
+// References:
+//
+//	https://learn.microsoft.com/en-us/azure/governance/resource-graph/overview
+//	https://learn.microsoft.com/en-us/rest/api/azureresourcegraph/resourcegraph/resources/resources
+func QueryAzResourceGraph(query string, z Bundle) (list []interface{}, err error) {
+	return QueryAzResourceGraphCtx(context.Background(), query, z)
+}
+
+// Context-aware version of QueryAzResourceGraph
+func QueryAzResourceGraphCtx(ctx context.Context, query string, z Bundle) (list []interface{}, err error) {
+	list, _, err = queryAzResourceGraph(ctx, query, z)
+	return list, err
+}
+
+// Does the work of QueryAzResourceGraphCtx, also returning the number of API calls it took
+func queryAzResourceGraph(ctx context.Context, query string, z Bundle) (list []interface{}, calls int, err error) {
+	url := z.AzUrl() + "/providers/Microsoft.ResourceGraph/resources"
+	params := map[string]string{"api-version": "2022-10-01"}
+	options := map[string]interface{}{"resultFormat": "objectArray", "$top": resourceGraphPageSize}
+	payload := jsonT{
+		"query":            query,
+		"managementGroups": []string{z.TenantId}, // The Tenant Root Group shares the tenant's ID
+		"options":          options,
+	}
+	list = []interface{}{}
+	totalRecords := int64(-1)
+	for {
+		r, _, err := ApiPostCtx(ctx, url, z, payload, params)
+		calls++
+		if err != nil {
+			if calls > 1 && ctx.Err() == nil {
+				return list, calls, fmt.Errorf("%w: Resource Graph page %d failed: %w", ErrIncomplete, calls, err)
+			}
+			return nil, calls, err
+		}
+		if rows, ok := r["data"].([]interface{}); ok {
+			list = append(list, rows...)
+		}
+		if strings.EqualFold(utl.Str(r["resultTruncated"]), "true") {
+			return list, calls, fmt.Errorf("%w: Resource Graph truncated the results at %d rows", ErrIncomplete, len(list))
+		}
+		if totalRecords < 0 {
+			if n, ok := r["totalRecords"].(float64); ok {
+				totalRecords = int64(n)
+			}
+		}
+		skipToken := utl.Str(r["$skipToken"])
+		if skipToken == "" {
+			break
+		}
+		options["$skipToken"] = skipToken
+	}
+	if totalRecords >= 0 && int64(len(list)) != totalRecords {
+		return list, calls, fmt.Errorf("%w: Resource Graph returned %d of %d rows", ErrIncomplete, len(list), totalRecords)
+	}
+	return list, calls, nil
+}
+
+// Returns an error matching ErrIncomplete if Resource Graph, scoped to the Tenant Root Group, can't
+// see every subscription the caller can, which happens when the caller can read some subscriptions
+// or management groups, but not the root one. Its results would then be missing those.
+func checkResourceGraphCoverage(ctx context.Context, z Bundle) error {
+	subIds, err := GetAzSubscriptionsIdsCtx(ctx, z)
+	if err != nil {
+		return err
+	}
+	rows, _, err := queryAzResourceGraph(ctx, "resourcecontainers "+
+		"| where type =~ 'microsoft.resources/subscriptions' | project subscriptionId", z)
+	if err != nil {
+		return err
+	}
+	visible := make(map[string]bool)
+	for _, i := range rows {
+		if x, ok := i.(map[string]interface{}); ok {
+			visible[strings.ToLower(utl.Str(x["subscriptionId"]))] = true
+		}
+	}
+	missing := 0
+	for _, subId := range subIds {
+		if !visible[strings.ToLower(strings.TrimPrefix(subId, "/subscriptions/"))] {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%w: Resource Graph can't see %d of the %d subscriptions under the Tenant Root Group",
+			ErrIncomplete, missing, len(subIds))
+	}
+	return nil
+}
+
+// Gets all RBAC objects of given type, "roleAssignments" or "roleDefinitions", from Resource
+// Graph's authorizationresources table, in the same form the Authorization API returns them
+func getAzRbacObjectsByGraph(ctx context.Context, z Bundle, rbacType string, verbose bool) (list []interface{}, err error) {
+	query := fmt.Sprintf("authorizationresources | where type =~ 'microsoft.authorization/%s' "+
+		"| project id, name, type, properties", rbacType)
+	list, calls, err := queryAzResourceGraph(ctx, query, z)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range list {
+		if x, ok := i.(map[string]interface{}); ok {
+			x["type"] = "Microsoft.Authorization/" + rbacType // Resource Graph lowercases types
+		}
+	}
+	if verbose {
+		fmt.Printf("API call %4d: %5d objects from Resource Graph\n", calls, len(list))
+	}
+	return list, nil
+}
+
+// Gets all RBAC objects of given type via Resource Graph, unless z.RbacQuery says otherwise. The
+// boolean is false if the caller should walk the scopes instead, either because it was asked to,
+// or because Resource Graph failed in auto mode. In auto mode, Resource Graph results also have to
+// be complete, and cover all subscriptions the caller can see, otherwise the scopes are walked.
+func getAzRbacObjectsFast(ctx context.Context, z Bundle, rbacType string, verbose bool) (list []interface{}, ok bool, err error) {
+	mode := z.rbacQuery()
+	if mode == ConstRbacQueryScopes {
+		return nil, false, nil
+	}
+	if mode == ConstRbacQueryAuto {
+		err = checkResourceGraphCoverage(ctx, z)
+	}
+	if err == nil {
+		list, err = getAzRbacObjectsByGraph(ctx, z, rbacType, verbose)
+	}
+	if err == nil {
+		return list, true, nil
+	}
+	if mode == ConstRbacQueryResourceGraph || ctx.Err() != nil {
+		return nil, true, err
+	}
+	if verbose {
+		fmt.Println(utl.Yel("Resource Graph query failed or incomplete, walking all scopes instead: " + err.Error()))
+	}
+	return nil, false, nil
+}
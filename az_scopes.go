@@ -0,0 +1,205 @@
+package maz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/queone/utl"
+)
+
+// Number of scopes queried in parallel when Bundle.Concurrency is not set
+const ConstAzConcurrency = 8
+
+// Returns the number of parallel API calls to use when walking the RBAC scopes
+func (z Bundle) concurrency() int {
+	if z.Concurrency > 0 {
+		return z.Concurrency
+	}
+	return ConstAzConcurrency
+}
+
+// Calls fetch for each of given scopes, with up to z.Concurrency calls in flight, and passes each
+// result on to handle in scope order, along with its position in the list. Stops early, cancelling
+// any calls still in flight, if handle returns false. Handle is only ever called from the calling
+// goroutine, so it needs no locking of its own.
+//
+// ApiCall already retries throttled calls, but with many calls in flight the others would keep
+// hitting the API meanwhile. So once any call gets a 429, the workers hold off on starting new ones
+// until the Retry-After delay has passed.
+func forEachScope(ctx context.Context, z Bundle, scopes []string,
+	fetch func(ctx context.Context, z Bundle, scope string) (map[string]interface{}, error),
+	handle func(k int, scope string, r map[string]interface{}, err error) bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	gate := &throttleGate{}
+	policy := z.retryPolicy()
+	onRetry := policy.OnRetry
+	policy.OnRetry = func(e RetryEvent) {
+		if e.StatusCode == http.StatusTooManyRequests {
+			gate.hold(e.Delay)
+		}
+		if onRetry != nil {
+			onRetry(e)
+		}
+	}
+	z.Retry = &policy // Only affects this copy of the bundle
+
+	type result struct {
+		r    map[string]interface{}
+		err  error
+		done chan struct{}
+	}
+	results := make([]result, len(scopes))
+	for i := range results {
+		results[i].done = make(chan struct{})
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(z.concurrency(), len(scopes)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if err := gate.wait(ctx); err != nil {
+					results[i].err = err
+				} else {
+					results[i].r, results[i].err = fetch(ctx, z, scopes[i])
+				}
+				close(results[i].done)
+			}
+		}()
+	}
+	go func() {
+		defer close(next)
+		for i := range scopes {
+			select {
+			case next <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	defer func() {
+		cancel()
+		wg.Wait() // Don't leave workers behind
+	}()
+
+	for i, scope := range scopes {
+		select {
+		case <-results[i].done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !handle(i, scope, results[i].r, results[i].err) {
+			return nil
+		}
+		results[i].r = nil // Let it be collected, the caller has what it needs
+	}
+	return nil
+}
+
+// Shared pause for all workers of a forEachScope run, set whenever one of them gets throttled
+type throttleGate struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// Makes the workers hold off for given duration, unless they already have to for longer
+func (g *throttleGate) hold(d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if t := time.Now().Add(d); t.After(g.until) {
+		g.until = t
+	}
+}
+
+// Waits until the gate opens, or the context is done
+func (g *throttleGate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	d := time.Until(g.until)
+	g.mu.Unlock()
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Gets all RBAC objects of given type, "roleAssignments" or "roleDefinitions", by querying every
+// scope from GetAzRbacScopes, skipping the ones that can't be read, and dropping the repeats that
+// inherited nesting brings
+func getAzRbacObjectsByScopes(ctx context.Context, z Bundle, rbacType string, verbose bool) (list []interface{}, err error) {
+	list = nil                         // We have to zero it out
+	uniqueIds := make(map[string]bool) // Keep track of the objects
+
+	var mgGroupNameMap, subNameMap map[string]string
+	if verbose {
+		mgGroupNameMap = GetIdMapMgGroups(z)
+		subNameMap = GetIdMapSubs(z)
+	}
+
+	scopes, err := GetAzRbacScopesCtx(ctx, z) // Get all scopes
+	if err != nil {
+		return nil, err
+	}
+	params := map[string]string{"api-version": "2022-04-01"} // Same for roleAssignments and roleDefinitions
+	fetch := func(ctx context.Context, z Bundle, scope string) (map[string]interface{}, error) {
+		url := z.AzUrl() + scope + "/providers/Microsoft.Authorization/" + rbacType
+		r, _, err := ApiGetCtx(ctx, url, z, params)
+		return r, err
+	}
+	var fatalErr error = nil
+	err = forEachScope(ctx, z, scopes, fetch, func(k int, scope string, r map[string]interface{}, err error) bool {
+		if err != nil {
+			// Skip scopes we cannot read, but fail outright on anything else
+			if !errors.Is(err, ErrForbidden) && !errors.Is(err, ErrNotFound) {
+				fatalErr = err
+				return false
+			}
+		}
+		if r != nil && r["value"] != nil {
+			objectsUnderThisScope, _ := r["value"].([]interface{})
+			count := 0
+			for _, i := range objectsUnderThisScope {
+				x, ok := i.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				uuid := utl.Str(x["name"])
+				if uniqueIds[uuid] {
+					continue // Skip this repeated one. This can happen due to inherited nesting
+				}
+				uniqueIds[uuid] = true // Keep track of the UUIDs we are seeing
+				list = append(list, x)
+				count++
+			}
+			if verbose && count > 0 {
+				scopeName := scope
+				if strings.HasPrefix(scope, "/providers") {
+					scopeName = mgGroupNameMap[scope]
+				} else if strings.HasPrefix(scope, "/subscriptions") {
+					scopeName = subNameMap[utl.LastElem(scope, "/")]
+				}
+				fmt.Printf("API call %4d: %5d objects under %s\n", k+1, count, scopeName)
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = fatalErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
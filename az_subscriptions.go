@@ -1,8 +1,8 @@
 package maz
 
 import (
+	"context"
 	"fmt"
-	"path/filepath"
 
 	"github.com/queone/utl"
 )
@@ -23,29 +23,33 @@ func PrintSubscription(x map[string]interface{}) {
 
 // Returns count of all subscriptions in local cache file
 func SubsCountLocal(z Bundle) int64 {
-	var cachedList []interface{} = nil
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_subscriptions."+ConstCacheFileExtension)
-	if utl.FileUsable(cacheFile) {
-		rawList, _ := utl.LoadFileJsonGzip(cacheFile)
-		if rawList != nil {
-			cachedList = rawList.([]interface{})
-			return int64(len(cachedList))
-		}
-	}
-	return 0
+	return int64(len(getCachedObjects(z, "subscriptions")))
 }
 
 // Returns count of all subscriptions in current Azure tenant
-func SubsCountAzure(z Bundle) int64 {
-	list := GetAzSubscriptions(z)
-	return int64(len(list))
+func SubsCountAzure(z Bundle) (int64, error) {
+	return SubsCountAzureCtx(context.Background(), z)
+}
+
+// Context-aware version of SubsCountAzure
+func SubsCountAzureCtx(ctx context.Context, z Bundle) (int64, error) {
+	list, err := GetAzSubscriptionsCtx(ctx, z)
+	return int64(len(list)), err
 }
 
 // Gets all subscription full IDs, i.e. "/subscriptions/UUID", which are commonly
 // used as scopes for Azure resource RBAC role definitions and assignments
-func GetAzSubscriptionsIds(z Bundle) (scopes []string) {
+func GetAzSubscriptionsIds(z Bundle) (scopes []string, err error) {
+	return GetAzSubscriptionsIdsCtx(context.Background(), z)
+}
+
+// Context-aware version of GetAzSubscriptionsIds
+func GetAzSubscriptionsIdsCtx(ctx context.Context, z Bundle) (scopes []string, err error) {
 	scopes = nil
-	subscriptions := GetAzSubscriptions(z)
+	subscriptions, err := GetAzSubscriptionsCtx(ctx, z)
+	if err != nil {
+		return nil, err
+	}
 	for _, i := range subscriptions {
 		x := i.(map[string]interface{})
 		// Skip disabled and legacy subscriptions
@@ -57,13 +61,13 @@ func GetAzSubscriptionsIds(z Bundle) (scopes []string) {
 		subId := utl.Str(x["id"])
 		scopes = append(scopes, subId)
 	}
-	return scopes
+	return scopes, nil
 }
 
 // Returns id:name map of all subscriptions
 func GetIdMapSubs(z Bundle) (nameMap map[string]string) {
 	nameMap = make(map[string]string)
-	roleDefs := GetMatchingSubscriptions("", false, z) // false = don't force a call to Azure
+	roleDefs, _ := GetMatchingSubscriptions("", false, z) // false = don't force a call to Azure
 	// By not forcing an Azure call we're opting for cache speed over id:name map accuracy
 	for _, i := range roleDefs {
 		x := i.(map[string]interface{})
@@ -75,21 +79,28 @@ func GetIdMapSubs(z Bundle) (nameMap map[string]string) {
 }
 
 // Gets all Azure subscriptions matching on 'filter'. Returns entire list if filter is empty ""
-func GetMatchingSubscriptions(filter string, force bool, z Bundle) (list []interface{}) {
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_subscriptions."+ConstCacheFileExtension)
-	cacheFileAge := utl.FileAge(cacheFile)
-	if utl.InternetIsAvailable() && (force || cacheFileAge == 0 || cacheFileAge > ConstAzCacheFileAgePeriod) {
-		// If Internet is available AND (force was requested OR cacheFileAge is zero (meaning does not exist)
+func GetMatchingSubscriptions(filter string, force bool, z Bundle) (list []interface{}, err error) {
+	return GetMatchingSubscriptionsCtx(context.Background(), filter, force, z)
+}
+
+// Context-aware version of GetMatchingSubscriptions
+func GetMatchingSubscriptionsCtx(ctx context.Context, filter string, force bool, z Bundle) (list []interface{}, err error) {
+	cacheAge := getCacheAge(z, "subscriptions")
+	if utl.InternetIsAvailable() && (force || cacheAge == 0 || cacheAge > ConstAzCacheFileAgePeriod) {
+		// If Internet is available AND (force was requested OR cacheAge is zero (meaning does not exist)
 		// OR it is older than ConstAzCacheFileAgePeriod) then query Azure directly to get all objects
 		// and show progress while doing so (true = verbose below)
-		list = GetAzSubscriptions(z)
+		list, err = GetAzSubscriptionsCtx(ctx, z)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		// Use local cache for all other conditions
-		list = GetCachedObjects(cacheFile)
+		list = getCachedObjects(z, "subscriptions")
 	}
 
 	if filter == "" {
-		return list
+		return list, nil
 	}
 	var matchingList []interface{} = nil
 	for _, i := range list { // Parse every object
@@ -99,30 +110,45 @@ func GetMatchingSubscriptions(filter string, force bool, z Bundle) (list []inter
 			matchingList = append(matchingList, x)
 		}
 	}
-	return matchingList
+	return matchingList, nil
 }
 
 // Gets all subscription in current Azure tenant, and saves them to local cache file
-func GetAzSubscriptions(z Bundle) (list []interface{}) {
+func GetAzSubscriptions(z Bundle) (list []interface{}, err error) {
+	return GetAzSubscriptionsCtx(context.Background(), z)
+}
+
+// Context-aware version of GetAzSubscriptions
+func GetAzSubscriptionsCtx(ctx context.Context, z Bundle) (list []interface{}, err error) {
 	list = nil                                               // We have to zero it out
 	params := map[string]string{"api-version": "2022-09-01"} // subscriptions
-	url := ConstAzUrl + "/subscriptions"
-	r, _, _ := ApiGet(url, z, params)
-	ApiErrorCheck("GET", url, utl.Trace(), r)
+	url := z.AzUrl() + "/subscriptions"
+	r, _, err := ApiGetCtx(ctx, url, z, params)
+	if err != nil {
+		return nil, err
+	}
 	if r != nil && r["value"] != nil {
 		objects := r["value"].([]interface{})
 		list = append(list, objects...)
 	}
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_subscriptions."+ConstCacheFileExtension)
-	utl.SaveFileJsonGzip(list, cacheFile) // Update the local cache
-	return list
+	if err := saveCachedObjects(z, "subscriptions", list); err != nil { // Update the local cache
+		return nil, err
+	}
+	return list, nil
 }
 
 // Gets specific Azure subscription by Object UUID
-func GetAzSubscriptionByUuid(uuid string, z Bundle) map[string]interface{} {
+func GetAzSubscriptionByUuid(uuid string, z Bundle) (map[string]interface{}, error) {
+	return GetAzSubscriptionByUuidCtx(context.Background(), uuid, z)
+}
+
+// Context-aware version of GetAzSubscriptionByUuid
+func GetAzSubscriptionByUuidCtx(ctx context.Context, uuid string, z Bundle) (map[string]interface{}, error) {
 	params := map[string]string{"api-version": "2022-09-01"} // subscriptions
-	url := ConstAzUrl + "/subscriptions/" + uuid
-	r, _, _ := ApiGet(url, z, params)
-	//ApiErrorCheck("GET", url, utl.Trace(), r) // Commented out to do this quietly. Use for DEBUGging
-	return r
+	url := z.AzUrl() + "/subscriptions/" + uuid
+	r, _, err := ApiGetCtx(ctx, url, z, params)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
 }
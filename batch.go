@@ -0,0 +1,170 @@
+package maz
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/queone/utl"
+)
+
+// Maximum number of sub-requests MS Graph accepts in a single $batch call
+const ConstMgBatchSize = 20
+
+// BatchRequest is a single sub-request of an MS Graph JSON batch. See
+// https://learn.microsoft.com/en-us/graph/json-batching
+type BatchRequest struct {
+	Method  string                 // Defaults to GET
+	Url     string                 // Relative to the API version, e.g. "/servicePrincipals/{id}"
+	Headers map[string]string      // Optional
+	Body    map[string]interface{} // Optional JSON body, for POST, PUT and PATCH
+}
+
+// BatchResponse is the outcome of a single BatchRequest
+type BatchResponse struct {
+	StatusCode int
+	Headers    map[string]string
+	Body       map[string]interface{} // JSON body, if any
+	Err        error                  // An *ApiError if StatusCode is not 2xx
+}
+
+// Runs given MS Graph requests via the $batch endpoint of given API version, "v1.0" or "beta", in
+// as many calls as needed to stay within ConstMgBatchSize sub-requests per call. The responses are
+// returned in the same order as the requests. Sub-requests that get throttled (429) or find the
+// service unavailable (503) are retried according to the bundle's retry policy. The error is only
+// set if a whole batch call fails; each sub-request's own failure is in its BatchResponse.Err.
+func MgBatch(requests []BatchRequest, apiVersion string, z Bundle) ([]BatchResponse, error) {
+	return MgBatchCtx(context.Background(), requests, apiVersion, z)
+}
+
+// Context-aware version of MgBatch
+func MgBatchCtx(ctx context.Context, requests []BatchRequest, apiVersion string, z Bundle) ([]BatchResponse, error) {
+	responses := make([]BatchResponse, len(requests))
+	policy := z.retryPolicy()
+	pending := make([]int, len(requests)) // Indexes of the requests still to be run
+	for i := range pending {
+		pending[i] = i
+	}
+	for attempt := 1; len(pending) > 0; attempt++ {
+		var retry []int
+		var delay time.Duration
+		for start := 0; start < len(pending); start += ConstMgBatchSize {
+			chunk := pending[start:min(start+ConstMgBatchSize, len(pending))]
+			if err := mgBatchCall(ctx, requests, responses, chunk, apiVersion, z); err != nil {
+				return nil, err
+			}
+			for _, i := range chunk {
+				if !retryableStatus(responses[i].StatusCode) || attempt >= policy.MaxAttempts {
+					continue
+				}
+				retry = append(retry, i)
+				// Wait as long as the most demanding of the throttled sub-requests asks for
+				r := &http.Response{StatusCode: responses[i].StatusCode, Header: http.Header{}}
+				for h, v := range responses[i].Headers {
+					r.Header.Set(h, v)
+				}
+				delay = max(delay, policy.delay(attempt, r))
+			}
+		}
+		if len(retry) > 0 {
+			if policy.OnRetry != nil {
+				for _, i := range retry {
+					policy.OnRetry(RetryEvent{
+						Method:     batchMethod(requests[i]),
+						Url:        requests[i].Url,
+						Attempt:    attempt,
+						StatusCode: responses[i].StatusCode,
+						Delay:      delay,
+						Err:        responses[i].Err,
+					})
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+		pending = retry
+	}
+	return responses, nil
+}
+
+// Makes a single $batch call with the requests at given indexes, storing their responses
+func mgBatchCall(ctx context.Context, requests []BatchRequest, responses []BatchResponse, indexes []int, apiVersion string, z Bundle) error {
+	var subRequests []interface{}
+	for _, i := range indexes {
+		req := requests[i]
+		sub := map[string]interface{}{
+			"id":     strconv.Itoa(i), // Sub-request IDs only need to be unique within the batch
+			"method": batchMethod(req),
+			"url":    req.Url,
+		}
+		headers := make(map[string]string)
+		for h, v := range req.Headers {
+			headers[h] = v
+		}
+		if req.Body != nil {
+			sub["body"] = req.Body
+			if _, ok := headers["Content-Type"]; !ok {
+				headers["Content-Type"] = "application/json"
+			}
+		}
+		if len(headers) > 0 {
+			sub["headers"] = headers
+		}
+		subRequests = append(subRequests, sub)
+	}
+	url := z.MgUrl() + "/" + apiVersion + "/$batch"
+	r, _, err := ApiPostCtx(ctx, url, z, jsonT{"requests": subRequests}, nil)
+	if err != nil {
+		return err
+	}
+	results, _ := r["responses"].([]interface{})
+	found := make(map[int]bool)
+	for _, item := range results {
+		x, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		i, err := strconv.Atoi(utl.Str(x["id"]))
+		if err != nil || i < 0 || i >= len(requests) {
+			continue
+		}
+		res := BatchResponse{Headers: make(map[string]string)}
+		if status, ok := x["status"].(float64); ok {
+			res.StatusCode = int(status)
+		}
+		if headers, ok := x["headers"].(map[string]interface{}); ok {
+			for h, v := range headers {
+				res.Headers[h] = utl.Str(v)
+			}
+		}
+		res.Body, _ = x["body"].(map[string]interface{})
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			header := http.Header{}
+			for h, v := range res.Headers {
+				header.Set(h, v)
+			}
+			res.Err = newApiError(batchMethod(requests[i]), requests[i].Url, &http.Response{StatusCode: res.StatusCode, Header: header}, res.Body)
+		}
+		responses[i] = res
+		found[i] = true
+	}
+	for _, i := range indexes {
+		if !found[i] {
+			return fmt.Errorf("POST %s: no response for sub-request %s %s", url, batchMethod(requests[i]), requests[i].Url)
+		}
+	}
+	return nil
+}
+
+// Returns the HTTP method of given sub-request
+func batchMethod(req BatchRequest) string {
+	if req.Method == "" {
+		return "GET"
+	}
+	return req.Method
+}
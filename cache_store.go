@@ -0,0 +1,289 @@
+package maz
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/queone/utl"
+)
+
+// CacheStore keeps the local cache of Azure objects, as one list per tenant and object type, like
+// "users" or "roleAssignments", along with the deltaLink of the types that support delta queries,
+// and the comma-separated list of attributes selected for the sync it came from. Load returns a nil
+// list if nothing is cached, and Age returns the age in seconds of the cached list, or zero if
+// there isn't one. Remove drops both the list and the deltaLink of given type, or
+// of all types if objectType is empty. Implementations must be safe for concurrent use.
+type CacheStore interface {
+	Load(tenantId, objectType string) ([]interface{}, error)
+	Save(tenantId, objectType string, list []interface{}) error
+	DeltaLink(tenantId, objectType string) (deltaLink, selection string, age int64, err error)
+	SaveDeltaLink(tenantId, objectType, deltaLink, selection string) error
+	Age(tenantId, objectType string) int64
+	Remove(tenantId, objectType string) error
+}
+
+// Returns the CacheStore in effect, which is the gzipped files in z.ConfDir unless z.Cache is set
+func (z Bundle) cacheStore() CacheStore {
+	if z.Cache != nil {
+		return z.Cache
+	}
+	return NewFileCacheStore(z.ConfDir)
+}
+
+// Returns the cached list of given object type, or nil if there's none or it can't be read
+func getCachedObjects(z Bundle, objectType string) []interface{} {
+	list, _ := z.cacheStore().Load(z.TenantId, objectType)
+	return jsonObjects(list)
+}
+
+// Returns the entries of given list that are JSON objects, so that a corrupt or foreign cache
+// can't make callers panic on their type assertions
+func jsonObjects(list []interface{}) []interface{} {
+	for _, i := range list {
+		if _, ok := i.(map[string]interface{}); !ok {
+			return slices.DeleteFunc(slices.Clone(list), func(i interface{}) bool {
+				_, ok := i.(map[string]interface{})
+				return !ok
+			})
+		}
+	}
+	return list // The usual case, with nothing to drop
+}
+
+// Returns the age in seconds of the cached list of given object type, or zero if there's none
+func getCacheAge(z Bundle, objectType string) int64 {
+	return z.cacheStore().Age(z.TenantId, objectType)
+}
+
+// Saves given list as the cache of given object type
+func saveCachedObjects(z Bundle, objectType string, list []interface{}) error {
+	return z.cacheStore().Save(z.TenantId, objectType, list)
+}
+
+// CacheUpdater is an optional CacheStore extension, for stores that can apply the changes found by a
+// delta query in place, rather than have the whole merged list saved each time. Deleted objects go
+// first, then each object in mergeSet is added, or merged into the one with the same ID with
+// MergeDeltaObject, the same way NormalizeCache does.
+type CacheUpdater interface {
+	Update(tenantId, objectType string, mergeSet []interface{}, deletedIds []string) error
+}
+
+// CacheQuerier is an optional CacheStore extension, for stores that can answer lookups without
+// loading the whole list. Search returns the objects with any string value containing filter,
+// ignoring case, though it may return a few more, which get weeded out with utl.StringInJson.
+// IdMap returns the id:displayName pairs of all objects having a displayName.
+type CacheQuerier interface {
+	Search(tenantId, objectType, filter string) ([]interface{}, error)
+	IdMap(tenantId, objectType string) (map[string]string, error)
+}
+
+// Returns the cached objects of given type matching filter, using the store's own search. The
+// boolean is false if the store can't search, or the search failed, so the caller has to scan the
+// whole list instead.
+func searchCachedObjects(z Bundle, objectType, filter string) ([]interface{}, bool) {
+	querier, ok := z.cacheStore().(CacheQuerier)
+	if !ok {
+		return nil, false
+	}
+	candidates, err := querier.Search(z.TenantId, objectType, filter)
+	if err != nil {
+		return nil, false
+	}
+	var matchingList []interface{} = nil
+	for _, i := range candidates {
+		if utl.StringInJson(i, filter) {
+			matchingList = append(matchingList, i)
+		}
+	}
+	return matchingList, true
+}
+
+// Returns the id:displayName map of the cached objects of given type, using the store's own query,
+// after refreshing the cache if it's older than ttl seconds, or if its selected attributes changed,
+// like GetMatching* functions do. The boolean is false if the store can't do such queries, so the
+// caller has to build the map from the whole list.
+func getIdMapIndexed(z Bundle, objectType string, ttl int64, selectionChanged bool, refresh func() error) (map[string]string, bool) {
+	querier, ok := z.cacheStore().(CacheQuerier)
+	if !ok {
+		return nil, false
+	}
+	age := getCacheAge(z, objectType)
+	if utl.InternetIsAvailable() && (age == 0 || age > ttl || selectionChanged) {
+		refresh() // On failure, go with whatever is cached
+	}
+	nameMap, err := querier.IdMap(z.TenantId, objectType)
+	if err != nil {
+		return nil, false
+	}
+	return nameMap, true
+}
+
+// FileCacheStore is the default CacheStore, keeping each list in a gzipped JSON file named
+// "<tenantId>_<objectType>.gz", and its deltaLink in "<tenantId>_<objectType>_deltaLink.gz"
+type FileCacheStore struct {
+	dir string
+}
+
+// Returns a CacheStore that keeps its files in given directory
+func NewFileCacheStore(dir string) *FileCacheStore {
+	return &FileCacheStore{dir: dir}
+}
+
+// Returns the path of the cache file of given tenant and object type
+func (s *FileCacheStore) file(tenantId, objectType string) string {
+	return filepath.Join(s.dir, tenantId+"_"+objectType+"."+ConstCacheFileExtension)
+}
+
+func (s *FileCacheStore) Load(tenantId, objectType string) ([]interface{}, error) {
+	cacheFile := s.file(tenantId, objectType)
+	if !utl.FileUsable(cacheFile) {
+		return nil, nil
+	}
+	rawList, err := loadFileJsonGzip(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := rawList.([]interface{})
+	if !ok && rawList != nil {
+		return nil, fmt.Errorf("[%s] not a list of objects", cacheFile)
+	}
+	return list, nil
+}
+
+func (s *FileCacheStore) Save(tenantId, objectType string, list []interface{}) error {
+	return saveFileJsonGzip(list, s.file(tenantId, objectType))
+}
+
+func (s *FileCacheStore) DeltaLink(tenantId, objectType string) (string, string, int64, error) {
+	deltaLinkFile := s.file(tenantId, objectType+"_deltaLink")
+	if !utl.FileUsable(deltaLinkFile) {
+		return "", "", 0, nil
+	}
+	rawMap, err := loadFileJsonGzip(deltaLinkFile)
+	if err != nil {
+		return "", "", 0, err
+	}
+	deltaLinkMap, _ := rawMap.(map[string]interface{})
+	return utl.Str(deltaLinkMap["@odata.deltaLink"]), utl.Str(deltaLinkMap["selection"]), utl.FileAge(deltaLinkFile), nil
+}
+
+func (s *FileCacheStore) SaveDeltaLink(tenantId, objectType, deltaLink, selection string) error {
+	deltaLinkMap := map[string]interface{}{"@odata.deltaLink": deltaLink, "selection": selection}
+	return saveFileJsonGzip(deltaLinkMap, s.file(tenantId, objectType+"_deltaLink"))
+}
+
+func (s *FileCacheStore) Age(tenantId, objectType string) int64 {
+	return utl.FileAge(s.file(tenantId, objectType))
+}
+
+func (s *FileCacheStore) Remove(tenantId, objectType string) error {
+	var fileList []string
+	if objectType == "" {
+		// See https://stackoverflow.com/questions/48072236/remove-files-with-wildcard
+		var err error
+		fileList, err = filepath.Glob(s.file(tenantId, "*"))
+		if err != nil {
+			return err
+		}
+	} else {
+		fileList = []string{s.file(tenantId, objectType), s.file(tenantId, objectType+"_deltaLink")}
+	}
+	for _, filePath := range fileList {
+		// The lock files stay, as other processes may be holding locks on them
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// MemoryCacheStore is a CacheStore that keeps everything in memory, for services that want to share
+// one cache among their bundles, or that shouldn't touch the disk. The cached objects are shared
+// with the callers, which must treat them as read-only.
+type MemoryCacheStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryCacheEntry
+}
+
+type memoryCacheEntry struct {
+	list      []interface{}
+	deltaLink string
+	selection string
+	savedAt   time.Time // When the list was saved
+	linkedAt  time.Time // When the deltaLink was saved
+}
+
+// Returns an empty in-memory CacheStore
+func NewMemoryCacheStore() *MemoryCacheStore {
+	return &MemoryCacheStore{entries: make(map[string]memoryCacheEntry)}
+}
+
+func (s *MemoryCacheStore) Load(tenantId, objectType string) ([]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[tenantId+"_"+objectType]
+	if !ok || e.savedAt.IsZero() {
+		return nil, nil
+	}
+	return append([]interface{}(nil), e.list...), nil // Callers may append to it
+}
+
+func (s *MemoryCacheStore) Save(tenantId, objectType string, list []interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := tenantId + "_" + objectType
+	e := s.entries[key]
+	e.list, e.savedAt = append([]interface{}(nil), list...), time.Now()
+	s.entries[key] = e
+	return nil
+}
+
+func (s *MemoryCacheStore) DeltaLink(tenantId, objectType string) (string, string, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[tenantId+"_"+objectType]
+	if !ok || e.linkedAt.IsZero() {
+		return "", "", 0, nil
+	}
+	return e.deltaLink, e.selection, int64(time.Since(e.linkedAt).Seconds()), nil
+}
+
+func (s *MemoryCacheStore) SaveDeltaLink(tenantId, objectType, deltaLink, selection string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := tenantId + "_" + objectType
+	e := s.entries[key]
+	e.deltaLink, e.selection, e.linkedAt = deltaLink, selection, time.Now()
+	s.entries[key] = e
+	return nil
+}
+
+func (s *MemoryCacheStore) Age(tenantId, objectType string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[tenantId+"_"+objectType]
+	if !ok || e.savedAt.IsZero() {
+		return 0
+	}
+	return max(int64(time.Since(e.savedAt).Seconds()), 1) // Zero would mean not cached
+}
+
+func (s *MemoryCacheStore) Remove(tenantId, objectType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if objectType != "" {
+		delete(s.entries, tenantId+"_"+objectType)
+		return nil
+	}
+	for key := range s.entries {
+		if strings.HasPrefix(key, tenantId+"_") {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package maz
+
+import (
+	"errors"
+	"os"
+
+	"github.com/queone/utl"
+)
+
+// Exit is a thin wrapper for CLI utilities, which ends the program according to the error returned
+// by one of the library functions that perform a whole command, such as UpsertAzObject or
+// SetupAutomatedLogin. A nil error exits with 0, while any other one is printed and exits with 1.
+func Exit(err error) {
+	if err == nil {
+		os.Exit(0)
+	}
+	if errors.Is(err, ErrAborted) {
+		utl.Die("Aborted.\n")
+	}
+	utl.Die("%s\n", utl.Red("Error: "+err.Error()))
+}
@@ -0,0 +1,107 @@
+package maz
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Cloud bundles the endpoints and default scopes of a given Azure cloud environment
+type Cloud struct {
+	Name    string // Profile name, e.g. "AzurePublic"
+	AuthUrl string // Login authority base URL, with trailing slash
+	MgUrl   string // MS Graph API base URL
+	AzUrl   string // Azure Resource Management API base URL
+	MgScope string // Default scope for MS Graph API tokens
+	AzScope string // Default scope for Azure Resource Management API tokens
+
+	Apis []ApiResource // Other APIs available in this cloud, like Key Vault
+}
+
+var (
+	AzurePublic = Cloud{
+		Name:    "AzurePublic",
+		AuthUrl: ConstAuthUrl,
+		MgUrl:   ConstMgUrl,
+		AzUrl:   ConstAzUrl,
+		MgScope: ConstMgUrl + "/.default",
+		AzScope: ConstAzUrl + "/.default",
+		Apis: []ApiResource{
+			{Name: ConstKeyVaultApi, Url: "https://vault.azure.net", Scope: "https://vault.azure.net/.default"},
+			{Name: ConstLogAnalyticsApi, Url: "https://api.loganalytics.io", Scope: "https://api.loganalytics.io/.default"},
+			{Name: ConstStorageApi, Url: "https://core.windows.net", Scope: "https://storage.azure.com/.default", Headers: storageHeaders},
+		},
+	}
+	AzureUSGov = Cloud{
+		Name:    "AzureUSGov",
+		AuthUrl: "https://login.microsoftonline.us/",
+		MgUrl:   "https://graph.microsoft.us",
+		AzUrl:   "https://management.usgovcloudapi.net",
+		MgScope: "https://graph.microsoft.us/.default",
+		AzScope: "https://management.usgovcloudapi.net/.default",
+		Apis: []ApiResource{
+			{Name: ConstKeyVaultApi, Url: "https://vault.usgovcloudapi.net", Scope: "https://vault.usgovcloudapi.net/.default"},
+			{Name: ConstLogAnalyticsApi, Url: "https://api.loganalytics.us", Scope: "https://api.loganalytics.us/.default"},
+			{Name: ConstStorageApi, Url: "https://core.usgovcloudapi.net", Scope: "https://storage.azure.com/.default", Headers: storageHeaders},
+		},
+	}
+	AzureChina = Cloud{
+		Name:    "AzureChina",
+		AuthUrl: "https://login.chinacloudapi.cn/",
+		MgUrl:   "https://microsoftgraph.chinacloudapi.cn",
+		AzUrl:   "https://management.chinacloudapi.cn",
+		MgScope: "https://microsoftgraph.chinacloudapi.cn/.default",
+		AzScope: "https://management.chinacloudapi.cn/.default",
+		Apis: []ApiResource{
+			{Name: ConstKeyVaultApi, Url: "https://vault.azure.cn", Scope: "https://vault.azure.cn/.default"},
+			{Name: ConstLogAnalyticsApi, Url: "https://api.loganalytics.azure.cn", Scope: "https://api.loganalytics.azure.cn/.default"},
+			{Name: ConstStorageApi, Url: "https://core.chinacloudapi.cn", Scope: "https://storage.azure.com/.default", Headers: storageHeaders},
+		},
+	}
+
+	// Named cloud profiles, keyed by lowercase name. Also accepts the names the az CLI uses
+	clouds = map[string]Cloud{
+		"azurepublic":       AzurePublic,
+		"azurecloud":        AzurePublic,
+		"azureusgov":        AzureUSGov,
+		"azureusgovernment": AzureUSGov,
+		"azurechina":        AzureChina,
+		"azurechinacloud":   AzureChina,
+	}
+)
+
+// Storage data plane calls authenticated with tokens require an x-ms-version header
+var storageHeaders = map[string]string{"x-ms-version": "2023-11-03"}
+
+// Returns the cloud profile with given name, ignoring case. An empty name means AzurePublic
+func CloudByName(name string) (Cloud, error) {
+	if name == "" {
+		return AzurePublic, nil
+	}
+	if c, ok := clouds[strings.ToLower(name)]; ok {
+		return c, nil
+	}
+	return Cloud{}, fmt.Errorf("unknown cloud '%s', must be one of: %s", name, strings.Join(CloudNames(), ", "))
+}
+
+// Returns the names of all built-in cloud profiles
+func CloudNames() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, c := range clouds {
+		if !seen[c.Name] {
+			names = append(names, c.Name)
+			seen[c.Name] = true
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the cloud profile in effect for this bundle, which is AzurePublic unless set
+func (z Bundle) cloud() Cloud {
+	if z.Cloud.Name == "" {
+		return AzurePublic
+	}
+	return z.Cloud
+}
@@ -0,0 +1,87 @@
+package maz
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/queone/utl"
+)
+
+var (
+	// Sentinel errors that an *ApiError will match via errors.Is(), so callers can
+	// easily branch on the most common HTTP failure conditions.
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrThrottled    = errors.New("throttled")
+
+	ErrBadUrl            = errors.New("bad URL")
+	ErrUnsupportedMethod = errors.New("unsupported HTTP method")
+	ErrAborted           = errors.New("aborted")
+	ErrIncomplete        = errors.New("incomplete results")
+)
+
+// ApiError is returned by ApiCall, and all functions built on top of it, whenever an Azure
+// API responds with a non-2xx status code. It carries the essential details of the failure.
+type ApiError struct {
+	Method     string // HTTP method of the failed request
+	Url        string // URL of the failed request
+	StatusCode int    // HTTP response status code
+	Code       string // Azure error code, e.g. "AuthorizationFailed" or "Request_ResourceNotFound"
+	Message    string // Azure error message
+	RequestId  string // Azure request ID, useful when opening support cases
+}
+
+// Returns a one-line description of the API error
+func (e *ApiError) Error() string {
+	msg := fmt.Sprintf("%s %s: %d %s", e.Method, e.Url, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.RequestId != "" {
+		msg += " (request-id " + e.RequestId + ")"
+	}
+	return msg
+}
+
+// Allows errors.Is(err, ErrNotFound) and similar checks against the sentinel errors
+func (e *ApiError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrThrottled:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// Builds an ApiError from the response of a failed call. Both the ARM and the MS Graph APIs
+// return errors in the form {"error": {"code": "...", "message": "..."}}, with Graph also
+// including the request ID under "innerError".
+func newApiError(method, url string, r *http.Response, body jsonT) *ApiError {
+	e := &ApiError{Method: method, Url: url, StatusCode: r.StatusCode}
+	for _, h := range []string{"x-ms-request-id", "request-id", "x-ms-correlation-request-id"} {
+		if v := r.Header.Get(h); v != "" {
+			e.RequestId = v
+			break
+		}
+	}
+	if body != nil {
+		if x, ok := body["error"].(map[string]interface{}); ok {
+			e.Code = utl.Str(x["code"])
+			e.Message = utl.Str(x["message"])
+			if inner, ok := x["innerError"].(map[string]interface{}); ok && e.RequestId == "" {
+				e.RequestId = utl.Str(inner["request-id"])
+			}
+		}
+	}
+	return e
+}
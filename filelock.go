@@ -0,0 +1,110 @@
+package maz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Extension of the lock files kept next to each cache file. The lock is taken on this separate file,
+// since the cache file itself gets replaced on every write.
+const ConstLockFileExtension = ".lock"
+
+// Takes an advisory lock on given file, exclusive for writers or shared for readers, waiting for
+// any other process holding a conflicting lock. Call the returned function to release it.
+func lockFile(filePath string, exclusive bool) (unlock func(), err error) {
+	f, err := os.OpenFile(filePath+ConstLockFileExtension, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] locking: %w", filePath, err)
+	}
+	if err := flock(f, exclusive); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("[%s] locking: %w", filePath, err)
+	}
+	return func() {
+		funlock(f)
+		f.Close()
+	}, nil
+}
+
+// Writes data to a temporary file in the same directory, then renames it over given file, so that
+// readers never see a partially written file
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// Reads given file while holding a shared lock on it
+func readFileLocked(filePath string) ([]byte, error) {
+	unlock, err := lockFile(filePath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return os.ReadFile(filePath)
+}
+
+// Atomically writes given file while holding an exclusive lock on it
+func writeFileLocked(filePath string, data []byte, perm os.FileMode) error {
+	unlock, err := lockFile(filePath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := writeFileAtomic(filePath, data, perm); err != nil {
+		return fmt.Errorf("[%s] %w", filePath, err)
+	}
+	return nil
+}
+
+// Loads a gzipped JSON cache file, under a shared lock. Same as utl.LoadFileJsonGzip otherwise.
+func loadFileJsonGzip(filePath string) (jsonObject interface{}, err error) {
+	data, err := readFileLocked(filePath)
+	if err != nil {
+		return nil, err
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %w", filePath, err)
+	}
+	defer gzipReader.Close()
+	if err := json.NewDecoder(gzipReader).Decode(&jsonObject); err != nil {
+		return nil, fmt.Errorf("[%s] %w", filePath, err)
+	}
+	return jsonObject, nil
+}
+
+// Saves given object as a gzipped JSON cache file, atomically and under an exclusive lock. Unlike
+// utl.SaveFileJsonGzip, concurrent processes can't corrupt the file, and errors are returned.
+func saveFileJsonGzip(jsonObject interface{}, filePath string) error {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gzipWriter).Encode(jsonObject); err != nil {
+		return fmt.Errorf("[%s] %w", filePath, err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("[%s] %w", filePath, err)
+	}
+	return writeFileLocked(filePath, buf.Bytes(), 0600)
+}
@@ -0,0 +1,15 @@
+//go:build !unix && !windows
+
+package maz
+
+import "os"
+
+// File locking is not supported on this platform, so cache writes only rely on the atomic rename
+func flock(f *os.File, exclusive bool) error {
+	return nil
+}
+
+// Releases the lock taken by flock
+func funlock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package maz
+
+import (
+	"os"
+	"syscall"
+)
+
+// Locks given file with flock(2), which blocks until the lock is granted
+func flock(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// Releases the lock taken by flock
+func funlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
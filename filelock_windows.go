@@ -0,0 +1,23 @@
+//go:build windows
+
+package maz
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Locks the whole of given file with LockFileEx, which blocks until the lock is granted
+func flock(f *os.File, exclusive bool) error {
+	var flags uint32
+	if exclusive {
+		flags = windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	return windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, ^uint32(0), ^uint32(0), new(windows.Overlapped))
+}
+
+// Releases the lock taken by flock
+func funlock(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, ^uint32(0), ^uint32(0), new(windows.Overlapped))
+}
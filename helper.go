@@ -1,171 +1,188 @@
 package maz
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/queone/utl"
 )
 
 // Creates or updates a role definition or assignment based on given specfile
-func UpsertAzObject(force bool, filePath string, z Bundle) {
+func UpsertAzObject(force bool, filePath string, z Bundle) error {
 	if utl.FileNotExist(filePath) || utl.FileSize(filePath) < 1 {
-		utl.Die("File does not exist, or it is zero size\n")
+		return fmt.Errorf("[%s] file does not exist, or it is zero size", filePath)
 	}
 	formatType, t, x := GetObjectFromFile(filePath)
 	if formatType != "JSON" && formatType != "YAML" {
-		utl.Die("File is not in JSON nor YAML format\n")
-	}
-	if t != "d" && t != "a" {
-		utl.Die("File is not a role definition nor an assignment specfile\n")
+		return fmt.Errorf("[%s] file is not in JSON nor YAML format", filePath)
 	}
 	switch t {
 	case "d":
-		UpsertAzRoleDefinition(force, x, z)
+		return UpsertAzRoleDefinition(force, x, z)
 	case "a":
-		CreateAzRoleAssignment(x, z)
+		return CreateAzRoleAssignment(x, z)
 	}
-	os.Exit(0)
+	return fmt.Errorf("[%s] file is not a role definition nor an assignment specfile", filePath)
 }
 
 // Deletes object based on string specifier (currently only supports roleDefinitions or Assignments)
 // String specifier can be either of 3: UUID, specfile, or displaName (only for roleDefinition)
 // 1) Search Azure by given identifier; 2) Grab object's Fully Qualified Id string;
-// 3) Print and prompt for confirmation; 4) Delete or abort
-func DeleteAzObject(force bool, specifier string, z Bundle) {
+// 3) Print and prompt for confirmation; 4) Delete or abort. Declining the prompt returns ErrAborted.
+func DeleteAzObject(force bool, specifier string, z Bundle) error {
+	var t string                       // The object's maz type, "d" or "a"
+	var y map[string]interface{} = nil // The object as it is in Azure
 	if utl.ValidUuid(specifier) {
-		list := FindAzObjectsByUuid(specifier, z) // Get all objects that may match this UUID, hopefully just one
+		list, err := FindAzObjectsByUuid(specifier, z) // Get all objects that may match this UUID, hopefully just one
+		if err != nil && len(list) < 1 {
+			return err
+		}
 		if len(list) > 1 {
-			utl.Die(utl.Red("UUID collision? Run utility with UUID argument to see the list.\n"))
+			return fmt.Errorf("UUID collision? Run utility with UUID argument to see the list")
 		}
 		if len(list) < 1 {
-			utl.Die("Object does not exist.\n")
+			return fmt.Errorf("object %s: %w", specifier, ErrNotFound)
 		}
-		y := list[0].(map[string]interface{}) // Single out the only object
-		if y != nil && y["mazType"] != nil {
-			t := utl.Str(y["mazType"])
-			fqid := utl.Str(y["id"]) // Grab fully qualified object Id
-			PrintObject(t, y, z)
-			if !force {
-				if utl.PromptMsg("DELETE above? y/n ") != 'y' {
-					utl.Die("Aborted.\n")
-				}
-			}
-			switch t {
-			case "d":
-				DeleteAzRoleDefinitionByFqid(fqid, z)
-			case "a":
-				DeleteAzRoleAssignmentByFqid(fqid, z)
-			}
+		y = list[0].(map[string]interface{}) // Single out the only object
+		t = utl.Str(y["mazType"])
+		if t != "d" && t != "a" {
+			return fmt.Errorf("object %s is not a role definition or assignment", specifier)
 		}
 	} else if utl.FileExist(specifier) {
 		// Delete object defined in specfile
-		formatType, t, x := GetObjectFromFile(specifier) // x is for the object in Specfile
+		var formatType string
+		var x map[string]interface{} // The object in the specfile
+		formatType, t, x = GetObjectFromFile(specifier)
 		if formatType != "JSON" && formatType != "YAML" {
-			utl.Die("File is not in JSON nor YAML format\n")
+			return fmt.Errorf("[%s] file is not in JSON nor YAML format", specifier)
 		}
-		var y map[string]interface{} = nil
+		var err error
 		switch t {
 		case "d":
-			y = GetAzRoleDefinitionByObject(x, z) // y is for the object from Azure
-			fqid := utl.Str(y["id"])              // Grab fully qualified object Id
+			if y, err = GetAzRoleDefinitionByObject(x, z); err != nil {
+				return err
+			}
 			if y == nil {
-				utl.Die("Role definition does not exist.\n")
-			} else {
-				PrintRoleDefinition(y, z) // Use specific role def print function
-				if !force {
-					if utl.PromptMsg("DELETE above? y/n ") != 'y' {
-						utl.Die("Aborted.\n")
-					}
-				}
-				DeleteAzRoleDefinitionByFqid(fqid, z)
+				return fmt.Errorf("role definition in %s: %w", specifier, ErrNotFound)
 			}
 		case "a":
-			y = GetAzRoleAssignmentByObject(x, z)
-			fqid := utl.Str(y["id"]) // Grab fully qualified object Id
+			if y, err = GetAzRoleAssignmentByObject(x, z); err != nil {
+				return err
+			}
 			if y == nil {
-				utl.Die("Role assignment does not exist.\n")
-			} else {
-				PrintRoleAssignment(y, z) // Use specific role assgmnt print function
-				if !force {
-					if utl.PromptMsg("DELETE above? y/n ") != 'y' {
-						utl.Die("Aborted.\n")
-					}
-				}
-				DeleteAzRoleAssignmentByFqid(fqid, z)
+				return fmt.Errorf("role assignment in %s: %w", specifier, ErrNotFound)
 			}
 		default:
-			utl.Die("File " + formatType + " is not a role definition or assignment.\n")
+			return fmt.Errorf("[%s] file is not a role definition or assignment", specifier)
 		}
 	} else {
 		// Delete role definition by its displayName, if it exists. This only applies to definitions
 		// since assignments do not have a displayName attribute. Also, other objects are not supported.
-		y := GetAzRoleDefinitionByName(specifier, z)
-		if y == nil {
-			utl.Die("Role definition does not exist.\n")
+		var err error
+		if y, err = GetAzRoleDefinitionByName(specifier, z); err != nil {
+			return err // Includes ErrNotFound
 		}
-		fqid := utl.Str(y["id"]) // Grab fully qualified object Id
-		PrintRoleDefinition(y, z)
-		if !force {
-			if utl.PromptMsg("DELETE above? y/n ") != 'y' {
-				utl.Die("Aborted.\n")
-			}
+		t = "d"
+	}
+
+	fqid := utl.Str(y["id"]) // Grab fully qualified object Id
+	if err := PrintObject(t, y, z); err != nil {
+		fmt.Println(utl.Red(err.Error()))
+	}
+	if !force {
+		if utl.PromptMsg("DELETE above? y/n ") != 'y' {
+			return ErrAborted
 		}
-		DeleteAzRoleDefinitionByFqid(fqid, z)
 	}
+	if t == "d" {
+		return DeleteAzRoleDefinitionByFqid(fqid, z)
+	}
+	return DeleteAzRoleAssignmentByFqid(fqid, z)
 }
 
 // Returns list of Azure objects with this UUID. We are saying a list because 1)
 // the UUID could be an appId shared by an app and an SP, or 2) there could be
 // UUID collisions with multiple objects potentially sharing the same UUID. Only
-// checks for the maz package limited set of Azure object types.
-func FindAzObjectsByUuid(uuid string, z Bundle) (list []interface{}) {
+// checks for the maz package limited set of Azure object types. Any errors other than
+// ErrNotFound are collected and returned alongside whatever objects were found.
+func FindAzObjectsByUuid(uuid string, z Bundle) (list []interface{}, err error) {
+	return FindAzObjectsByUuidCtx(context.Background(), uuid, z)
+}
+
+// Context-aware version of FindAzObjectsByUuid
+func FindAzObjectsByUuidCtx(ctx context.Context, uuid string, z Bundle) (list []interface{}, err error) {
 	list = nil
+	var errs []error
 	for _, t := range mazTypes {
-		x := GetAzObjectByUuid(t, uuid, z)
+		x, err := GetAzObjectByUuidCtx(ctx, t, uuid, z)
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				errs = append(errs, err)
+			}
+			continue
+		}
 		if x != nil && x["id"] != nil { // Valid objects have an 'id' attribute
 			// Found one of these types with this UUID
 			x["mazType"] = t // Extend object with mazType as an ADDITIONAL field
 			list = append(list, x)
 		}
 	}
-	return list
+	return list, errors.Join(errs...)
 }
 
 // Retrieves Azure object by Object UUID
-func GetAzObjectByUuid(t, uuid string, z Bundle) (x map[string]interface{}) {
+func GetAzObjectByUuid(t, uuid string, z Bundle) (x map[string]interface{}, err error) {
+	return GetAzObjectByUuidCtx(context.Background(), t, uuid, z)
+}
+
+// Context-aware version of GetAzObjectByUuid
+func GetAzObjectByUuidCtx(ctx context.Context, t, uuid string, z Bundle) (x map[string]interface{}, err error) {
 	switch t {
 	case "d":
-		return GetAzRoleDefinitionByUuid(uuid, z)
+		return GetAzRoleDefinitionByUuidCtx(ctx, uuid, z)
 	case "a":
-		return GetAzRoleAssignmentByUuid(uuid, z)
+		return GetAzRoleAssignmentByUuidCtx(ctx, uuid, z)
 	case "s":
-		return GetAzSubscriptionByUuid(uuid, z)
+		return GetAzSubscriptionByUuidCtx(ctx, uuid, z)
 	case "u":
-		return GetAzUserByUuid(uuid, z)
+		return GetAzUserByUuidCtx(ctx, uuid, z)
 	case "g":
-		return GetAzGroupByUuid(uuid, z)
+		return GetAzGroupByUuidCtx(ctx, uuid, z)
 	case "sp":
-		return GetAzSpByUuid(uuid, z)
+		return GetAzSpByUuidCtx(ctx, uuid, z)
 	case "ap":
-		return GetAzAppByUuid(uuid, z)
+		return GetAzAppByUuidCtx(ctx, uuid, z)
 	case "ad":
-		return GetAzAdRoleByUuid(uuid, z)
+		return GetAzAdRoleByUuidCtx(ctx, uuid, z)
 	}
-	return nil
+	return nil, fmt.Errorf("unknown object type '%s'", t)
 }
 
 // Gets all scopes in the Azure tenant RBAC hierarchy: Tenant Root Group and all
 // management groups, plus all subscription scopes
-func GetAzRbacScopes(z Bundle) (scopes []string) {
+func GetAzRbacScopes(z Bundle) (scopes []string, err error) {
+	return GetAzRbacScopesCtx(context.Background(), z)
+}
+
+// Context-aware version of GetAzRbacScopes
+func GetAzRbacScopesCtx(ctx context.Context, z Bundle) (scopes []string, err error) {
 	scopes = nil
-	managementGroups := GetAzMgGroups(z) // Start by adding all the managementGroups scopes
+	managementGroups, err := GetAzMgGroupsCtx(ctx, z) // Start by adding all the managementGroups scopes
+	if err != nil {
+		return nil, err
+	}
 	for _, i := range managementGroups {
 		x := i.(map[string]interface{})
 		scopes = append(scopes, utl.Str(x["id"]))
 	}
-	subIds := GetAzSubscriptionsIds(z) // Now add all the subscription scopes
+	subIds, err := GetAzSubscriptionsIdsCtx(ctx, z) // Now add all the subscription scopes
+	if err != nil {
+		return nil, err
+	}
 	scopes = append(scopes, subIds...)
 
 	// SCOPES below subscriptions do not appear to be REALLY NEEDED. Most list
@@ -175,8 +192,8 @@ func GetAzRbacScopes(z Bundle) (scopes []string) {
 
 	// params := map[string]string{"api-version": "2021-04-01"} // resourceGroups
 	// for subId := range subIds {
-	// 	url := ConstAzUrl + subId + "/resourcegroups"
-	// 	r, _, _ := ApiGet(url, z, params)
+	// 	url := z.AzUrl() + subId + "/resourcegroups"
+	// 	r, _, _ := ApiGetCtx(ctx, url, z, params)
 	// 	if r != nil && r["value"] != nil {
 	// 		resourceGroups := r["value"].([]interface{})
 	// 		for _, j := range resourceGroups {
@@ -188,24 +205,36 @@ func GetAzRbacScopes(z Bundle) (scopes []string) {
 	// }
 	// // Then repeat for next leval scope ...
 
-	return scopes
+	return scopes, nil
 }
 
 // Retrieves locally cached list of objects in given cache file
 func GetCachedObjects(cacheFile string) (cachedList []interface{}) {
 	cachedList = nil
 	if utl.FileUsable(cacheFile) {
-		rawList, _ := utl.LoadFileJsonGzip(cacheFile)
-		if rawList != nil {
-			cachedList = rawList.([]interface{})
-		}
+		rawList, _ := loadFileJsonGzip(cacheFile)
+		cachedList, _ = rawList.([]interface{}) // A corrupt or foreign file is treated as empty
+		cachedList = jsonObjects(cachedList)
 	}
 	return cachedList
 }
 
+// Returns the count in the result of an MS Graph $count call, which ApiCall puts under "value", or
+// zero if it's missing
+func countResult(url string, r jsonT) (int64, error) {
+	if r["value"] == nil {
+		return 0, nil
+	}
+	count, ok := r["value"].(int64) // Expected result is a single int64 value for the count
+	if !ok {
+		return 0, fmt.Errorf("GET %s: unexpected count value %v", url, r["value"])
+	}
+	return count, nil
+}
+
 // Generic function to get objects of type t whose attributes match on filter.
 // If filter is the "" empty string return ALL of the objects of this type.
-func GetObjects(t, filter string, force bool, z Bundle) (list []interface{}) {
+func GetObjects(t, filter string, force bool, z Bundle) (list []interface{}, err error) {
 	switch t {
 	case "d":
 		return GetMatchingRoleDefinitions(filter, force, z)
@@ -226,13 +255,21 @@ func GetObjects(t, filter string, force bool, z Bundle) (list []interface{}) {
 	case "u":
 		return GetMatchingUsers(filter, force, z)
 	}
-	return nil
+	return nil, fmt.Errorf("unknown object type '%s'", t)
 }
 
 // Returns all Azure pages for given API URL call
-func GetAzAllPages(url string, z Bundle) (list []interface{}) {
+func GetAzAllPages(url string, z Bundle) (list []interface{}, err error) {
+	return GetAzAllPagesCtx(context.Background(), url, z)
+}
+
+// Context-aware version of GetAzAllPages
+func GetAzAllPagesCtx(ctx context.Context, url string, z Bundle) (list []interface{}, err error) {
 	list = nil
-	r, _, _ := ApiGet(url, z, nil)
+	r, _, err := ApiGetCtx(ctx, url, z, nil)
+	if err != nil {
+		return nil, err
+	}
 	for {
 		// Forver loop until there are no more pages
 		var thisBatch []interface{} = nil // Assume zero entries in this batch
@@ -246,18 +283,28 @@ func GetAzAllPages(url string, z Bundle) (list []interface{}) {
 		if nextLink == "" {
 			break // Break once there is no more pages
 		}
-		r, _, _ = ApiGet(nextLink, z, nil) // Get next batch
+		r, _, err = ApiGetCtx(ctx, nextLink, z, nil) // Get next batch
+		if err != nil {
+			return list, err
+		}
 	}
-	return list
+	return list, nil
 }
 
 // Generic Azure object deltaSet retriever function. Returns the set of changed or new items,
 // and a deltaLink for running the next future Azure query. Implements the pattern described at
 // https://docs.microsoft.com/en-us/graph/delta-query-overview
-func GetAzObjects(url string, z Bundle, verbose bool) (deltaSet []interface{}, deltaLinkMap map[string]interface{}) {
+func GetAzObjects(url string, z Bundle, verbose bool) (deltaSet []interface{}, deltaLinkMap map[string]interface{}, err error) {
+	return GetAzObjectsCtx(context.Background(), url, z, verbose)
+}
+
+// Context-aware version of GetAzObjects
+func GetAzObjectsCtx(ctx context.Context, url string, z Bundle, verbose bool) (deltaSet []interface{}, deltaLinkMap map[string]interface{}, err error) {
 	k := 1 // Track number of API calls
-	r, _, _ := ApiGet(url, z, nil)
-	ApiErrorCheck("GET", url, utl.Trace(), r)
+	r, _, err := ApiGetCtx(ctx, url, z, nil)
+	if err != nil {
+		return nil, nil, err
+	}
 	for {
 		// Infinite for-loop until deltaLink appears (meaning we're done getting current delta set)
 		var thisBatch []interface{} = nil // Assume zero entries in this batch
@@ -278,54 +325,48 @@ func GetAzObjects(url string, z Bundle, verbose bool) (deltaSet []interface{}, d
 			if verbose {
 				fmt.Printf("\n")
 			}
-			return deltaSet, deltaLinkMap // Return immediately after deltaLink appears
+			return deltaSet, deltaLinkMap, nil // Return immediately after deltaLink appears
+		}
+		r, _, err = ApiGetCtx(ctx, utl.Str(r["@odata.nextLink"]), z, nil) // Get next batch
+		if err != nil {
+			if verbose {
+				fmt.Printf("\n")
+			}
+			return deltaSet, nil, err
 		}
-		r, _, _ = ApiGet(utl.Str(r["@odata.nextLink"]), z, nil) // Get next batch
-		//ApiErrorCheck("GET", url, utl.Trace(), r)
 		k++
 	}
 }
 
-// Removes specified cache file
-func RemoveCacheFile(t string, z Bundle) {
+// Removes specified cache file. Object caches, like "u" for users, are removed from the CacheStore
+func RemoveCacheFile(t string, z Bundle) error {
+	var fileList []string
 	switch t {
 	case "id":
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.CredsFile))
+		fileList = []string{filepath.Join(z.ConfDir, z.CredsFile)}
 	case "t":
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TokenFile))
-	case "d":
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TenantId+"_roleDefinitions."+ConstCacheFileExtension))
-	case "a":
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TenantId+"_roleAssignments."+ConstCacheFileExtension))
-	case "s":
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TenantId+"_subscriptions."+ConstCacheFileExtension))
-	case "m":
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TenantId+"_managementGroups."+ConstCacheFileExtension))
-	case "u":
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TenantId+"_users."+ConstCacheFileExtension))
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TenantId+"_users_deltaLink."+ConstCacheFileExtension))
-	case "g":
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TenantId+"_groups."+ConstCacheFileExtension))
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TenantId+"_groups_deltaLink."+ConstCacheFileExtension))
-	case "sp":
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TenantId+"_servicePrincipals."+ConstCacheFileExtension))
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TenantId+"_servicePrincipals_deltaLink."+ConstCacheFileExtension))
-	case "ap":
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TenantId+"_applications."+ConstCacheFileExtension))
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TenantId+"_applications_deltaLink."+ConstCacheFileExtension))
-	case "ad":
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TenantId+"_directoryRoles."+ConstCacheFileExtension))
-		utl.RemoveFile(filepath.Join(z.ConfDir, z.TenantId+"_directoryRoles_deltaLink."+ConstCacheFileExtension))
+		fileList = []string{filepath.Join(z.ConfDir, z.TokenFile)}
+		if err := setupSecretStore(&z); err != nil {
+			return err
+		}
+		if z.SecretStore != nil {
+			if err := z.SecretStore.Delete(z.TokenFile); err != nil {
+				return err
+			}
+		}
 	case "all":
-		// See https://stackoverflow.com/questions/48072236/remove-files-with-wildcard
-		fileList, err := filepath.Glob(filepath.Join(z.ConfDir, z.TenantId+"_*."+ConstCacheFileExtension))
-		if err != nil {
-			panic(err)
+		return z.cacheStore().Remove(z.TenantId, "")
+	default:
+		if objectType := cacheObjectTypes[t]; objectType != "" {
+			return z.cacheStore().Remove(z.TenantId, objectType)
 		}
-		for _, filePath := range fileList {
-			utl.RemoveFile(filePath)
+	}
+	for _, filePath := range fileList {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
 		}
 	}
+	return nil
 }
 
 // Returns 3 values: File format type, single-letter object type, and the object itself
@@ -361,17 +402,20 @@ func GetObjectFromFile(filePath string) (formatType, t string, obj map[string]in
 }
 
 // Compares specification file to what is in Azure
-func CompareSpecfileToAzure(filePath string, z Bundle) {
+func CompareSpecfileToAzure(filePath string, z Bundle) error {
 	if utl.FileNotExist(filePath) || utl.FileSize(filePath) < 1 {
-		utl.Die("File does not exist, or is zero size\n")
+		return fmt.Errorf("[%s] file does not exist, or is zero size", filePath)
 	}
 	formatType, t, fileDef := GetObjectFromFile(filePath)
 	if (formatType != "JSON" && formatType != "YAML" && t != "d" && t != "a") || t == "" {
-		utl.Die("File is not a properly defined role definition or assignment.\n")
+		return fmt.Errorf("[%s] file is not a properly defined role definition or assignment", filePath)
 	}
 
 	if t == "d" {
-		azureDef := GetAzRoleDefinitionByObject(fileDef, z)
+		azureDef, err := GetAzRoleDefinitionByObject(fileDef, z)
+		if err != nil {
+			return err
+		}
 		if azureDef == nil {
 			fileProp := fileDef["properties"].(map[string]interface{})
 			fileRoleName := utl.Str(fileProp["roleName"])
@@ -381,7 +425,10 @@ func CompareSpecfileToAzure(filePath string, z Bundle) {
 			DiffRoleDefinitionSpecfileVsAzure(fileDef, azureDef, z)
 		}
 	} else {
-		azureDef := GetAzRoleAssignmentByObject(fileDef, z)
+		azureDef, err := GetAzRoleAssignmentByObject(fileDef, z)
+		if err != nil {
+			return err
+		}
 		if azureDef == nil {
 			fmt.Printf("Role assignment in specfile does " + utl.Red("not") + " exist in Azure.\n")
 		} else {
@@ -389,5 +436,28 @@ func CompareSpecfileToAzure(filePath string, z Bundle) {
 			PrintRoleAssignment(azureDef, z)
 		}
 	}
-	os.Exit(0)
+	return nil
+}
+
+// Returns the endDateTime of a new secret in RFC3339Nano/ISO8601 format, along with its date in
+// yyyy-mm-dd format, given an expiry that is either such a date or a number of days from now
+func secretEndDateTime(expiry string) (endDateTime, date string, err error) {
+	if utl.ValidDate(expiry, "2006-01-02") {
+		endDateTime, err = utl.ConvertDateFormat(expiry, "2006-01-02", time.RFC3339Nano)
+		if err != nil {
+			return "", "", fmt.Errorf("converting expiry '%s' to RFC3339Nano/ISO8601 format: %w", expiry, err)
+		}
+		return endDateTime, expiry, nil
+	}
+	// If expiry not a valid date, see if it's a valid integer number
+	days, err := utl.StringToInt64(expiry)
+	if err != nil {
+		return "", "", fmt.Errorf("expiry '%s' is neither a yyyy-mm-dd date nor a number of days", expiry)
+	}
+	maxDays := utl.GetDaysSinceOrTo("9999-12-31") // Maximum supported date
+	if days > maxDays {
+		days = maxDays
+	}
+	expiryTime := utl.GetDateInDays(utl.Int64ToString(days)) // Set expiryTime to 'days' from now
+	return expiryTime.Format(time.RFC3339Nano), expiryTime.Format("2006-01-02"), nil
 }
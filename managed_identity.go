@@ -0,0 +1,124 @@
+package maz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	ConstImdsUrl = "http://169.254.169.254/metadata/identity/oauth2/token" // Azure VM IMDS token endpoint
+)
+
+// Acquires an Azure JWT token from the managed identity of the Azure VM, App Service, Function
+// App, etc, that the program is running on. An empty clientId means the system-assigned identity,
+// otherwise it's the client ID of the user-assigned identity to use. An empty endpoint means the
+// App Service IDENTITY_ENDPOINT if defined, or the VM Instance Metadata Service (IMDS) otherwise.
+// Given endpoints are always called with the IMDS protocol.
+// Only the first scope is used, since managed identity tokens are requested per resource.
+func GetTokenByManagedIdentity(scopes []string, endpoint, clientId string) (token string, err error) {
+	return GetTokenByManagedIdentityCtx(context.Background(), scopes, endpoint, clientId)
+}
+
+// Context-aware version of GetTokenByManagedIdentity
+func GetTokenByManagedIdentityCtx(ctx context.Context, scopes []string, endpoint, clientId string) (token string, err error) {
+	return getTokenByManagedIdentity(ctx, Bundle{}, scopes, endpoint, clientId)
+}
+
+// Managed identity login, making the calls with the bundle's HTTP client and retrying throttled or
+// failed ones according to its retry policy, since IMDS is rate limited and can be briefly unavailable
+func getTokenByManagedIdentity(ctx context.Context, z Bundle, scopes []string, endpoint, clientId string) (token string, err error) {
+	if len(scopes) < 1 {
+		return "", fmt.Errorf("managed identity: no scope given")
+	}
+	resource := strings.TrimSuffix(scopes[0], "/.default")
+
+	// App Service and Functions expose their own endpoint, which uses a different protocol than IMDS.
+	// It only applies when no endpoint was explicitly given.
+	identityHeader := ""
+	if endpoint == "" && os.Getenv("IDENTITY_ENDPOINT") != "" {
+		endpoint = os.Getenv("IDENTITY_ENDPOINT")
+		identityHeader = os.Getenv("IDENTITY_HEADER")
+	}
+	if endpoint == "" {
+		endpoint = ConstImdsUrl
+	}
+
+	params := url.Values{}
+	params.Set("resource", resource)
+	if clientId != "" {
+		params.Set("client_id", clientId) // Selects a user-assigned identity
+	}
+	if identityHeader != "" {
+		params.Set("api-version", "2019-08-01")
+	} else {
+		params.Set("api-version", "2018-02-01")
+	}
+
+	policy := z.retryPolicy()
+	var r *http.Response
+	var body []byte
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+		if err != nil {
+			return "", fmt.Errorf("managed identity: %w", err)
+		}
+		if identityHeader != "" {
+			req.Header.Set("X-IDENTITY-HEADER", identityHeader)
+		} else {
+			req.Header.Set("Metadata", "true")
+		}
+		req.URL.RawQuery = params.Encode()
+
+		r, err = z.httpClient().Do(req)
+		if err != nil {
+			return "", fmt.Errorf("managed identity: %w", err)
+		}
+		body, err = io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("managed identity: reading response: %w", err)
+		}
+		// Unlike the APIs, IMDS may also fail with other 5xx codes that are worth retrying
+		retryable := r.StatusCode == http.StatusTooManyRequests || r.StatusCode >= 500
+		if !retryable || attempt >= policy.MaxAttempts {
+			break
+		}
+		delay := policy.delay(attempt, r)
+		if policy.OnRetry != nil {
+			policy.OnRetry(RetryEvent{
+				Method:     "GET",
+				Url:        endpoint,
+				Attempt:    attempt,
+				StatusCode: r.StatusCode,
+				Delay:      delay,
+				Err:        fmt.Errorf("managed identity: %d %s", r.StatusCode, http.StatusText(r.StatusCode)),
+				Header:     r.Header,
+			})
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("managed identity: %d %s: decoding response: %w", r.StatusCode, http.StatusText(r.StatusCode), err)
+	}
+	if r.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return "", fmt.Errorf("managed identity: %d %s: %s: %s", r.StatusCode, http.StatusText(r.StatusCode), result.Error, result.ErrorDescription)
+	}
+	return result.AccessToken, nil
+}
@@ -1,17 +1,23 @@
 // Package maz is a library of functions for interacting with essential Azure APIs via
-// REST calls. Currently it supports two APIs, the Azure Resource Management (ARM) API
-// and the MS Graph API, but can be extended to support additional APIs. This package
+// REST calls. Currently it mainly supports two APIs, the Azure Resource Management (ARM) API
+// and the MS Graph API, but other APIs like Key Vault can be called too, by way of the
+// ApiResource registry. This package
 // obviously also includes code to get an Azure JWT token using the MSAL library, to
 // then use against either the 2 currently supported Azure APIs.
 package maz
 
 import (
+	"context"
 	"fmt"
+	"maps"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
 	"github.com/queone/utl"
 )
 
@@ -45,106 +51,342 @@ var (
 		"ap": "Registered Application",
 		"ad": "Azure AD Role",
 	}
+	cacheObjectTypes = map[string]string{ // Object type names the CacheStore uses, by maz type
+		"d":  "roleDefinitions",
+		"a":  "roleAssignments",
+		"s":  "subscriptions",
+		"m":  "managementGroups",
+		"u":  "users",
+		"g":  "groups",
+		"sp": "servicePrincipals",
+		"ap": "applications",
+		"ad": "directoryRoles",
+	}
 	eVars = map[string]string{
-		"MAZ_TENANT_ID":     "",
-		"MAZ_USERNAME":      "",
-		"MAZ_INTERACTIVE":   "",
-		"MAZ_CLIENT_ID":     "",
-		"MAZ_CLIENT_SECRET": "",
-		"MAZ_MG_TOKEN":      "",
-		"MAZ_AZ_TOKEN":      "",
+		"MAZ_TENANT_ID":            "",
+		"MAZ_USERNAME":             "",
+		"MAZ_INTERACTIVE":          "",
+		"MAZ_DEVICE_CODE":          "",
+		"MAZ_CLIENT_ID":            "",
+		"MAZ_CLIENT_SECRET":        "",
+		"MAZ_CLIENT_CERT_PATH":     "",
+		"MAZ_CLIENT_CERT_PASSWORD": "",
+		"MAZ_FEDERATED_TOKEN_FILE": "",
+		"MAZ_MANAGED_IDENTITY":     "",
+		"MAZ_MANAGED_IDENTITY_URL": "",
+		"MAZ_MG_TOKEN":             "",
+		"MAZ_AZ_TOKEN":             "",
 	}
 )
 
 type Bundle struct {
-	ConfDir      string // Directory where utility will store all its file
-	CredsFile    string
-	TokenFile    string
-	TenantId     string
-	ClientId     string
-	ClientSecret string
-	Interactive  bool
-	Username     string
-	AuthorityUrl string
-	MgToken      string // This and below to support MS Graph API
-	MgHeaders    map[string]string
-	AzToken      string // This and below to support Azure Resource Management API
-	AzHeaders    map[string]string
-	// To support other future APIs, those token/headers pairs can be added here
+	ConfDir            string // Directory where utility will store all its file
+	CredsFile          string
+	TokenFile          string
+	Profile            string // Credentials file profile to use. MAZ_PROFILE has precedence
+	TenantId           string
+	ClientId           string
+	ClientSecret       string
+	ClientCertPath     string // PEM or PFX certificate file, used instead of ClientSecret if set
+	ClientCertPassword string // Optional password for above certificate file
+	FederatedTokenFile string // File with a federated OIDC token, used instead of ClientSecret if set
+	ManagedIdentity    bool   // Use the host's managed identity. ClientId selects a user-assigned one
+	ManagedIdentityUrl string // Managed identity token endpoint. Defaults to App Service's or IMDS
+	Interactive        bool
+	DeviceCode         bool // Use the device code flow, instead of a browser popup, for interactive login
+	Username           string
+	AuthorityUrl       string
+	MgToken            string // This and below to support MS Graph API
+	MgHeaders          map[string]string
+	AzToken            string // This and below to support Azure Resource Management API
+	AzHeaders          map[string]string
+	// Other APIs, on top of the cloud's built-in ones like Key Vault, are registered in Apis
+	Apis          []ApiResource       // Get their tokens from TokenProvider, on the first call to each
+	TokenProvider TokenProvider       // Supplies fresh tokens to ApiCall. If nil, the static tokens above are used
+	Retry         *RetryPolicy        // Retry policy for throttled API calls. If nil, DefaultRetryPolicy is used
+	SecretStore   SecretStore         // Keeps the token cache and secrets. If nil, MAZ_SECRET_STORE selects one
+	Cache         CacheStore          // Keeps the local cache of Azure objects. If nil, it's gzipped files in ConfDir
+	Concurrency   int                 // Max parallel calls when walking RBAC scopes. Defaults to ConstAzConcurrency
+	RbacQuery     string              // How to list RBAC objects, one of the ConstRbacQuery* ones. Defaults to auto
+	DeltaTypes    []DeltaType         // MS Graph types synced with delta queries, on top of the built-in ones
+	CacheSelect   map[string][]string // Extra attributes to cache, by delta type, e.g. "users": {"mail", "jobTitle"}
+
+	// Optional overrides, to target other clouds or local test servers. Empty means the defaults
+	Cloud        Cloud        // Cloud environment profile. Defaults to AzurePublic
+	HttpClient   *http.Client // HTTP client used for all API calls
+	AuthEndpoint string       // Login authority base URL, with trailing slash. Defaults to the cloud's
+	MgEndpoint   string       // MS Graph API base URL. Defaults to the cloud's
+	AzEndpoint   string       // Azure Resource Management API base URL. Defaults to the cloud's
+}
+
+// Shared client for all API calls when Bundle.HttpClient is not set, so connections get reused
+var defaultHttpClient = &http.Client{Timeout: time.Second * 60} // One minute timeout
+
+// Returns the HTTP client to use for API calls
+func (z Bundle) httpClient() *http.Client {
+	if z.HttpClient != nil {
+		return z.HttpClient
+	}
+	return defaultHttpClient
+}
+
+// Returns a copy of the bundle with given MS Graph header added, leaving the caller's headers alone
+func (z Bundle) withMgHeader(k, v string) Bundle {
+	h := make(map[string]string, len(z.MgHeaders)+1)
+	maps.Copy(h, z.MgHeaders)
+	h[k] = v
+	z.MgHeaders = h
+	return z
+}
+
+// Returns the login authority base URL in effect
+func (z Bundle) AuthUrl() string {
+	if z.AuthEndpoint != "" {
+		return z.AuthEndpoint
+	}
+	return z.cloud().AuthUrl
+}
+
+// Returns the MS Graph API base URL in effect
+func (z Bundle) MgUrl() string {
+	if z.MgEndpoint != "" {
+		return strings.TrimSuffix(z.MgEndpoint, "/")
+	}
+	return z.cloud().MgUrl
+}
+
+// Returns the Azure Resource Management API base URL in effect
+func (z Bundle) AzUrl() string {
+	if z.AzEndpoint != "" {
+		return strings.TrimSuffix(z.AzEndpoint, "/")
+	}
+	return z.cloud().AzUrl
+}
+
+// Returns the scope to request MS Graph API tokens with
+func (z Bundle) mgScope() string {
+	if z.MgEndpoint != "" {
+		return z.MgUrl() + "/.default"
+	}
+	return z.cloud().MgScope
+}
+
+// Returns the scope to request Azure Resource Management API tokens with
+func (z Bundle) azScope() string {
+	if z.AzEndpoint != "" {
+		return z.AzUrl() + "/.default"
+	}
+	return z.cloud().AzScope
 }
 
 // Dumps configured login values
-func DumpLoginValues(z Bundle) {
+func DumpLoginValues(z Bundle) error {
 	fmt.Printf("%s: %s  # Config and cache directory\n", utl.Blu("config_dir"), utl.Gre(z.ConfDir))
 
 	fmt.Printf("%s:\n", utl.Blu("config_env_variables"))
 	fmt.Println("  # 1. MS Graph and Azure ARM tokens can be supplied directly via MAZ_MG_TOKEN and")
 	fmt.Println("  #    MAZ_AZ_TOKEN environment variables, and they have the highest precedence.")
-	fmt.Println("  #    Note, MAZ_TENANT_ID is still required when using these 2.")
+	fmt.Println("  #    Note, MAZ_TENANT_ID is still required when using these 2. If only one is")
+	fmt.Println("  #    supplied, the other API's token comes from any login set up below.")
 	fmt.Println("  # 2. Credentials supplied via environment variables have precedence over those")
 	fmt.Println("  #    provided via credentials file.")
 	fmt.Println("  # 3. The MAZ_USERNAME + MAZ_INTERACTIVE combo have priority over the MAZ_CLIENT_ID")
 	fmt.Println("  #    + MAZ_CLIENT_SECRET combination.")
+	fmt.Println("  # 4. MAZ_CLIENT_CERT_PATH, plus optional MAZ_CLIENT_CERT_PASSWORD, can be used")
+	fmt.Println("  #    instead of MAZ_CLIENT_SECRET, and have priority over it.")
+	fmt.Println("  # 5. MAZ_FEDERATED_TOKEN_FILE can also be used instead of MAZ_CLIENT_SECRET. If no")
+	fmt.Println("  #    MAZ_* variables are set, the AZURE_TENANT_ID, AZURE_CLIENT_ID and")
+	fmt.Println("  #    AZURE_FEDERATED_TOKEN_FILE ones from Kubernetes workload identity are used.")
+	fmt.Println("  # 6. MAZ_MANAGED_IDENTITY uses the host's managed identity, the user-assigned one")
+	fmt.Println("  #    if MAZ_CLIENT_ID is also set, and MAZ_MANAGED_IDENTITY_URL optionally sets")
+	fmt.Println("  #    the token endpoint to use.")
+	fmt.Println("  # 7. MAZ_SECRET_STORE keeps the token cache, and any client_secret or")
+	fmt.Println("  #    client_cert_password saved with 'secretstore:' references, in an encrypted")
+	fmt.Println("  #    'file', keyed by MAZ_SECRET_KEY or MAZ_SECRET_KEY_FILE, or in the OS 'keyring'.")
 	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_TENANT_ID"), utl.Gre(os.Getenv("MAZ_TENANT_ID")))
 	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_USERNAME"), utl.Gre(os.Getenv("MAZ_USERNAME")))
 	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_INTERACTIVE"), utl.Mag(os.Getenv("MAZ_INTERACTIVE")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_DEVICE_CODE"), utl.Mag(os.Getenv("MAZ_DEVICE_CODE")))
 	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CLIENT_ID"), utl.Gre(os.Getenv("MAZ_CLIENT_ID")))
-	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CLIENT_SECRET"), utl.Gre(os.Getenv("MAZ_CLIENT_SECRET")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CLIENT_SECRET"), utl.Gre(maskedSecret(os.Getenv("MAZ_CLIENT_SECRET"))))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CLIENT_CERT_PATH"), utl.Gre(os.Getenv("MAZ_CLIENT_CERT_PATH")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CLIENT_CERT_PASSWORD"), utl.Gre(maskedSecret(os.Getenv("MAZ_CLIENT_CERT_PASSWORD"))))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_FEDERATED_TOKEN_FILE"), utl.Gre(os.Getenv("MAZ_FEDERATED_TOKEN_FILE")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_MANAGED_IDENTITY"), utl.Mag(os.Getenv("MAZ_MANAGED_IDENTITY")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_MANAGED_IDENTITY_URL"), utl.Gre(os.Getenv("MAZ_MANAGED_IDENTITY_URL")))
 	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_MG_TOKEN"), utl.Gre(os.Getenv("MAZ_MG_TOKEN")))
 	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_AZ_TOKEN"), utl.Gre(os.Getenv("MAZ_AZ_TOKEN")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_CLOUD"), utl.Gre(os.Getenv("MAZ_CLOUD")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_PROFILE"), utl.Gre(os.Getenv("MAZ_PROFILE")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_SECRET_STORE"), utl.Gre(os.Getenv("MAZ_SECRET_STORE")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_SECRET_KEY"), utl.Gre(maskedEnv("MAZ_SECRET_KEY")))
+	fmt.Printf("  %s: %s\n", utl.Blu("MAZ_SECRET_KEY_FILE"), utl.Gre(os.Getenv("MAZ_SECRET_KEY_FILE")))
 	fmt.Printf("%s:\n", utl.Blu("config_creds_file"))
 	filePath := filepath.Join(z.ConfDir, z.CredsFile)
 	fmt.Printf("  %s: %s\n", utl.Blu("file_path"), utl.Gre(filePath))
-	credsRaw, err := utl.LoadFileYaml(filePath)
+	if utl.FileNotExist(filePath) {
+		return fmt.Errorf("[%s] credentials file does not exist yet", filePath)
+	}
+	if names, defaultName, err := ListProfiles(z); err == nil && len(names) > 1 {
+		fmt.Printf("  %s: %s\n", utl.Blu("profiles"), utl.Gre(strings.Join(names, ", ")))
+		fmt.Printf("  %s: %s\n", utl.Blu("default_profile"), utl.Gre(defaultName))
+	}
+	creds, profile, err := loadProfile(z)
 	if err != nil {
-		utl.Die(utl.Red("  Credentials file does not exists yet.\n"))
+		return err
 	}
-	creds := credsRaw.(map[string]interface{})
+	fmt.Printf("  %s: %s\n", utl.Blu("profile"), utl.Gre(profile))
 	fmt.Printf("  %s: %s\n", utl.Blu("tenant_id"), utl.Gre(utl.Str(creds["tenant_id"])))
-	if strings.ToLower(utl.Str(creds["interactive"])) == "true" {
+	if cloud := utl.Str(creds["cloud"]); cloud != "" {
+		fmt.Printf("  %s: %s\n", utl.Blu("cloud"), utl.Gre(cloud))
+	}
+	if strings.ToLower(utl.Str(creds["managed_identity"])) == "true" {
+		fmt.Printf("  %s: %s\n", utl.Blu("managed_identity"), utl.Mag("true"))
+		if clientId := utl.Str(creds["client_id"]); clientId != "" {
+			fmt.Printf("  %s: %s\n", utl.Blu("client_id"), utl.Gre(clientId))
+		}
+		if miUrl := utl.Str(creds["managed_identity_url"]); miUrl != "" {
+			fmt.Printf("  %s: %s\n", utl.Blu("managed_identity_url"), utl.Gre(miUrl))
+		}
+	} else if strings.ToLower(utl.Str(creds["interactive"])) == "true" || utl.Str(creds["interactive_mode"]) != "" {
 		fmt.Printf("  %s: %s\n", utl.Blu("username"), utl.Gre(utl.Str(creds["username"])))
 		fmt.Printf("  %s: %s\n", utl.Blu("interactive"), utl.Mag("true"))
+		if mode := utl.Str(creds["interactive_mode"]); mode != "" {
+			fmt.Printf("  %s: %s\n", utl.Blu("interactive_mode"), utl.Mag(mode))
+		}
 	} else {
 		fmt.Printf("  %s: %s\n", utl.Blu("client_id"), utl.Gre(utl.Str(creds["client_id"])))
-		fmt.Printf("  %s: %s\n", utl.Blu("client_secret"), utl.Gre(utl.Str(creds["client_secret"])))
+		if certPath := utl.Str(creds["client_cert_path"]); certPath != "" {
+			fmt.Printf("  %s: %s\n", utl.Blu("client_cert_path"), utl.Gre(certPath))
+			fmt.Printf("  %s: %s\n", utl.Blu("client_cert_password"), utl.Gre(maskedSecret(utl.Str(creds["client_cert_password"]))))
+		} else if tokenFile := utl.Str(creds["federated_token_file"]); tokenFile != "" {
+			fmt.Printf("  %s: %s\n", utl.Blu("federated_token_file"), utl.Gre(tokenFile))
+		} else {
+			fmt.Printf("  %s: %s\n", utl.Blu("client_secret"), utl.Gre(maskedSecret(utl.Str(creds["client_secret"]))))
+		}
+	}
+	return nil
+}
+
+// Returns "(set)" if given environment variable has a value, so secrets aren't displayed
+func maskedEnv(name string) string {
+	if os.Getenv(name) != "" {
+		return "(set)"
 	}
-	os.Exit(0)
+	return ""
+}
+
+// Returns "(set)" for a non-empty secret, so it isn't displayed, but returns ConstSecretRefPrefix
+// references as they are, since they only name the key the secret is kept under
+func maskedSecret(value string) string {
+	if value == "" || strings.HasPrefix(value, ConstSecretRefPrefix) {
+		return value
+	}
+	return "(set)"
 }
 
 // Sets up credentials file for interactive login
-func SetupInterativeLogin(z Bundle) {
-	filePath := filepath.Join(z.ConfDir, z.CredsFile) // credentials.yaml
+func SetupInterativeLogin(z Bundle) error {
 	if !utl.ValidUuid(z.TenantId) {
-		utl.Die("Error. TENANT_ID is an invalid UUID.\n")
+		return fmt.Errorf("tenant_id '%s' is not a valid UUID", z.TenantId)
 	}
 	content := fmt.Sprintf("%-14s %s\n%-14s %s\n%-14s %s\n", "tenant_id:", z.TenantId, "username:", z.Username, "interactive:", "true")
-	if err := os.WriteFile(filePath, []byte(content), 0600); err != nil { // Write string to file
-		panic(err.Error())
+	if z.DeviceCode {
+		content += fmt.Sprintf("%-14s %s\n", "interactive_mode:", "devicecode")
 	}
-	fmt.Printf("Updated %s file\n", utl.Gre(filePath))
-	os.Exit(0)
+	z.Interactive, z.ManagedIdentity = true, false
+	return saveLogin(z, content)
 }
 
-// Sets up credentials file for client_id + secret login
-func SetupAutomatedLogin(z Bundle) {
-	filePath := filepath.Join(z.ConfDir, z.CredsFile) // credentials.yaml
+// Sets up credentials file for client_id + secret login, or client_id + certificate login if
+// z.ClientCertPath is set, or client_id + federated token login if z.FederatedTokenFile is set
+func SetupAutomatedLogin(z Bundle) error {
 	if !utl.ValidUuid(z.TenantId) {
-		utl.Die("Error. TENANT_ID is an invalid UUID.\n")
+		return fmt.Errorf("tenant_id '%s' is not a valid UUID", z.TenantId)
 	}
 	if !utl.ValidUuid(z.ClientId) {
-		utl.Die("Error. CLIENT_ID is an invalid UUID.\n")
+		return fmt.Errorf("client_id '%s' is not a valid UUID", z.ClientId)
+	}
+	content := fmt.Sprintf("%-14s %s\n%-14s %s\n", "tenant_id:", z.TenantId, "client_id:", z.ClientId)
+	if z.ClientCertPath != "" {
+		if utl.FileNotExist(z.ClientCertPath) {
+			return fmt.Errorf("certificate file %s does not exist", z.ClientCertPath)
+		}
+		content += fmt.Sprintf("%-14s %s\n", "client_cert_path:", z.ClientCertPath)
+		if z.ClientCertPassword != "" {
+			password, err := storeSecret(z, "client_cert_password", z.ClientCertPassword)
+			if err != nil {
+				return err
+			}
+			z.ClientCertPassword = password // So saveLogin doesn't store it again
+			content += fmt.Sprintf("%-14s %s\n", "client_cert_password:", password)
+		}
+	} else if z.FederatedTokenFile != "" {
+		content += fmt.Sprintf("%-14s %s\n", "federated_token_file:", z.FederatedTokenFile)
+	} else {
+		secret, err := storeSecret(z, "client_secret", z.ClientSecret)
+		if err != nil {
+			return err
+		}
+		z.ClientSecret = secret // So saveLogin doesn't store it again
+		content += fmt.Sprintf("%-14s %s\n", "client_secret:", secret)
+	}
+	z.Interactive, z.DeviceCode, z.ManagedIdentity = false, false, false
+	return saveLogin(z, content)
+}
+
+// Sets up credentials file for managed identity login, using the user-assigned identity if
+// z.ClientId is set
+func SetupManagedIdentityLogin(z Bundle) error {
+	if !utl.ValidUuid(z.TenantId) {
+		return fmt.Errorf("tenant_id '%s' is not a valid UUID", z.TenantId)
+	}
+	if z.ClientId != "" && !utl.ValidUuid(z.ClientId) {
+		return fmt.Errorf("client_id '%s' is not a valid UUID", z.ClientId)
+	}
+	content := fmt.Sprintf("%-14s %s\n%-14s %s\n", "tenant_id:", z.TenantId, "managed_identity:", "true")
+	if z.ClientId != "" {
+		content += fmt.Sprintf("%-14s %s\n", "client_id:", z.ClientId)
+	}
+	if z.ManagedIdentityUrl != "" {
+		content += fmt.Sprintf("%-14s %s\n", "managed_identity_url:", z.ManagedIdentityUrl)
+	}
+	z.ManagedIdentity = true
+	return saveLogin(z, content)
+}
+
+// Saves the login settings set up by one of above functions. If the credentials file is using
+// profiles, they go into the selected profile, otherwise given content becomes the whole file.
+func saveLogin(z Bundle, content string) error {
+	filePath := filepath.Join(z.ConfDir, z.CredsFile) // credentials.yaml
+	file, err := loadCredsFile(filePath)
+	if err != nil {
+		return err
+	}
+	if _, hasProfiles := file["profiles"]; hasProfiles || z.Profile != "" || os.Getenv("MAZ_PROFILE") != "" {
+		name := selectProfile(z, file)
+		if err := AddProfile(z, name); err != nil {
+			return err
+		}
+		fmt.Printf("Updated profile %s in %s file\n", utl.Gre(name), utl.Gre(filePath))
+		return nil
 	}
-	content := fmt.Sprintf("%-14s %s\n%-14s %s\n%-14s %s\n", "tenant_id:", z.TenantId, "client_id:", z.ClientId, "client_secret:", z.ClientSecret)
-	if err := os.WriteFile(filePath, []byte(content), 0600); err != nil { // Write string to file
-		panic(err.Error())
+	if err := writeFileLocked(filePath, []byte(content), 0600); err != nil { // Write string to file
+		return err
 	}
 	fmt.Printf("Updated %s file\n", utl.Gre(filePath))
-	os.Exit(0)
+	return nil
 }
 
 // Gets credentials from OS environment variables (which take precedence), or from the
 // credentials file.
-func SetupCredentials(z *Bundle) Bundle {
+func SetupCredentials(z *Bundle) (Bundle, error) {
+	// MAZ_SECRET_STORE is also read separately, since it applies to both login setups below
+	if err := setupSecretStore(z); err != nil {
+		return *z, err
+	}
+	cloudName := ""   // Keep whatever cloud the bundle has, unless one is specified below
+	cloudSource := "" // Where the cloud name came from, for error messages
 	usingEnv := false // Assume environment variables are not being used
 	for k := range eVars {
 		eVars[k] = os.Getenv(k) // Read all MAZ_* environment variables
@@ -152,19 +394,61 @@ func SetupCredentials(z *Bundle) Bundle {
 			usingEnv = true // If any are set, environment variable login/token is true
 		}
 	}
+	if !usingEnv && os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "" {
+		// Fall back to the variables injected by Kubernetes workload identity, if that's all there is
+		eVars["MAZ_TENANT_ID"] = os.Getenv("AZURE_TENANT_ID")
+		eVars["MAZ_CLIENT_ID"] = os.Getenv("AZURE_CLIENT_ID")
+		eVars["MAZ_FEDERATED_TOKEN_FILE"] = os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+		usingEnv = true
+	}
 	if usingEnv {
 		// Getting from OS environment variables
 		z.TenantId = eVars["MAZ_TENANT_ID"]
 		if !utl.ValidUuid(z.TenantId) {
-			utl.Die("[MAZ_TENANT_ID] tenant_id '%s' is not a valid UUID\n", z.TenantId)
+			return *z, fmt.Errorf("[MAZ_TENANT_ID] tenant_id '%s' is not a valid UUID", z.TenantId)
+		}
+		if z.CacheSelect == nil {
+			// Not a login setting, so it still comes from the credentials file profile, if there is one
+			if creds, profile, err := loadProfile(*z); err == nil {
+				if z.CacheSelect, err = parseCacheSelect(creds["cache_select"]); err != nil {
+					filePath := filepath.Join(z.ConfDir, z.CredsFile) + ":" + profile
+					return *z, fmt.Errorf("[%s] cache_select %w", filePath, err)
+				}
+			}
 		}
 		z.MgToken = eVars["MAZ_MG_TOKEN"]
 		z.AzToken = eVars["MAZ_AZ_TOKEN"]
-		// Let's assume tokens for each of the 2 APIs have been supplied
-		if !TokenValid(z.AzToken) && !TokenValid(z.MgToken) {
-			// If they are both not valid, then we'll process the other variables
+		// A login is needed unless tokens for both APIs have been supplied. If only one was, and no login
+		// is set up via environment variables, then the credentials file profile login is used for the
+		// other API, as long as it's for the same tenant. Calls to that API will fail without one.
+		supplied := TokenValid(z.AzToken) || TokenValid(z.MgToken)
+		bothSupplied := TokenValid(z.AzToken) && TokenValid(z.MgToken)
+		if supplied && !bothSupplied && !envLoginSet() {
+			creds, profile, err := loadProfile(*z)
+			if err == nil && strings.EqualFold(utl.Str(creds["tenant_id"]), z.TenantId) {
+				z.Profile = profile
+				filePath := filepath.Join(z.ConfDir, z.CredsFile) + ":" + profile // For error messages
+				cloudName, cloudSource = utl.Str(creds["cloud"]), filePath
+				if err := setupProfileLogin(z, creds, filePath); err != nil {
+					return *z, err
+				}
+			}
+		} else if !bothSupplied {
+			// Process the other variables
 			z.Interactive, _ = strconv.ParseBool(utl.Str(eVars["MAZ_INTERACTIVE"]))
-			if z.Interactive {
+			z.DeviceCode, _ = strconv.ParseBool(utl.Str(eVars["MAZ_DEVICE_CODE"]))
+			if z.DeviceCode {
+				z.Interactive = true // Device code is just another way of logging in interactively
+			}
+			z.ManagedIdentity, _ = strconv.ParseBool(utl.Str(eVars["MAZ_MANAGED_IDENTITY"]))
+			if z.ManagedIdentity {
+				z.Interactive = false
+				z.ManagedIdentityUrl = utl.Str(eVars["MAZ_MANAGED_IDENTITY_URL"])
+				z.ClientId = utl.Str(eVars["MAZ_CLIENT_ID"]) // Optional, for a user-assigned identity
+				if z.ClientId != "" && !utl.ValidUuid(z.ClientId) {
+					return *z, fmt.Errorf("[MAZ_CLIENT_ID] client_id '%s' is not a valid UUID", z.ClientId)
+				}
+			} else if z.Interactive {
 				z.Username = strings.ToLower(utl.Str(eVars["MAZ_USERNAME"]))
 				if z.ClientId != "" || z.ClientSecret != "" {
 					fmt.Println("Warning: ", utl.Yel(""))
@@ -172,87 +456,211 @@ func SetupCredentials(z *Bundle) Bundle {
 			} else {
 				z.ClientId = utl.Str(eVars["MAZ_CLIENT_ID"])
 				if !utl.ValidUuid(z.ClientId) {
-					utl.Die("[MAZ_CLIENT_ID] client_id '%s' is not a valid UUID\n", z.ClientId)
+					return *z, fmt.Errorf("[MAZ_CLIENT_ID] client_id '%s' is not a valid UUID", z.ClientId)
 				}
+				z.ClientCertPath = utl.Str(eVars["MAZ_CLIENT_CERT_PATH"])
+				z.ClientCertPassword = utl.Str(eVars["MAZ_CLIENT_CERT_PASSWORD"])
+				z.FederatedTokenFile = utl.Str(eVars["MAZ_FEDERATED_TOKEN_FILE"])
 				z.ClientSecret = utl.Str(eVars["MAZ_CLIENT_SECRET"])
-				if z.ClientSecret == "" {
-					utl.Die("[MAZ_CLIENT_SECRET] client_secret is blank\n")
+				if z.ClientCertPath == "" && z.FederatedTokenFile == "" && z.ClientSecret == "" {
+					return *z, fmt.Errorf("[MAZ_CLIENT_SECRET] client_secret is blank, and no MAZ_CLIENT_CERT_PATH or MAZ_FEDERATED_TOKEN_FILE either")
+				}
+				var err error
+				if z.ClientSecret, err = resolveSecret(z.SecretStore, z.ClientSecret); err != nil {
+					return *z, fmt.Errorf("[MAZ_CLIENT_SECRET] %w", err)
+				}
+				if z.ClientCertPassword, err = resolveSecret(z.SecretStore, z.ClientCertPassword); err != nil {
+					return *z, fmt.Errorf("[MAZ_CLIENT_CERT_PASSWORD] %w", err)
 				}
 			}
-		} // ... else it gets the Tenant Id from the valid tokens
-	} else {
-		// Getting from credentials file
-		filePath := filepath.Join(z.ConfDir, z.CredsFile) // credentials.yaml
-		if utl.FileNotExist(filePath) && utl.FileSize(filePath) < 1 {
-			utl.Die("Missing credentials file: " + filePath + "\n" +
-				"Re-run program to set up the appropriate login credentials.\n")
 		}
-		credsRaw, err := utl.LoadFileYaml(filePath)
+	} else {
+		// Getting from the selected profile in the credentials file
+		creds, profile, err := loadProfile(*z)
 		if err != nil {
-			utl.Die("[%s] %s\n", filePath, err)
+			return *z, err
 		}
-		creds := credsRaw.(map[string]interface{})
+		z.Profile = profile
+		filePath := filepath.Join(z.ConfDir, z.CredsFile) + ":" + profile // For error messages
 		z.TenantId = utl.Str(creds["tenant_id"])
 		if !utl.ValidUuid(z.TenantId) {
-			utl.Die("[%s] tenant_id '%s' is not a valid UUID\n", filePath, z.TenantId)
+			return *z, fmt.Errorf("[%s] tenant_id '%s' is not a valid UUID", filePath, z.TenantId)
 		}
-		z.Interactive, _ = strconv.ParseBool(utl.Str(creds["interactive"]))
-		if z.Interactive {
-			z.Username = strings.ToLower(utl.Str(creds["username"]))
-		} else {
-			z.ClientId = utl.Str(creds["client_id"])
-			if !utl.ValidUuid(z.ClientId) {
-				utl.Die("[%s] client_id '%s' is not a valid UUID\n", filePath, z.ClientId)
-			}
-			z.ClientSecret = utl.Str(creds["client_secret"])
-			if z.ClientSecret == "" {
-				utl.Die("[%s] client_secret is blank\n", filePath)
+		cloudName, cloudSource = utl.Str(creds["cloud"]), filePath
+		if z.CacheSelect == nil {
+			if z.CacheSelect, err = parseCacheSelect(creds["cache_select"]); err != nil {
+				return *z, fmt.Errorf("[%s] cache_select %w", filePath, err)
 			}
 		}
+		if err := setupProfileLogin(z, creds, filePath); err != nil {
+			return *z, err
+		}
+	}
+
+	// MAZ_CLOUD is read separately, so that setting it alone doesn't switch to environment variable login
+	if v := os.Getenv("MAZ_CLOUD"); v != "" {
+		cloudName, cloudSource = v, "MAZ_CLOUD"
+	}
+	if cloudName != "" {
+		cloud, err := CloudByName(cloudName)
+		if err != nil {
+			return *z, fmt.Errorf("[%s] %w", cloudSource, err)
+		}
+		z.Cloud = cloud
+	}
+	return *z, nil
+}
+
+// Sets up the login method of the bundle from given credentials file profile, which filePath names
+// in error messages
+func setupProfileLogin(z *Bundle, creds map[string]interface{}, filePath string) (err error) {
+	z.Interactive, _ = strconv.ParseBool(utl.Str(creds["interactive"]))
+	switch mode := strings.ToLower(utl.Str(creds["interactive_mode"])); mode {
+	case "", "browser":
+	case "devicecode":
+		z.Interactive = true // Device code is just another way of logging in interactively
+		z.DeviceCode = true
+	default:
+		return fmt.Errorf("[%s] interactive_mode '%s' must be 'browser' or 'devicecode'", filePath, mode)
+	}
+	z.ManagedIdentity, _ = strconv.ParseBool(utl.Str(creds["managed_identity"]))
+	if z.ManagedIdentity {
+		z.Interactive = false
+		z.ManagedIdentityUrl = utl.Str(creds["managed_identity_url"])
+		z.ClientId = utl.Str(creds["client_id"]) // Optional, for a user-assigned identity
+		if z.ClientId != "" && !utl.ValidUuid(z.ClientId) {
+			return fmt.Errorf("[%s] client_id '%s' is not a valid UUID", filePath, z.ClientId)
+		}
+	} else if z.Interactive {
+		z.Username = strings.ToLower(utl.Str(creds["username"]))
+	} else {
+		z.ClientId = utl.Str(creds["client_id"])
+		if !utl.ValidUuid(z.ClientId) {
+			return fmt.Errorf("[%s] client_id '%s' is not a valid UUID", filePath, z.ClientId)
+		}
+		z.ClientCertPath = utl.Str(creds["client_cert_path"])
+		z.ClientCertPassword = utl.Str(creds["client_cert_password"])
+		z.FederatedTokenFile = utl.Str(creds["federated_token_file"])
+		z.ClientSecret = utl.Str(creds["client_secret"])
+		if z.ClientCertPath == "" && z.FederatedTokenFile == "" && z.ClientSecret == "" {
+			return fmt.Errorf("[%s] client_secret is blank, and no client_cert_path or federated_token_file either", filePath)
+		}
+		if z.ClientSecret, err = resolveSecret(z.SecretStore, z.ClientSecret); err != nil {
+			return fmt.Errorf("[%s] client_secret %w", filePath, err)
+		}
+		if z.ClientCertPassword, err = resolveSecret(z.SecretStore, z.ClientCertPassword); err != nil {
+			return fmt.Errorf("[%s] client_cert_password %w", filePath, err)
+		}
 	}
-	return *z
+	return nil
 }
 
-// Initializes the necessary global variables, acquires all API tokens, and sets them up for use.
-func SetupApiTokens(z *Bundle) Bundle {
-	*z = SetupCredentials(z) // Sets up tenant ID, client ID, authentication method, etc
+// Returns true if any of the environment variables selecting a login method are set
+func envLoginSet() bool {
+	for _, k := range []string{"MAZ_USERNAME", "MAZ_INTERACTIVE", "MAZ_DEVICE_CODE", "MAZ_CLIENT_ID", "MAZ_CLIENT_SECRET",
+		"MAZ_CLIENT_CERT_PATH", "MAZ_FEDERATED_TOKEN_FILE", "MAZ_MANAGED_IDENTITY"} {
+		if eVars[k] != "" {
+			return true
+		}
+	}
+	return false
+}
 
-	// Currently supporting calls for 2 different APIs (Azure Resource Management (ARM) and MS Graph), so each needs its own
-	// separate token. The Microsoft identity platform does not allow using same token for multiple resources at once.
-	// See https://learn.microsoft.com/en-us/azure/active-directory/develop/msal-net-user-gets-consent-for-multiple-resources
+// Initializes the necessary global variables, and sets up the TokenProvider that acquires the API
+// tokens on the first call to each API. Use PrefetchApiTokens to get them right away instead.
+func SetupApiTokens(z *Bundle) (Bundle, error) {
+	return SetupApiTokensCtx(context.Background(), z)
+}
 
-	if !TokenValid(z.AzToken) && !TokenValid(z.MgToken) {
-		// If API tokens have *both* not been supplied via environment variables, let's go ahead and get them
-		// via the other supported methods.
+// Context-aware version of SetupApiTokens. As no tokens are acquired here, ctx is currently unused,
+// and is only kept for API compatibility; use PrefetchApiTokens to acquire them under a context.
+func SetupApiTokensCtx(ctx context.Context, z *Bundle) (Bundle, error) {
+	var err error
+	*z, err = SetupCredentials(z) // Sets up tenant ID, client ID, authentication method, etc
+	if err != nil {
+		return *z, err
+	}
 
-		z.AuthorityUrl = ConstAuthUrl + z.TenantId
+	// Each API (Azure Resource Management (ARM), MS Graph, etc) needs its own separate token. The Microsoft identity
+	// platform does not allow using same token for multiple resources at once.
+	// See https://learn.microsoft.com/en-us/azure/active-directory/develop/msal-net-user-gets-consent-for-multiple-resources
+	// Tokens are only acquired on the first ApiCall to each API, so an identity consented to only one of them works,
+	// and an interactive login only prompts once. Any tokens supplied via MAZ_MG_TOKEN or MAZ_AZ_TOKEN are used as is.
+	z.AuthorityUrl = z.AuthUrl() + z.TenantId
 
-		// Get a token for ARM access
-		azScope := []string{ConstAzUrl + "/.default"}
-		// Appending '/.default' allows using all static and consented permissions of the identity in use
-		// See https://learn.microsoft.com/en-us/azure/active-directory/develop/msal-v1-app-scopes
-		if z.Interactive {
-			// Get token interactively
-			z.AzToken, _ = GetTokenInteractively(azScope, z.ConfDir, z.TokenFile, z.AuthorityUrl, z.Username)
-		} else {
-			// Get token with clientId + Secret
-			z.AzToken, _ = GetTokenByCredentials(azScope, z.ConfDir, z.TokenFile, z.AuthorityUrl, z.ClientId, z.ClientSecret)
-		}
+	// Tokens expire after about an hour, so the provider is what keeps long running programs going,
+	// with ApiCall asking it for a current token on every request
+	if z.TokenProvider == nil {
+		z.TokenProvider = NewTokenProvider(*z)
+	}
 
-		// Get a token for MS Graph access
-		mgScope := []string{ConstMgUrl + "/.default"}
-		if z.Interactive {
-			z.MgToken, _ = GetTokenInteractively(mgScope, z.ConfDir, z.TokenFile, z.AuthorityUrl, z.Username)
-		} else {
-			z.MgToken, _ = GetTokenByCredentials(mgScope, z.ConfDir, z.TokenFile, z.AuthorityUrl, z.ClientId, z.ClientSecret)
-		}
+	// Setup the base API headers; content type, plus any supplied token
+	z.AzHeaders = map[string]string{"Content-Type": "application/json"}
+	z.MgHeaders = map[string]string{"Content-Type": "application/json"}
+	if TokenValid(z.AzToken) {
+		z.AzHeaders["Authorization"] = "Bearer " + z.AzToken
+	}
+	if TokenValid(z.MgToken) {
+		z.MgHeaders["Authorization"] = "Bearer " + z.MgToken
+	}
+
+	return *z, nil
+}
 
-		// Support for other APIs can be added here in the future ...
+// Acquires the tokens for both MS Graph and ARM right away, instead of on the first call to each
+// API, to fail fast on login problems. Call it after SetupApiTokens.
+func PrefetchApiTokens(ctx context.Context, z Bundle) error {
+	if z.TokenProvider == nil {
+		return fmt.Errorf("no token provider, call SetupApiTokens first")
+	}
+	// Appending '/.default' allows using all static and consented permissions of the identity in use
+	// See https://learn.microsoft.com/en-us/azure/active-directory/develop/msal-v1-app-scopes
+	if _, err := z.TokenProvider.GetToken(ctx, []string{z.azScope()}, false); err != nil {
+		return fmt.Errorf("getting ARM token: %w", err)
 	}
+	if _, err := z.TokenProvider.GetToken(ctx, []string{z.mgScope()}, false); err != nil {
+		return fmt.Errorf("getting MS Graph token: %w", err)
+	}
+	return nil
+}
 
-	// Setup the base API headers; token + content type
-	z.AzHeaders = map[string]string{"Authorization": "Bearer " + z.AzToken, "Content-Type": "application/json"}
-	z.MgHeaders = map[string]string{"Authorization": "Bearer " + z.MgToken, "Content-Type": "application/json"}
+// Returns true if the bundle has a login method set up, to acquire tokens with
+func (z Bundle) canLogin() bool {
+	return z.ManagedIdentity || z.Interactive || z.ClientId != ""
+}
 
-	return *z
+// Acquires a token for given scopes, using whichever login method the bundle is configured for. If
+// forceRefresh is true, the MSAL token cache is bypassed, so that a new token is always acquired.
+func acquireToken(ctx context.Context, z *Bundle, scopes []string, forceRefresh bool) (string, error) {
+	switch {
+	case z.ManagedIdentity:
+		// Get token from the host's managed identity
+		return getTokenByManagedIdentity(ctx, *z, scopes, z.ManagedIdentityUrl, z.ClientId)
+	}
+	cacheAccessor := NewTokenCache(filepath.Join(z.ConfDir, z.TokenFile), z.SecretStore)
+	switch {
+	case z.Interactive && z.DeviceCode:
+		// Get token via device code, for when there's no local browser
+		return getTokenByDeviceCode(ctx, scopes, cacheAccessor, z.AuthorityUrl, z.Username, forceRefresh)
+	case z.Interactive:
+		// Get token interactively
+		return getTokenInteractively(ctx, scopes, cacheAccessor, z.AuthorityUrl, z.Username, forceRefresh)
+	case z.ClientCertPath != "":
+		// Get token with clientId + certificate
+		cred, err := certificateCredential(z.ClientCertPath, z.ClientCertPassword)
+		if err != nil {
+			return "", err
+		}
+		return getConfidentialToken(ctx, scopes, cacheAccessor, z.AuthorityUrl, z.ClientId, forceRefresh, cred, confidential.WithX5C())
+	case z.FederatedTokenFile != "":
+		// Get token with clientId + federated token
+		return getConfidentialToken(ctx, scopes, cacheAccessor, z.AuthorityUrl, z.ClientId, forceRefresh, federatedTokenCredential(z.FederatedTokenFile))
+	default:
+		// Get token with clientId + Secret
+		cred, err := confidential.NewCredFromSecret(z.ClientSecret)
+		if err != nil {
+			return "", fmt.Errorf("creating credential from client_secret: %w", err)
+		}
+		return getConfidentialToken(ctx, scopes, cacheAccessor, z.AuthorityUrl, z.ClientId, forceRefresh, cred)
+	}
 }
@@ -1,17 +1,19 @@
 package maz
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"path/filepath"
+	neturl "net/url"
 	"time"
 
 	"github.com/queone/utl"
 )
 
 // Prints application object in YAML-like format
-func PrintApp(x map[string]interface{}, z Bundle) {
+func PrintApp(x map[string]interface{}, z Bundle) error {
 	if x == nil {
-		return
+		return nil
 	}
 	id := utl.Str(x["id"])
 
@@ -26,17 +28,21 @@ func PrintApp(x map[string]interface{}, z Bundle) {
 
 	// Print certificates keys
 	if x["keyCredentials"] != nil {
-		PrintCertificateList(x["keyCredentials"].([]interface{}))
+		if err := PrintCertificateList(x["keyCredentials"].([]interface{})); err != nil {
+			return err
+		}
 	}
 
 	// Print secret list & expiry details, not actual secretText (which cannot be retrieve anyway)
 	if x["passwordCredentials"] != nil {
-		PrintSecretList(x["passwordCredentials"].([]interface{}))
+		if err := PrintSecretList(x["passwordCredentials"].([]interface{})); err != nil {
+			return err
+		}
 	}
 
 	// Print federated IDs
-	//url := ConstMgUrl + "/v1.0/applications/" + id + "/federatedIdentityCredentials"
-	url := ConstMgUrl + "/beta/applications/" + id + "/federatedIdentityCredentials"
+	//url := z.MgUrl() + "/v1.0/applications/" + id + "/federatedIdentityCredentials"
+	url := z.MgUrl() + "/beta/applications/" + id + "/federatedIdentityCredentials"
 	r, statusCode, _ := ApiGet(url, z, nil)
 	if statusCode == 200 && r != nil && r["value"] != nil {
 		fedCreds := r["value"].([]interface{})
@@ -54,7 +60,7 @@ func PrintApp(x map[string]interface{}, z Bundle) {
 	}
 
 	// Print owners
-	url = ConstMgUrl + "/beta/applications/" + id + "/owners"
+	url = z.MgUrl() + "/beta/applications/" + id + "/owners"
 	r, statusCode, _ = ApiGet(url, z, nil)
 	if statusCode == 200 && r != nil && r["value"] != nil {
 		PrintOwners(r["value"].([]interface{}))
@@ -67,7 +73,21 @@ func PrintApp(x map[string]interface{}, z Bundle) {
 	if x["requiredResourceAccess"] != nil && len(x["requiredResourceAccess"].([]interface{})) > 0 {
 		fmt.Printf(utl.Blu("requiredResourceAccess") + ":\n")
 		APIs := x["requiredResourceAccess"].([]interface{}) // Assert to JSON array
+
+		// Get the SP objects of all these APIs in as few batched calls as possible
+		var requests []BatchRequest
 		for _, a := range APIs {
+			resAppId := utl.Str(a.(map[string]interface{})["resourceAppId"])
+			query := neturl.Values{"$filter": {"appId eq '" + resAppId + "'"}} // Sub-request URLs must be encoded
+			requests = append(requests, BatchRequest{Url: "/servicePrincipals?" + query.Encode()})
+		}
+		responses, err := MgBatch(requests, "beta", z)
+		if err != nil {
+			fmt.Println(utl.Red(err.Error()))
+			responses = make([]BatchResponse, len(requests))
+		}
+
+		for k, a := range APIs {
 			api := a.(map[string]interface{})
 			// Getting this API's name and permission value such as Directory.Read.All is a 2-step process:
 			// 1) Get all the roles for given API and put their id/value pairs in a map, then
@@ -80,11 +100,11 @@ func PrintApp(x map[string]interface{}, z Bundle) {
 			}
 			resAppId := utl.Str(api["resourceAppId"])
 
-			// Get this API's SP object with all relevant attributes
-			params := map[string]string{"$filter": "appId eq '" + resAppId + "'"}
-			url := ConstMgUrl + "/beta/servicePrincipals"
-			r, _, _ := ApiGet(url, z, params)
-			ApiErrorCheck("GET", url, utl.Trace(), r) // TODO: Get rid of this by using StatuCode checks, etc
+			// This API's SP object with all relevant attributes
+			r := responses[k].Body
+			if err := responses[k].Err; err != nil {
+				fmt.Println(utl.Red(err.Error()))
+			}
 			// Result is a list because this could be a multi-tenant app, having multiple SPs
 			if r["value"] == nil {
 				fmt.Printf("  %-50s %s\n", resAppId, "Unable to get Resource App object. Skipping this API.")
@@ -94,15 +114,20 @@ func PrintApp(x map[string]interface{}, z Bundle) {
 
 			SPs := r["value"].([]interface{})
 			if len(SPs) > 1 {
-				utl.Die("  %-50s %s\n", resAppId, "Error. Multiple SPs for this AppId. Aborting.")
+				return fmt.Errorf("%s: multiple SPs for this AppId", resAppId)
+			}
+			if len(SPs) < 1 {
+				fmt.Printf("  %-50s %s\n", resAppId, "No SP for this API in the tenant. Skipping this API.")
+				continue
 			}
 			sp := SPs[0].(map[string]interface{}) // Currently only handling the expected single-tenant entry
 
 			// 1. Put all API role id:name pairs into roleMap list
 			roleMap := make(map[string]string)
 			if sp["appRoles"] != nil { // These are for Application types
-				for _, i := range sp["appRoles"].([]interface{}) { // Iterate through all roles
-					role := i.(map[string]interface{})
+				appRoles, _ := sp["appRoles"].([]interface{})
+				for _, i := range appRoles { // Iterate through all roles
+					role, _ := i.(map[string]interface{})
 					//utl.PrintJsonColor(role) // DEBUG
 					if role["id"] != nil && role["value"] != nil {
 						roleMap[utl.Str(role["id"])] = utl.Str(role["value"]) // Add entry to map
@@ -145,33 +170,17 @@ func PrintApp(x map[string]interface{}, z Bundle) {
 			}
 		}
 	}
+	return nil
 }
 
-// Creates/adds a secret to the given application
-func AddAppSecret(uuid, displayName, expiry string, z Bundle) {
+// Creates/adds a secret to the given App
+func AddAppSecret(uuid, displayName, expiry string, z Bundle) error {
 	if !utl.ValidUuid(uuid) {
-		utl.Die("Invalid App UUID.\n")
+		return fmt.Errorf("App UUID '%s' is not a valid UUID", uuid)
 	}
-	var endDateTime string
-	if utl.ValidDate(expiry, "2006-01-02") {
-		var err error
-		endDateTime, err = utl.ConvertDateFormat(expiry, "2006-01-02", time.RFC3339Nano)
-		if err != nil {
-			utl.Die("Error converting Expiry date format to RFC3339Nano/ISO8601 format.\n")
-		}
-	} else {
-		// If expiry not a valid date, see if it's a valid integer number
-		days, err := utl.StringToInt64(expiry)
-		if err != nil {
-			utl.Die("Error converting Expiry to valid integer number.\n")
-		}
-		maxDays := utl.GetDaysSinceOrTo("9999-12-31") // Maximum supported date
-		if days > maxDays {
-			days = maxDays
-		}
-		expiryTime := utl.GetDateInDays(utl.Int64ToString(days)) // Set expiryTime to 'days' from now
-		expiry = expiryTime.Format("2006-01-02")                 // Convert it to yyyy-mm-dd format
-		endDateTime = expiryTime.Format(time.RFC3339Nano)        // Convert to RFC3339Nano/ISO8601 format
+	endDateTime, expiry, err := secretEndDateTime(expiry)
+	if err != nil {
+		return err
 	}
 
 	payload := map[string]interface{}{
@@ -180,40 +189,43 @@ func AddAppSecret(uuid, displayName, expiry string, z Bundle) {
 			"endDateTime": endDateTime,
 		},
 	}
-	url := ConstMgUrl + "/v1.0/applications/" + uuid + "/addPassword"
-	r, statusCode, _ := ApiPost(url, z, payload, nil)
-	if statusCode == 200 {
-		fmt.Printf("%s: %s\n", utl.Blu("App_Object_Id"), utl.Gre(uuid))
-		fmt.Printf("%s: %s\n", utl.Blu("New_Secret_Id"), utl.Gre(utl.Str(r["keyId"])))
-		fmt.Printf("%s: %s\n", utl.Blu("New_Secret_Name"), utl.Gre(displayName))
-		fmt.Printf("%s: %s\n", utl.Blu("New_Secret_Expiry"), utl.Gre(expiry))
-		fmt.Printf("%s: %s\n", utl.Blu("New_Secret_Text"), utl.Gre(utl.Str(r["secretText"])))
-	} else {
-		e := r["error"].(map[string]interface{})
-		utl.Die(e["message"].(string) + "\n")
+	url := z.MgUrl() + "/v1.0/applications/" + uuid + "/addPassword"
+	r, _, err := ApiPost(url, z, payload, nil)
+	if err != nil {
+		return err
 	}
+	fmt.Printf("%s: %s\n", utl.Blu("App_Object_Id"), utl.Gre(uuid))
+	fmt.Printf("%s: %s\n", utl.Blu("New_Secret_Id"), utl.Gre(utl.Str(r["keyId"])))
+	fmt.Printf("%s: %s\n", utl.Blu("New_Secret_Name"), utl.Gre(displayName))
+	fmt.Printf("%s: %s\n", utl.Blu("New_Secret_Expiry"), utl.Gre(expiry))
+	fmt.Printf("%s: %s\n", utl.Blu("New_Secret_Text"), utl.Gre(utl.Str(r["secretText"])))
+	return nil
 }
 
-// Removes a secret from the given application
-func RemoveAppSecret(uuid, keyId string, z Bundle) {
+// Removes a secret from the given App, after prompting for confirmation. Declining the prompt
+// returns ErrAborted.
+func RemoveAppSecret(uuid, keyId string, z Bundle) error {
 	if !utl.ValidUuid(uuid) {
-		utl.Die("App UUID is not a valid UUID.\n")
+		return fmt.Errorf("App UUID '%s' is not a valid UUID", uuid)
 	}
 	if !utl.ValidUuid(keyId) {
-		utl.Die("Secret ID is not a valid UUID.\n")
+		return fmt.Errorf("secret ID '%s' is not a valid UUID", keyId)
 	}
 
-	// Get app, display details and secret, and prompt for delete confirmation
-	x := GetAzAppByUuid(uuid, z)
+	// Get App, display details and secret, and prompt for delete confirmation
+	x, err := GetAzAppByUuid(uuid, z)
+	if err != nil {
+		return err
+	}
 	if x == nil || x["id"] == nil {
-		utl.Die("There's no App with this UUID.\n")
+		return fmt.Errorf("App %s: %w", uuid, ErrNotFound)
 	}
-	pwdCreds := x["passwordCredentials"].([]interface{})
-	if pwdCreds == nil || len(pwdCreds) < 1 {
-		utl.Die("App object has no secrets.\n")
+	passwordCredentials, _ := x["passwordCredentials"].([]interface{})
+	if len(passwordCredentials) < 1 {
+		return fmt.Errorf("App %s has no secrets", uuid)
 	}
 	var a map[string]interface{} = nil // Target keyId, Secret ID to be deleted
-	for _, i := range pwdCreds {
+	for _, i := range passwordCredentials {
 		targetKeyId := i.(map[string]interface{})
 		if utl.Str(targetKeyId["keyId"]) == keyId {
 			a = targetKeyId
@@ -221,18 +233,18 @@ func RemoveAppSecret(uuid, keyId string, z Bundle) {
 		}
 	}
 	if a == nil {
-		utl.Die("App object does not have this Secret ID.\n")
+		return fmt.Errorf("App %s secret %s: %w", uuid, keyId, ErrNotFound)
 	}
 	cId := utl.Str(a["keyId"])
 	cName := utl.Str(a["displayName"])
 	cHint := utl.Str(a["hint"]) + "********"
 	cStart, err := utl.ConvertDateFormat(utl.Str(a["startDateTime"]), time.RFC3339Nano, "2006-01-02")
 	if err != nil {
-		utl.Die(utl.Trace() + err.Error() + "\n")
+		return err
 	}
 	cExpiry, err := utl.ConvertDateFormat(utl.Str(a["endDateTime"]), time.RFC3339Nano, "2006-01-02")
 	if err != nil {
-		utl.Die(utl.Trace() + err.Error() + "\n")
+		return err
 	}
 
 	// Prompt
@@ -242,155 +254,99 @@ func RemoveAppSecret(uuid, keyId string, z Bundle) {
 	fmt.Printf("%s:\n", utl.Yel("secret_to_be_deleted"))
 	fmt.Printf("  %-36s  %-30s  %-16s  %-16s  %s\n", utl.Yel(cId), utl.Yel(cName),
 		utl.Yel(cHint), utl.Yel(cStart), utl.Yel(cExpiry))
-	if utl.PromptMsg(utl.Yel("DELETE above? y/n ")) == 'y' {
-		payload := map[string]interface{}{"keyId": keyId}
-		url := ConstMgUrl + "/v1.0/applications/" + uuid + "/removePassword"
-		r, statusCode, _ := ApiPost(url, z, payload, nil)
-		if statusCode == 204 {
-			utl.Die("Successfully deleted secret.\n")
-		} else {
-			e := r["error"].(map[string]interface{})
-			utl.Die(e["message"].(string) + "\n")
-		}
-	} else {
-		utl.Die("Aborted.\n")
+	if utl.PromptMsg(utl.Yel("DELETE above? y/n ")) != 'y' {
+		return ErrAborted
 	}
+	payload := map[string]interface{}{"keyId": keyId}
+	url := z.MgUrl() + "/v1.0/applications/" + uuid + "/removePassword"
+	if _, _, err := ApiPost(url, z, payload, nil); err != nil {
+		return err
+	}
+	fmt.Println("Successfully deleted secret.")
+	return nil
 }
 
 // Retrieves count of all applications in local cache file
 func AppsCountLocal(z Bundle) int64 {
-	var cachedList []interface{} = nil
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_applications."+ConstCacheFileExtension)
-	if utl.FileUsable(cacheFile) {
-		rawList, _ := utl.LoadFileJsonGzip(cacheFile)
-		if rawList != nil {
-			cachedList = rawList.([]interface{})
-			return int64(len(cachedList))
-		}
-	}
-	return 0
+	return int64(len(getCachedObjects(z, "applications")))
 }
 
 // Retrieves count of all applications in Azure tenant
-func AppsCountAzure(z Bundle) int64 {
-	z.MgHeaders["ConsistencyLevel"] = "eventual"
-	//url := ConstMgUrl + "/v1.0/applications/$count"
-	url := ConstMgUrl + "/beta/applications/$count"
-	r, _, _ := ApiGet(url, z, nil)
-	ApiErrorCheck("GET", url, utl.Trace(), r)
-	if r["value"] != nil {
-		return r["value"].(int64) // Expected result is a single int64 value for the count
+func AppsCountAzure(z Bundle) (int64, error) {
+	return AppsCountAzureCtx(context.Background(), z)
+}
+
+// Context-aware version of AppsCountAzure
+func AppsCountAzureCtx(ctx context.Context, z Bundle) (int64, error) {
+	z = z.withMgHeader("ConsistencyLevel", "eventual")
+	//url := z.MgUrl() + "/v1.0/applications/$count"
+	url := z.MgUrl() + "/beta/applications/$count"
+	r, _, err := ApiGetCtx(ctx, url, z, nil)
+	if err != nil {
+		return 0, err
 	}
-	return 0
+	return countResult(url, r)
 }
 
 // Returns an id:name map of all applications
 func GetIdMapApps(z Bundle) (nameMap map[string]string) {
-	nameMap = make(map[string]string)
-	apps := GetMatchingApps("", false, z) // false = don't force a call to Azure
-	// By not forcing an Azure call we're opting for cache speed over id:name map accuracy
-	for _, i := range apps {
-		x := i.(map[string]interface{})
-		if x["id"] != nil && x["displayName"] != nil {
-			nameMap[utl.Str(x["id"])] = utl.Str(x["displayName"])
-		}
-	}
-	return nameMap
+	return GetIdMapDeltaObjects("applications", z)
 }
 
 // Gets all applications matching on 'filter'. Return entire list if filter is empty ""
-func GetMatchingApps(filter string, force bool, z Bundle) (list []interface{}) {
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_applications."+ConstCacheFileExtension)
-	cacheFileAge := utl.FileAge(cacheFile)
-	if utl.InternetIsAvailable() && (force || cacheFileAge == 0 || cacheFileAge > ConstMgCacheFileAgePeriod) {
-		// If Internet is available AND (force was requested OR cacheFileAge is zero (meaning does not exist)
-		// OR it is older than ConstMgCacheFileAgePeriod) then query Azure directly to get all objects
-		// and show progress while doing so (true = verbose below)
-		list = GetAzApps(z, true)
-	} else {
-		// Use local cache for all other conditions
-		list = GetCachedObjects(cacheFile)
-	}
+func GetMatchingApps(filter string, force bool, z Bundle) (list []interface{}, err error) {
+	return GetMatchingAppsCtx(context.Background(), filter, force, z)
+}
 
-	if filter == "" {
-		return list
-	}
-	var matchingList []interface{} = nil
-	var ids []string // Keep track of each unique objects to eliminate repeats
-	for _, i := range list {
-		x := i.(map[string]interface{})
-		id := utl.Str(x["id"])
-		// Match against relevant strings within application JSON object (Note: Not all attributes are maintained)
-		if !utl.ItemInList(id, ids) && utl.StringInJson(x, filter) {
-			matchingList = append(matchingList, x)
-			ids = append(ids, id)
-		}
-	}
-	return matchingList
+// Context-aware version of GetMatchingApps
+func GetMatchingAppsCtx(ctx context.Context, filter string, force bool, z Bundle) (list []interface{}, err error) {
+	return GetMatchingDeltaObjectsCtx(ctx, "applications", filter, force, z)
 }
 
 // Gets all applications from Azure and sync to local cache. Shows progress if verbose = true
-func GetAzApps(z Bundle, verbose bool) (list []interface{}) {
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_applications."+ConstCacheFileExtension)
-	deltaLinkFile := filepath.Join(z.ConfDir, z.TenantId+"_applications_deltaLink."+ConstCacheFileExtension)
-
-	baseUrl := ConstMgUrl + "/beta/applications"
-	// Get delta updates only if/when below attributes in $select are modified
-	selection := "?$select=displayName,appId,requiredResourceAccess,passwordCredentials"
-	url := baseUrl + "/delta" + selection + "&$top=999"
-	list = GetCachedObjects(cacheFile) // Get current cache
-	if len(list) < 1 {
-		// These are only needed on initial cache run
-		z.MgHeaders["Prefer"] = "return=minimal" // Tells API to focus only on $select attributes deltas
-		z.MgHeaders["deltaToken"] = "latest"
-		// https://graph.microsoft.com/v1.0/users/delta?$deltatoken=latest
-	}
-
-	// Prep to do a delta query if it is possible
-	var deltaLinkMap map[string]interface{} = nil
-	if utl.FileUsable(deltaLinkFile) && utl.FileAge(deltaLinkFile) < (3660*24*27) && len(list) > 0 {
-		// Note that deltaLink file age has to be within 30 days (we do 27)
-		tmpVal, _ := utl.LoadFileJsonGzip(deltaLinkFile)
-		deltaLinkMap = tmpVal.(map[string]interface{})
-		url = utl.Str(utl.Str(deltaLinkMap["@odata.deltaLink"]))
-		// Base URL is now the cached Delta Link URL
-	}
-
-	// Now go get Azure objects using the updated URL (either a full or a delta query)
-	var deltaSet []interface{} = nil
-	deltaSet, deltaLinkMap = GetAzObjects(url, z, verbose) // Run generic deltaSet retriever function
+func GetAzApps(z Bundle, verbose bool) (list []interface{}, err error) {
+	return GetAzAppsCtx(context.Background(), z, verbose)
+}
 
-	// Save new deltaLink for future call, and merge newly acquired delta set with existing list
-	utl.SaveFileJsonGzip(deltaLinkMap, deltaLinkFile)
-	list = NormalizeCache(list, deltaSet) // Run our MERGE LOGIC with new delta set
-	utl.SaveFileJsonGzip(list, cacheFile) // Update the local cache
-	return list
+// Context-aware version of GetAzApps
+func GetAzAppsCtx(ctx context.Context, z Bundle, verbose bool) (list []interface{}, err error) {
+	return GetAzDeltaObjectsCtx(ctx, "applications", z, verbose)
 }
 
 // Gets application by its Object UUID or by its appId, with all attributes
-func GetAzAppByUuid(uuid string, z Bundle) map[string]interface{} {
-	baseUrl := ConstMgUrl + "/beta/applications"
+func GetAzAppByUuid(uuid string, z Bundle) (map[string]interface{}, error) {
+	return GetAzAppByUuidCtx(context.Background(), uuid, z)
+}
+
+// Context-aware version of GetAzAppByUuid
+func GetAzAppByUuidCtx(ctx context.Context, uuid string, z Bundle) (map[string]interface{}, error) {
+	baseUrl := z.MgUrl() + "/beta/applications"
 	selection := "?$select=*"
 	url := baseUrl + "/" + uuid + selection // First search is for direct Object Id
-	r, _, _ := ApiGet(url, z, nil)
-	if r != nil && r["error"] != nil {
+	r, _, err := ApiGetCtx(ctx, url, z, nil)
+	var apiErr *ApiError
+	if errors.As(err, &apiErr) {
 		// Second search is for this app's application Client Id
 		url = baseUrl + selection
 		params := map[string]string{"$filter": "appId eq '" + uuid + "'"}
-		r, _, _ := ApiGet(url, z, params)
+		r, _, err := ApiGetCtx(ctx, url, z, params)
+		if err != nil {
+			return nil, err
+		}
 		if r != nil && r["value"] != nil {
 			list := r["value"].([]interface{})
 			count := len(list)
 			if count == 1 {
-				return list[0].(map[string]interface{}) // Return single value found
+				return list[0].(map[string]interface{}), nil // Return single value found
 			} else if count > 1 {
 				// Not sure this would ever happen, but just in case
-				fmt.Printf("Found %d entries with this appId\n", count)
-				return nil
-			} else {
-				return nil
+				return nil, fmt.Errorf("found %d entries with appId %s", count, uuid)
 			}
 		}
+		return nil, apiErr // Neither search found anything, so return the original error
+	}
+	if err != nil {
+		return nil, err
 	}
-	return r
+	return r, nil
 }
@@ -0,0 +1,296 @@
+package maz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/queone/utl"
+)
+
+// DeltaType describes an MS Graph object type that supports delta queries, so its objects can be
+// kept in the local cache and refreshed incrementally. The users, groups, servicePrincipals and
+// applications types are built in. Others can be added, or the built-in ones overridden, through
+// Bundle.DeltaTypes, after which the GetAzDeltaObjects family of functions work with them as well.
+// See https://learn.microsoft.com/en-us/graph/delta-query-overview
+type DeltaType struct {
+	Name     string   // Cache object type, e.g. "users"
+	Endpoint string   // Path under the MS Graph URL, e.g. "/beta/users"
+	Select   []string // Attributes to $select, which are the only ones cached, along with Bundle.CacheSelect ones
+	TTL      int64    // Cache age in seconds after which it is refreshed, ConstMgCacheFileAgePeriod if zero
+}
+
+// Maximum age in seconds of a deltaLink before a full sync is done instead. MS Graph keeps them for
+// up to 30 days, but we stay on the safe side.
+const deltaLinkMaxAge = 3600 * 24 * 27
+
+// The delta types built into every bundle
+var builtinDeltaTypes = []DeltaType{
+	{Name: "users", Endpoint: "/beta/users",
+		Select: []string{"displayName", "userPrincipalName", "onPremisesSamAccountName"}},
+	{Name: "groups", Endpoint: "/beta/groups",
+		Select: []string{"displayName", "description", "isAssignableToRole"}},
+	{Name: "servicePrincipals", Endpoint: "/beta/servicePrincipals",
+		Select: []string{"displayName", "appId", "accountEnabled", "appOwnerOrganizationId", "passwordCredentials"}},
+	{Name: "applications", Endpoint: "/beta/applications",
+		Select: []string{"displayName", "appId", "requiredResourceAccess", "passwordCredentials"}},
+}
+
+// Returns the delta type with given name, looking in z.DeltaTypes first, so they can override the
+// built-in ones
+func (z Bundle) DeltaType(name string) (DeltaType, error) {
+	for _, t := range append(append([]DeltaType{}, z.DeltaTypes...), builtinDeltaTypes...) {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return DeltaType{}, fmt.Errorf("unknown delta type '%s'", name)
+}
+
+// Returns the cache age in seconds after which objects of this type are refreshed
+func (t DeltaType) ttl() int64 {
+	if t.TTL > 0 {
+		return t.TTL
+	}
+	return ConstMgCacheFileAgePeriod
+}
+
+// Returns the attributes to $select for this type, its own ones plus any extra ones configured for
+// it in z.CacheSelect, as a normalized list, so that their order doesn't matter
+func (t DeltaType) selection(z Bundle) string {
+	return normalizeSelection(append(append([]string{}, t.Select...), z.CacheSelect[t.Name]...))
+}
+
+// Returns the selection the cache of this type was last synced with, as recorded along with its
+// deltaLink. Caches that predate its recording were synced with the type's own attributes.
+func (t DeltaType) cachedSelection(z Bundle) string {
+	if _, selection, _, err := z.cacheStore().DeltaLink(z.TenantId, t.Name); err == nil && selection != "" {
+		return selection
+	}
+	return normalizeSelection(t.Select)
+}
+
+// Returns true if the cache of this type was synced with other attributes than now selected
+func (t DeltaType) selectionChanged(z Bundle) bool {
+	return t.selection(z) != t.cachedSelection(z)
+}
+
+// Returns given attributes as a sorted comma-separated list, trimmed and without repeats
+func normalizeSelection(attrs []string) string {
+	var list []string = nil
+	seen := make(map[string]bool)
+	for _, a := range attrs {
+		a = strings.TrimSpace(a)
+		if a != "" && !seen[strings.ToLower(a)] {
+			list = append(list, a)
+			seen[strings.ToLower(a)] = true
+		}
+	}
+	slices.SortFunc(list, func(a, b string) int { return strings.Compare(strings.ToLower(a), strings.ToLower(b)) })
+	return strings.Join(list, ",")
+}
+
+// Returns the URL of a full delta query for this type
+func (t DeltaType) url(z Bundle) string {
+	return z.MgUrl() + t.Endpoint + "/delta?$select=" + t.selection(z) + "&$top=999"
+}
+
+// Gets all objects of given delta type from Azure and syncs them to the local cache, with a delta
+// query if there's a recent enough deltaLink, or a full one otherwise. A change to the selected
+// attributes also calls for a full one, since delta queries only return changed objects. Shows
+// progress if verbose.
+func GetAzDeltaObjects(name string, z Bundle, verbose bool) (list []interface{}, err error) {
+	return GetAzDeltaObjectsCtx(context.Background(), name, z, verbose)
+}
+
+// Context-aware version of GetAzDeltaObjects
+func GetAzDeltaObjectsCtx(ctx context.Context, name string, z Bundle, verbose bool) (list []interface{}, err error) {
+	t, err := z.DeltaType(name)
+	if err != nil {
+		return nil, err
+	}
+	store := z.cacheStore()
+	list, _ = store.Load(z.TenantId, t.Name) // Get current cache
+	selection, cachedSelection := t.selection(z), t.cachedSelection(z)
+	if len(list) > 0 && selection != cachedSelection && verbose {
+		fmt.Println(utl.Yel("Cached attributes of " + t.Name + " changed, doing a full sync"))
+	}
+	deltaLink, _, deltaLinkAge, _ := store.DeltaLink(z.TenantId, t.Name)
+	if deltaLink != "" && deltaLinkAge < deltaLinkMaxAge && len(list) > 0 && selection == cachedSelection {
+		deltaSet, nextLink, err := getAzDeltaSet(ctx, deltaLink, z, verbose, false)
+		if err == nil {
+			// Merge newly acquired delta set with existing list, and save new deltaLink for future call
+			list = NormalizeCache(list, deltaSet)
+			if err := saveDeltaResults(z, t.Name, list, deltaSet, nextLink, selection); err != nil {
+				return nil, err
+			}
+			return list, nil
+		}
+		if !isDeltaResyncError(err) {
+			return nil, err
+		}
+		if verbose {
+			fmt.Println(utl.Yel("Delta token expired, doing a full sync of " + t.Name))
+		}
+	}
+
+	// No usable deltaLink, so get all objects and replace whatever is cached
+	deltaSet, nextLink, err := getAzDeltaSet(ctx, t.url(z), z, verbose, true)
+	if err != nil {
+		return nil, err
+	}
+	list = NormalizeCache(nil, deltaSet) // Drops any removed objects, and folds repeated ones
+	if err := store.Save(z.TenantId, t.Name, list); err != nil {
+		return nil, err
+	}
+	if err := store.SaveDeltaLink(z.TenantId, t.Name, nextLink, selection); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Runs given delta query, and returns the resulting delta set along with the deltaLink for the next
+// one. The header a full sync needs is set on a copy of the MS Graph headers, so the caller's
+// bundle is left alone.
+func getAzDeltaSet(ctx context.Context, url string, z Bundle, verbose, full bool) ([]interface{}, string, error) {
+	if full {
+		z = z.withMgHeader("Prefer", "return=minimal") // Tells API to focus only on $select attributes deltas
+	}
+	deltaSet, deltaLinkMap, err := GetAzObjectsCtx(ctx, url, z, verbose) // Run generic deltaSet retriever function
+	if err != nil {
+		return nil, "", err
+	}
+	return deltaSet, utl.Str(deltaLinkMap["@odata.deltaLink"]), nil
+}
+
+// Returns true if given error means the deltaLink is no longer valid, and a full sync is needed
+func isDeltaResyncError(err error) bool {
+	var e *ApiError
+	if !errors.As(err, &e) {
+		return false
+	}
+	switch strings.ToLower(e.Code) {
+	case "syncstatenotfound", "syncstateinvalid", "resyncrequired":
+		return true
+	}
+	return e.StatusCode == http.StatusGone
+}
+
+// Saves the outcome of a delta query, either the merged list or only the changes if the store can
+// apply them itself, and then the new deltaLink along with the selection it was synced with. The
+// cache goes first, so that an interrupted run never leaves the deltaLink ahead of it.
+func saveDeltaResults(z Bundle, objectType string, list, deltaSet []interface{}, deltaLink, selection string) error {
+	store := z.cacheStore()
+	if updater, ok := store.(CacheUpdater); ok {
+		mergeSet, deletedIds := SplitDeltaSet(deltaSet)
+		if err := updater.Update(z.TenantId, objectType, mergeSet, deletedIds); err != nil {
+			return err
+		}
+	} else if err := store.Save(z.TenantId, objectType, list); err != nil {
+		return err
+	}
+	return store.SaveDeltaLink(z.TenantId, objectType, deltaLink, selection)
+}
+
+// Gets all objects of given delta type matching on 'filter'. Returns entire list if filter is empty
+func GetMatchingDeltaObjects(name, filter string, force bool, z Bundle) (list []interface{}, err error) {
+	return GetMatchingDeltaObjectsCtx(context.Background(), name, filter, force, z)
+}
+
+// Context-aware version of GetMatchingDeltaObjects
+func GetMatchingDeltaObjectsCtx(ctx context.Context, name, filter string, force bool, z Bundle) (list []interface{}, err error) {
+	t, err := z.DeltaType(name)
+	if err != nil {
+		return nil, err
+	}
+	cacheAge := getCacheAge(z, t.Name)
+	stale := cacheAge == 0 || cacheAge > t.ttl() || t.selectionChanged(z)
+	if utl.InternetIsAvailable() && (force || stale) {
+		// If Internet is available AND (force was requested OR cacheAge is zero (meaning does not exist)
+		// OR it is older than the type's TTL OR it has other attributes than now selected) then query
+		// Azure directly to get all objects and show progress while doing so (true = verbose below)
+		list, err = GetAzDeltaObjectsCtx(ctx, t.Name, z, true)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Use local cache for all other conditions, searching it directly if the store can
+		if filter != "" {
+			if matchingList, ok := searchCachedObjects(z, t.Name, filter); ok {
+				return matchingList, nil
+			}
+		}
+		list = getCachedObjects(z, t.Name)
+	}
+
+	if filter == "" {
+		return list, nil
+	}
+	var matchingList []interface{} = nil
+	ids := make(map[string]bool) // Keep track of each unique objects to eliminate repeats
+	for _, i := range list {
+		x := i.(map[string]interface{})
+		id := utl.Str(x["id"])
+		// Match against relevant strings within JSON object (Note: Not all attributes are maintained)
+		if !ids[id] && utl.StringInJson(x, filter) {
+			matchingList = append(matchingList, x)
+			ids[id] = true
+		}
+	}
+	return matchingList, nil
+}
+
+// Returns an id:name map of all objects of given delta type
+func GetIdMapDeltaObjects(name string, z Bundle) (nameMap map[string]string) {
+	t, err := z.DeltaType(name)
+	if err != nil {
+		return map[string]string{}
+	}
+	refresh := func() error { _, err := GetAzDeltaObjects(t.Name, z, true); return err }
+	if nameMap, ok := getIdMapIndexed(z, t.Name, t.ttl(), t.selectionChanged(z), refresh); ok {
+		return nameMap // Straight from the cache store's index
+	}
+	nameMap = make(map[string]string)
+	objects, _ := GetMatchingDeltaObjects(t.Name, "", false, z) // false = don't force a call to Azure
+	// By not forcing an Azure call we're opting for cache speed over id:name map accuracy
+	for _, i := range objects {
+		x := i.(map[string]interface{})
+		if x["id"] != nil && x["displayName"] != nil {
+			nameMap[utl.Str(x["id"])] = utl.Str(x["displayName"])
+		}
+	}
+	return nameMap
+}
+
+// Parses the cache_select entry of a credentials profile, which maps delta type names to the extra
+// attributes to cache, either as a comma-separated string or as a list:
+//
+//	cache_select:
+//	  users: mail,department,jobTitle,accountEnabled
+//	  groups: [mail, securityEnabled]
+func parseCacheSelect(raw interface{}) (map[string][]string, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	entries, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("must map object types to attribute lists")
+	}
+	cacheSelect := make(map[string][]string)
+	for name, v := range entries {
+		switch attrs := v.(type) {
+		case string:
+			cacheSelect[name] = strings.Split(attrs, ",")
+		case []interface{}:
+			for _, a := range attrs {
+				cacheSelect[name] = append(cacheSelect[name], utl.Str(a))
+			}
+		default:
+			return nil, fmt.Errorf("'%s' must be a comma-separated string or a list of attributes", name)
+		}
+	}
+	return cacheSelect, nil
+}
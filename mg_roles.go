@@ -1,8 +1,8 @@
 package maz
 
 import (
+	"context"
 	"fmt"
-	"path/filepath"
 
 	"github.com/queone/utl"
 )
@@ -44,7 +44,7 @@ func PrintAdRole(x map[string]interface{}, z Bundle) {
 		"$filter": "roleDefinitionId eq '" + utl.Str(x["templateId"]) + "'",
 		"$expand": "principal",
 	}
-	url := ConstMgUrl + "/v1.0/roleManagement/directory/roleAssignments"
+	url := z.MgUrl() + "/v1.0/roleManagement/directory/roleAssignments"
 	r, statusCode, _ := ApiGet(url, z, params)
 	if statusCode == 200 && r != nil && r["value"] != nil {
 		assignments := r["value"].([]interface{})
@@ -67,7 +67,7 @@ func PrintAdRole(x map[string]interface{}, z Bundle) {
 	// See https://github.com/microsoftgraph/microsoft-graph-docs/blob/main/api-reference/v1.0/api/directoryrole-list-members.md
 	// TODO: Fix 404 below for custom groups
 	//   Resource '<custom role UUID>' does not exist or one of its queried reference-property objects are not present.
-	url = ConstMgUrl + "/v1.0/directoryRoles(roleTemplateId='" + utl.Str(x["templateId"]) + "')/members"
+	url = z.MgUrl() + "/v1.0/directoryRoles(roleTemplateId='" + utl.Str(x["templateId"]) + "')/members"
 	r, statusCode, _ = ApiGet(url, z, nil)
 	if statusCode == 200 && r != nil && r["value"] != nil {
 		members := r["value"].([]interface{})
@@ -86,51 +86,56 @@ func PrintAdRole(x map[string]interface{}, z Bundle) {
 
 // Returns count of Azure AD directory role entries in local cache file
 func AdRolesCountLocal(z Bundle) int64 {
-	var cachedList []interface{} = nil
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_directoryRoles."+ConstCacheFileExtension)
-	if utl.FileUsable(cacheFile) {
-		rawList, _ := utl.LoadFileJsonGzip(cacheFile)
-		if rawList != nil {
-			cachedList = rawList.([]interface{})
-			return int64(len(cachedList))
-		}
-	}
-	return 0
+	return int64(len(getCachedObjects(z, "directoryRoles")))
 }
 
 // Returns count of Azure AD directory role entries in current tenant
-func AdRolesCountAzure(z Bundle) int64 {
+func AdRolesCountAzure(z Bundle) (int64, error) {
+	return AdRolesCountAzureCtx(context.Background(), z)
+}
+
+// Context-aware version of AdRolesCountAzure
+func AdRolesCountAzureCtx(ctx context.Context, z Bundle) (int64, error) {
 	// Note that endpoint "/v1.0/directoryRoles" is for Activated AD roles, so it wont give us
 	// the full count of all AD roles. Also, the actual role definitions, with what permissions
 	// each has is at endpoint "/v1.0/roleManagement/directory/roleDefinitions", but because
 	// we only care about their count it is easier to just call end point
 	// "/v1.0/directoryRoleTemplates" which is a quicker API call and has the accurate count.
 	// It's not clear why MSFT makes this so darn confusing.
-	url := ConstMgUrl + "/v1.0/directoryRoleTemplates"
-	r, _, _ := ApiGet(url, z, nil)
-	ApiErrorCheck("GET", url, utl.Trace(), r)
+	url := z.MgUrl() + "/v1.0/directoryRoleTemplates"
+	r, _, err := ApiGetCtx(ctx, url, z, nil)
+	if err != nil {
+		return 0, err
+	}
 	if r["value"] != nil {
-		return int64(len(r["value"].([]interface{})))
+		return int64(len(r["value"].([]interface{}))), nil
 	}
-	return 0
+	return 0, nil
 }
 
 // Gets all AD roles matching on 'filter'. Returns entire list if filter is empty ""
-func GetMatchingAdRoles(filter string, force bool, z Bundle) (list []interface{}) {
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_directoryRoles."+ConstCacheFileExtension)
-	cacheFileAge := utl.FileAge(cacheFile)
-	if utl.InternetIsAvailable() && (force || cacheFileAge == 0 || cacheFileAge > ConstMgCacheFileAgePeriod) {
-		// If Internet is available AND (force was requested OR cacheFileAge is zero (meaning does not exist)
+func GetMatchingAdRoles(filter string, force bool, z Bundle) (list []interface{}, err error) {
+	return GetMatchingAdRolesCtx(context.Background(), filter, force, z)
+}
+
+// Context-aware version of GetMatchingAdRoles
+func GetMatchingAdRolesCtx(ctx context.Context, filter string, force bool, z Bundle) (list []interface{}, err error) {
+	cacheAge := getCacheAge(z, "directoryRoles")
+	if utl.InternetIsAvailable() && (force || cacheAge == 0 || cacheAge > ConstMgCacheFileAgePeriod) {
+		// If Internet is available AND (force was requested OR cacheAge is zero (meaning does not exist)
 		// OR it is older than ConstMgCacheFileAgePeriod) then query Azure directly to get all objects
 		// and show progress while doing so (true = verbose below)
-		list = GetAzAdRoles(z, true)
+		list, err = GetAzAdRolesCtx(ctx, z, true)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		// Use local cache for all other conditions
-		list = GetCachedObjects(cacheFile)
+		list = getCachedObjects(z, "directoryRoles")
 	}
 
 	if filter == "" {
-		return list
+		return list, nil
 	}
 	var matchingList []interface{} = nil
 	var ids []string // Keep track of each unique objects to eliminate repeats
@@ -143,31 +148,47 @@ func GetMatchingAdRoles(filter string, force bool, z Bundle) (list []interface{}
 			ids = append(ids, id)
 		}
 	}
-	return matchingList
+	return matchingList, nil
 }
 
 // Gets all directory role definitions from Azure and sync to local cache. Shows progress if verbose = true
-func GetAzAdRoles(z Bundle, verbose bool) (list []interface{}) {
-	cacheFile := filepath.Join(z.ConfDir, z.TenantId+"_directoryRoles."+ConstCacheFileExtension)
+func GetAzAdRoles(z Bundle, verbose bool) (list []interface{}, err error) {
+	return GetAzAdRolesCtx(context.Background(), z, verbose)
+}
 
+// Context-aware version of GetAzAdRoles
+func GetAzAdRolesCtx(ctx context.Context, z Bundle, verbose bool) (list []interface{}, err error) {
 	// There's no API delta options for this object (too short a list?), so just one call
 
-	url := ConstMgUrl + "/beta/roleManagement/directory/roleDefinitions"
-	r, _, _ := ApiGet(url, z, nil)
+	url := z.MgUrl() + "/beta/roleManagement/directory/roleDefinitions"
+	r, _, err := ApiGetCtx(ctx, url, z, nil)
+	if err != nil {
+		return nil, err
+	}
 	if r["value"] == nil {
-		return nil
+		return nil, nil
 	}
 	list = r["value"].([]interface{})
-	utl.SaveFileJsonGzip(list, cacheFile) // Update the local cache
-	return list
+	if err := saveCachedObjects(z, "directoryRoles", list); err != nil { // Update the local cache
+		return nil, err
+	}
+	return list, nil
 }
 
 // Gets Azure AD role definition by Object UUID, with all attributes
-func GetAzAdRoleByUuid(uuid string, z Bundle) map[string]interface{} {
+func GetAzAdRoleByUuid(uuid string, z Bundle) (map[string]interface{}, error) {
+	return GetAzAdRoleByUuidCtx(context.Background(), uuid, z)
+}
+
+// Context-aware version of GetAzAdRoleByUuid
+func GetAzAdRoleByUuidCtx(ctx context.Context, uuid string, z Bundle) (map[string]interface{}, error) {
 	// Note that role definitions are under a different area, until they are activated
-	baseUrl := ConstMgUrl + "/beta/roleManagement/directory/roleDefinitions"
+	baseUrl := z.MgUrl() + "/beta/roleManagement/directory/roleDefinitions"
 	selection := "?$select=*"
 	url := baseUrl + "/" + uuid + selection
-	r, _, _ := ApiGet(url, z, nil)
-	return r
+	r, _, err := ApiGetCtx(ctx, url, z, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
 }
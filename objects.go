@@ -1,6 +1,8 @@
 package maz
 
 import (
+	"slices"
+
 	"github.com/queone/utl"
 )
 
@@ -16,69 +18,155 @@ func SelectObject(id string, objSet []interface{}) (x map[string]interface{}) {
 	return nil
 }
 
-// Builds JSON mergeSet from deltaSet, and builds and returns the list of deleted IDs
-func NormalizeCache(baseSet, deltaSet []interface{}) (list []interface{}) {
-	var deletedIds []string
-	var uniqueIds []string
-	var mergeSet []interface{} = nil
+// Splits deltaSet into the objects to be merged into the cache, and the IDs of the deleted ones.
+// Entries are taken in order, so later changes to an object win over earlier ones. An '@removed'
+// entry with reason "changed" means the object was soft-deleted, or left the query's scope, and it
+// may come back later in the same set, whereas reason "deleted" means it's gone for good. Groups
+// whose members changed come with a 'members@delta' list of member changes, which are collected
+// in the group's merge object, for MergeDeltaObject to apply to the cached members.
+// See https://learn.microsoft.com/en-us/graph/delta-query-overview
+func SplitDeltaSet(deltaSet []interface{}) (mergeSet []interface{}, deletedIds []string) {
+	type change struct {
+		x       map[string]interface{} // Accumulated updates, nil if removed
+		removed bool
+		deleted bool // Removed for good, so any later entries are ignored
+	}
+	changes := make(map[string]*change, len(deltaSet))
+	var ids []string = nil // Order in which the IDs first showed up
 	for _, i := range deltaSet {
-		x := i.(map[string]interface{})
+		x, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
 		id := utl.Str(x["id"])
-		if x["@removed"] == nil && x["members@delta"] == nil {
-			// Only add to mergeSet if '@remove' and 'members@delta' are missing
-			if !utl.ItemInList(id, uniqueIds) {
-				// Only add if it's unique
-				mergeSet = append(mergeSet, x)
-				uniqueIds = append(uniqueIds, id) // Track unique IDs
-			}
-		} else {
+		c := changes[id]
+		if c == nil {
+			c = &change{}
+			changes[id] = c
+			ids = append(ids, id)
+		} else if c.deleted {
+			continue
+		}
+		if x["@removed"] != nil {
+			removed, _ := x["@removed"].(map[string]interface{})
+			c.x, c.removed = nil, true
+			c.deleted = utl.Str(removed["reason"]) == "deleted"
+			continue
+		}
+		c.removed = false // A "changed" removal may be undone by a restore
+		if c.x == nil {
+			c.x = x
+			continue
+		}
+		// Fold this entry into the earlier ones, keeping all member changes in order
+		members := append(deltaMembers(c.x), deltaMembers(x)...)
+		c.x = utl.MergeObjects(copyObject(c.x), x)
+		if members != nil {
+			c.x["members@delta"] = members
+		}
+	}
+	for _, id := range ids {
+		c := changes[id]
+		if c.removed {
 			deletedIds = append(deletedIds, id)
+		} else if c.x != nil {
+			mergeSet = append(mergeSet, c.x)
 		}
 	}
+	return mergeSet, deletedIds
+}
 
-	// Remove recently deleted entries (deletedIs) from baseSet
-	list = nil
-	var baseIds []string = nil // Track all the IDs in the base cache set
-	for _, i := range baseSet {
-		x := i.(map[string]interface{})
-		id := utl.Str(x["id"])
-		if utl.ItemInList(id, deletedIds) {
-			continue
+// Returns cached object x updated with y, an object from the mergeSet of SplitDeltaSet. Properties
+// in y replace those in x, except for 'members@delta', whose member additions and removals are
+// applied to the members list of x. Neither x nor y are modified.
+func MergeDeltaObject(x, y map[string]interface{}) map[string]interface{} {
+	obj := utl.MergeObjects(copyObject(x), y)
+	if y["members@delta"] == nil {
+		return obj
+	}
+	var members []interface{} = nil
+	index := make(map[string]int) // Member ID to its position in members
+	for _, m := range deltaMembers(x) {
+		id := utl.Str(m.(map[string]interface{})["id"])
+		index[id] = len(members)
+		members = append(members, m)
+	}
+	for _, m := range deltaMembers(y) {
+		member := m.(map[string]interface{})
+		id := utl.Str(member["id"])
+		k, known := index[id]
+		switch {
+		case member["@removed"] != nil:
+			if known {
+				members[k] = nil // Dropped below, so positions stay valid meanwhile
+				delete(index, id)
+			}
+		case known:
+			members[k] = member
+		default:
+			index[id] = len(members)
+			members = append(members, member)
 		}
-		list = append(list, x)
-		baseIds = append(baseIds, id)
 	}
+	obj["members@delta"] = slices.DeleteFunc(members, func(m interface{}) bool { return m == nil })
+	return obj
+}
 
-	// Merge new entries in deltaSet into baseSet
-	var duplicates []interface{} = nil
-	var duplicateIds []string = nil
-	for _, obj := range mergeSet {
-		x := obj.(map[string]interface{})
-		id := utl.Str(x["id"])
-		if utl.ItemInList(id, baseIds) {
-			duplicates = append(duplicates, x)
-			duplicateIds = append(duplicateIds, id)
-			continue // Skip duplicates (these are updates)
+// Returns the 'members@delta' entries of given group object that are objects, or nil if it has none
+func deltaMembers(x map[string]interface{}) (members []interface{}) {
+	list, _ := x["members@delta"].([]interface{})
+	for _, m := range list {
+		if _, ok := m.(map[string]interface{}); ok {
+			members = append(members, m)
 		}
-		list = append(list, x) // Merge all others (these are new entries)
+	}
+	return members
+}
+
+// Returns a shallow copy of given object
+func copyObject(x map[string]interface{}) map[string]interface{} {
+	obj := make(map[string]interface{}, len(x))
+	for k, v := range x {
+		obj[k] = v
+	}
+	return obj
+}
+
+// Merges deltaSet into baseSet, dropping deleted objects and merging updated ones, and returns the
+// result. Objects keep their order in baseSet, with new ones appended in the order they came in.
+func NormalizeCache(baseSet, deltaSet []interface{}) (list []interface{}) {
+	mergeSet, deletedIds := SplitDeltaSet(deltaSet)
+	deleted := make(map[string]bool, len(deletedIds))
+	for _, id := range deletedIds {
+		deleted[id] = true
+	}
+	updates := make(map[string]map[string]interface{}, len(mergeSet))
+	for _, i := range mergeSet {
+		y := i.(map[string]interface{})
+		updates[utl.Str(y["id"])] = y
 	}
 
-	// Merge updated entries in deltaSet into baseSet
-	list2 := list
-	list = nil
-	for _, obj := range list2 {
-		x := obj.(map[string]interface{})
+	list = make([]interface{}, 0, len(baseSet)+len(mergeSet))
+	for _, i := range baseSet {
+		x, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
 		id := utl.Str(x["id"])
-		if !utl.ItemInList(id, duplicateIds) {
-			// If this object is not a duplicate, add it to our growing list
-			list = append(list, x)
-		} else {
-			// Merge object updates, then add it to our growing list
-			y := SelectObject(id, duplicates)
-			x = utl.MergeObjects(x, y)
-			list = append(list, x)
+		if deleted[id] {
+			continue
+		}
+		if y, ok := updates[id]; ok {
+			x = MergeDeltaObject(x, y)
+			delete(updates, id) // What's left at the end are new objects
+		}
+		list = append(list, x)
+	}
+	for _, i := range mergeSet {
+		y := i.(map[string]interface{})
+		if _, ok := updates[utl.Str(y["id"])]; ok {
+			list = append(list, MergeDeltaObject(nil, y)) // Applies any member changes to an empty list
 		}
 	}
-
 	return list
 }
@@ -0,0 +1,62 @@
+package maz
+
+import (
+	"fmt"
+	"testing"
+)
+
+const benchObjectCount = 200000
+
+// Returns n synthetic user objects, as a full sync would cache them
+func benchBaseSet(n int) []interface{} {
+	list := make([]interface{}, n)
+	for i := range list {
+		list[i] = map[string]interface{}{
+			"id":                fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+			"displayName":       fmt.Sprintf("User %d", i),
+			"userPrincipalName": fmt.Sprintf("user%d@contoso.com", i),
+		}
+	}
+	return list
+}
+
+// Returns a delta set for the objects of benchBaseSet(n), updating every tenth one, removing every
+// hundredth one, and adding n/10 new ones
+func benchDeltaSet(n int) []interface{} {
+	var deltaSet []interface{} = nil
+	for i := 0; i < n; i += 10 {
+		deltaSet = append(deltaSet, map[string]interface{}{
+			"id":          fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+			"displayName": fmt.Sprintf("Renamed user %d", i),
+		})
+	}
+	for i := 5; i < n; i += 100 {
+		deltaSet = append(deltaSet, map[string]interface{}{
+			"id":       fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+			"@removed": map[string]interface{}{"reason": "deleted"},
+		})
+	}
+	for i := n; i < n+n/10; i++ {
+		deltaSet = append(deltaSet, map[string]interface{}{
+			"id":          fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+			"displayName": fmt.Sprintf("New user %d", i),
+		})
+	}
+	return deltaSet
+}
+
+func BenchmarkNormalizeCache(b *testing.B) {
+	baseSet, deltaSet := benchBaseSet(benchObjectCount), benchDeltaSet(benchObjectCount)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NormalizeCache(baseSet, deltaSet)
+	}
+}
+
+func BenchmarkSplitDeltaSet(b *testing.B) {
+	deltaSet := append(benchBaseSet(benchObjectCount), benchDeltaSet(benchObjectCount)...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		SplitDeltaSet(deltaSet)
+	}
+}
@@ -0,0 +1,119 @@
+package maz
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/queone/utl"
+)
+
+// Returns the IDs of given objects, in order
+func objectIds(list []interface{}) (ids []string) {
+	for _, i := range list {
+		ids = append(ids, utl.Str(i.(map[string]interface{})["id"]))
+	}
+	return ids
+}
+
+func TestSplitDeltaSetRemovedReasons(t *testing.T) {
+	deltaSet := []interface{}{
+		map[string]interface{}{"id": "a", "@removed": map[string]interface{}{"reason": "changed"}},
+		map[string]interface{}{"id": "b", "@removed": map[string]interface{}{"reason": "deleted"}},
+		map[string]interface{}{"id": "c", "displayName": "C"},
+	}
+	mergeSet, deletedIds := SplitDeltaSet(deltaSet)
+	if got := objectIds(mergeSet); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("mergeSet ids = %v, want [c]", got)
+	}
+	if !reflect.DeepEqual(deletedIds, []string{"a", "b"}) {
+		t.Errorf("deletedIds = %v, want [a b]", deletedIds)
+	}
+}
+
+func TestSplitDeltaSetRemoveThenRestore(t *testing.T) {
+	deltaSet := []interface{}{
+		// Soft-deleted, then restored, so it stays
+		map[string]interface{}{"id": "a", "displayName": "A"},
+		map[string]interface{}{"id": "a", "@removed": map[string]interface{}{"reason": "changed"}},
+		map[string]interface{}{"id": "a", "displayName": "A2"},
+		// Deleted for good, so the later entry is ignored
+		map[string]interface{}{"id": "b", "@removed": map[string]interface{}{"reason": "deleted"}},
+		map[string]interface{}{"id": "b", "displayName": "B"},
+		// Restored, then soft-deleted again, so it goes
+		map[string]interface{}{"id": "c", "displayName": "C"},
+		map[string]interface{}{"id": "c", "@removed": map[string]interface{}{"reason": "changed"}},
+	}
+	mergeSet, deletedIds := SplitDeltaSet(deltaSet)
+	if len(mergeSet) != 1 || utl.Str(mergeSet[0].(map[string]interface{})["displayName"]) != "A2" {
+		t.Errorf("mergeSet = %v, want only a with displayName A2", mergeSet)
+	}
+	if !reflect.DeepEqual(deletedIds, []string{"b", "c"}) {
+		t.Errorf("deletedIds = %v, want [b c]", deletedIds)
+	}
+}
+
+func TestNormalizeCache(t *testing.T) {
+	baseSet := []interface{}{
+		map[string]interface{}{"id": "a", "displayName": "A", "mail": "a@contoso.com"},
+		map[string]interface{}{"id": "b", "displayName": "B"},
+		map[string]interface{}{"id": "c", "displayName": "C"},
+		map[string]interface{}{"id": "d", "displayName": "D"},
+	}
+	deltaSet := []interface{}{
+		map[string]interface{}{"id": "e", "displayName": "E"},
+		map[string]interface{}{"id": "a", "displayName": "A2"},
+		map[string]interface{}{"id": "b", "@removed": map[string]interface{}{"reason": "changed"}},
+		map[string]interface{}{"id": "c", "@removed": map[string]interface{}{"reason": "deleted"}},
+		map[string]interface{}{"id": "d", "@removed": map[string]interface{}{"reason": "changed"}},
+		map[string]interface{}{"id": "d", "displayName": "D2"},
+	}
+	list := NormalizeCache(baseSet, deltaSet)
+	if got := objectIds(list); !reflect.DeepEqual(got, []string{"a", "d", "e"}) {
+		t.Fatalf("ids = %v, want [a d e]", got)
+	}
+	a := list[0].(map[string]interface{})
+	if a["displayName"] != "A2" || a["mail"] != "a@contoso.com" {
+		t.Errorf("a = %v, want displayName updated and mail kept", a)
+	}
+	if d := list[1].(map[string]interface{}); d["displayName"] != "D2" {
+		t.Errorf("d = %v, want restored with displayName D2", d)
+	}
+	if baseSet[0].(map[string]interface{})["displayName"] != "A" {
+		t.Error("baseSet was modified")
+	}
+}
+
+func TestNormalizeCacheMembersDelta(t *testing.T) {
+	member := func(id string, removed bool) map[string]interface{} {
+		m := map[string]interface{}{"id": id, "@odata.type": "#microsoft.graph.user"}
+		if removed {
+			m["@removed"] = map[string]interface{}{"reason": "deleted"}
+		}
+		return m
+	}
+	baseSet := []interface{}{
+		map[string]interface{}{"id": "g", "displayName": "G",
+			"members@delta": []interface{}{member("u1", false), member("u2", false)}},
+	}
+	deltaSet := []interface{}{
+		map[string]interface{}{"id": "g", "members@delta": []interface{}{member("u1", true), member("u3", false)}},
+		map[string]interface{}{"id": "g", "displayName": "G2", "members@delta": []interface{}{member("u4", false)}},
+		map[string]interface{}{"id": "g", "members@delta": []interface{}{member("u3", true)}},
+		map[string]interface{}{"id": "h", "members@delta": []interface{}{member("u5", false), member("u6", true)}},
+	}
+	list := NormalizeCache(baseSet, deltaSet)
+	if got := objectIds(list); !reflect.DeepEqual(got, []string{"g", "h"}) {
+		t.Fatalf("ids = %v, want [g h]", got)
+	}
+	g := list[0].(map[string]interface{})
+	if g["displayName"] != "G2" {
+		t.Errorf("g displayName = %v, want G2", g["displayName"])
+	}
+	if got := objectIds(g["members@delta"].([]interface{})); !reflect.DeepEqual(got, []string{"u2", "u4"}) {
+		t.Errorf("g members = %v, want [u2 u4]", got)
+	}
+	h := list[1].(map[string]interface{})
+	if got := objectIds(h["members@delta"].([]interface{})); !reflect.DeepEqual(got, []string{"u5"}) {
+		t.Errorf("h members = %v, want [u5]", got)
+	}
+}
@@ -1,6 +1,7 @@
 package maz
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -13,15 +14,15 @@ func PrintCountStatus(z Bundle) {
 	fmt.Printf("%-36s%10s%10s\n", "OBJECTS", "LOCAL", "AZURE")
 	status := utl.Blu(utl.PostSpc("Azure AD Users", 36))
 	status += utl.Gre(utl.PreSpc(UsersCountLocal(z), 10))
-	status += utl.Gre(utl.PreSpc(UsersCountAzure(z), 10)) + "\n"
+	status += utl.Gre(utl.PreSpc(countOrZero(UsersCountAzure(z)), 10)) + "\n"
 	status += utl.Blu(utl.PostSpc("Azure AD Groups", 36))
 	status += utl.Gre(utl.PreSpc(GroupsCountLocal(z), 10))
-	status += utl.Gre(utl.PreSpc(GroupsCountAzure(z), 10)) + "\n"
+	status += utl.Gre(utl.PreSpc(countOrZero(GroupsCountAzure(z)), 10)) + "\n"
 	status += utl.Blu(utl.PostSpc("Azure App Registrations", 36))
 	status += utl.Gre(utl.PreSpc(AppsCountLocal(z), 10))
-	status += utl.Gre(utl.PreSpc(AppsCountAzure(z), 10)) + "\n"
+	status += utl.Gre(utl.PreSpc(countOrZero(AppsCountAzure(z)), 10)) + "\n"
 	nativeSpsLocal, msSpsLocal := SpsCountLocal(z)
-	nativeSpsAzure, msSpsAzure := SpsCountAzure(z)
+	nativeSpsAzure, msSpsAzure, _ := SpsCountAzure(z)
 	status += utl.Blu(utl.PostSpc("Azure SPs (multi-tenant)", 36))
 	status += utl.Gre(utl.PreSpc(msSpsLocal, 10))
 	status += utl.Gre(utl.PreSpc(msSpsAzure, 10)) + "\n"
@@ -30,15 +31,15 @@ func PrintCountStatus(z Bundle) {
 	status += utl.Gre(utl.PreSpc(nativeSpsAzure, 10)) + "\n"
 	status += utl.Blu(utl.PostSpc("Azure AD Roles", 36))
 	status += utl.Gre(utl.PreSpc(AdRolesCountLocal(z), 10))
-	status += utl.Gre(utl.PreSpc(AdRolesCountAzure(z), 10)) + "\n"
+	status += utl.Gre(utl.PreSpc(countOrZero(AdRolesCountAzure(z)), 10)) + "\n"
 	status += utl.Blu(utl.PostSpc("Azure Management Groups", 36))
 	status += utl.Gre(utl.PreSpc(MgGroupCountLocal(z), 10))
-	status += utl.Gre(utl.PreSpc(MgGroupCountAzure(z), 10)) + "\n"
+	status += utl.Gre(utl.PreSpc(countOrZero(MgGroupCountAzure(z)), 10)) + "\n"
 	status += utl.Blu(utl.PostSpc("Azure Subscriptions", 36))
 	status += utl.Gre(utl.PreSpc(SubsCountLocal(z), 10))
-	status += utl.Gre(utl.PreSpc(SubsCountAzure(z), 10)) + "\n"
+	status += utl.Gre(utl.PreSpc(countOrZero(SubsCountAzure(z)), 10)) + "\n"
 	builtinLocal, customLocal := RoleDefinitionCountLocal(z)
-	builtinAzure, customAzure := RoleDefinitionCountAzure(z)
+	builtinAzure, customAzure, _ := RoleDefinitionCountAzure(z)
 	status += utl.Blu(utl.PostSpc("Resource Role Definitions BuiltIn", 36))
 	status += utl.Gre(utl.PreSpc(builtinLocal, 10))
 	status += utl.Gre(utl.PreSpc(builtinAzure, 10)) + "\n"
@@ -47,19 +48,27 @@ func PrintCountStatus(z Bundle) {
 	status += utl.Gre(utl.PreSpc(customAzure, 10)) + "\n"
 	status += utl.Blu(utl.PostSpc("Resource Role Assignments", 36))
 	status += utl.Gre(utl.PreSpc(RoleAssignmentsCountLocal(z), 10))
-	status += utl.Gre(utl.PreSpc(RoleAssignmentsCountAzure(z), 10)) + "\n"
+	status += utl.Gre(utl.PreSpc(countOrZero(RoleAssignmentsCountAzure(z)), 10)) + "\n"
 	fmt.Print(status)
 }
 
+// Drops the error from a count call, since a failed count is shown as zero in the status report
+func countOrZero(count int64, _ error) int64 {
+	return count
+}
+
 // Prints this single object of type 't' tersely, with minimal attributes.
 func PrintTersely(t string, object interface{}) {
-	x := object.(map[string]interface{}) // Assert as JSON object
+	x, ok := object.(map[string]interface{}) // Assert as JSON object
+	if !ok {
+		return
+	}
 	switch t {
 	case "d":
-		xProp := x["properties"].(map[string]interface{})
+		xProp, _ := x["properties"].(map[string]interface{})
 		fmt.Printf("%s  %-60s  %s\n", utl.Str(x["name"]), utl.Str(xProp["roleName"]), utl.Str(xProp["type"]))
 	case "a":
-		xProp := x["properties"].(map[string]interface{})
+		xProp, _ := x["properties"].(map[string]interface{})
 		rdId := utl.LastElem(utl.Str(xProp["roleDefinitionId"]), "/")
 		principalId := utl.Str(xProp["principalId"])
 		principalType := utl.Str(xProp["principalType"])
@@ -68,7 +77,7 @@ func PrintTersely(t string, object interface{}) {
 	case "s":
 		fmt.Printf("%s  %-10s  %s\n", utl.Str(x["subscriptionId"]), utl.Str(x["state"]), utl.Str(x["displayName"]))
 	case "m":
-		xProp := x["properties"].(map[string]interface{})
+		xProp, _ := x["properties"].(map[string]interface{})
 		fmt.Printf("%-38s  %-20s  %s\n", utl.Str(x["name"]), utl.Str(xProp["displayName"]), MgType(utl.Str(x["type"])))
 	case "u":
 		upn := utl.Str(x["userPrincipalName"])
@@ -93,13 +102,18 @@ func PrintTersely(t string, object interface{}) {
 
 // Prints object by given UUID
 func PrintObjectByUuid(uuid string, z Bundle) {
-	list := FindAzObjectsByUuid(uuid, z) // Search for this UUID under all maz objects types
+	list, err := FindAzObjectsByUuid(uuid, z) // Search for this UUID under all maz objects types
+	if err != nil {
+		fmt.Println(utl.Red(err.Error()))
+	}
 	for i, obj := range list {
 		x := obj.(map[string]interface{})
 		mazType := utl.Str(x["mazType"])
 		if mazType != "" {
 			fmt.Printf("Object %d (%s):\n", i, utl.Red(mazTypesLong[mazType]))
-			PrintObject(mazType, x, z)
+			if err := PrintObject(mazType, x, z); err != nil {
+				fmt.Println(utl.Red(err.Error()))
+			}
 		}
 	}
 
@@ -114,8 +128,8 @@ func PrintObjectByUuid(uuid string, z Bundle) {
 	}
 }
 
-// Generic print object function
-func PrintObject(t string, x map[string]interface{}, z Bundle) {
+// Generic print object function. Only SPs and Apps, whose credential dates may not parse, can fail.
+func PrintObject(t string, x map[string]interface{}, z Bundle) error {
 	switch t {
 	case "d":
 		PrintRoleDefinition(x, z)
@@ -130,12 +144,13 @@ func PrintObject(t string, x map[string]interface{}, z Bundle) {
 	case "g":
 		PrintGroup(x, z)
 	case "sp":
-		PrintSp(x, z)
+		return PrintSp(x, z)
 	case "ap":
-		PrintApp(x, z)
+		return PrintApp(x, z)
 	case "ad":
 		PrintAdRole(x, z)
 	}
+	return nil
 }
 
 // Prints appRoleAssignments for given service principal (SP)
@@ -171,28 +186,43 @@ func PrintAppRoleAssignmentsOthers(appRoleAssignments []interface{}, z Bundle) {
 	}
 
 	fmt.Printf(utl.Blu("appRoleAssignments") + ":\n")
-	var uniqueIds []string // Keep track of assignments
+	var unique []map[string]interface{} // Unique assignments, in their original order
+	uniqueIds := make(map[string]bool)
+	var resourceIds []string
 	for _, i := range appRoleAssignments {
-		ara := i.(map[string]interface{}) // JSON object
-		appRoleId := utl.Str(ara["appRoleId"])
-		resourceDisplayName := utl.Str(ara["resourceDisplayName"])
+		ara := i.(map[string]interface{})        // JSON object
 		resourceId := utl.Str(ara["resourceId"]) // SP where the appRole is defined
 
 		// Only print unique assignments, skip over repeated ones
-		conbinedId := resourceDisplayName + "_" + resourceId + "_" + appRoleId
-		if utl.ItemInList(conbinedId, uniqueIds) {
+		conbinedId := utl.Str(ara["resourceDisplayName"]) + "_" + resourceId + "_" + utl.Str(ara["appRoleId"])
+		if uniqueIds[conbinedId] {
 			continue // Skip this repeated one. This can happen due to inherited nesting
 		}
-		uniqueIds = append(uniqueIds, conbinedId) // Track unique ones
+		uniqueIds[conbinedId] = true // Track unique ones
+		unique = append(unique, ara)
+		resourceIds = append(resourceIds, resourceId)
+	}
+
+	// MS Graph does not appear to have a global registry nor a call to get all SP app roles, so we
+	// have to get each resource SP, which is done in batches to keep it quick.
+	resSps, err := GetAzSpsByUuids(resourceIds, "id,appRoles", z)
+	if err != nil {
+		fmt.Println(utl.Red(err.Error()))
+	}
+	for _, ara := range unique {
+		appRoleId := utl.Str(ara["appRoleId"])
+		resourceDisplayName := utl.Str(ara["resourceDisplayName"])
+		resourceId := utl.Str(ara["resourceId"])
 
 		// Now build roleNameMap and get roleName
-		// We are forced to do this excessive processing for each appRole, because MG Graph does
-		// not appear to have a global registry nor a call to get all SP app roles.
 		roleNameMap := make(map[string]string)
-		x := GetAzSpByUuid(resourceId, z)
+		x := resSps[resourceId]
+		if x == nil {
+			continue // Resource SP no longer exists, or the error was printed above
+		}
 		roleNameMap["00000000-0000-0000-0000-000000000000"] = "Default" // Include default app permissions role
 		// But also get all other additional appRoles it may have defined
-		appRoles := x["appRoles"].([]interface{})
+		appRoles, _ := x["appRoles"].([]interface{})
 		if len(appRoles) > 0 {
 			for _, i := range appRoles {
 				a := i.(map[string]interface{})
@@ -227,9 +257,9 @@ func PrintMemberOfs(t string, memberOf []interface{}) {
 }
 
 // Prints secret list stanza for App and SP objects
-func PrintSecretList(secretsList []interface{}) {
+func PrintSecretList(secretsList []interface{}) error {
 	if len(secretsList) < 1 {
-		return
+		return nil
 	}
 	fmt.Println(utl.Blu("secrets") + ":")
 	for _, i := range secretsList {
@@ -241,18 +271,18 @@ func PrintSecretList(secretsList []interface{}) {
 		// Reformat date strings for better readability
 		cStart, err := utl.ConvertDateFormat(utl.Str(pw["startDateTime"]), time.RFC3339Nano, "2006-01-02 15:04")
 		if err != nil {
-			utl.Die(utl.Trace() + err.Error() + "\n")
+			return err
 		}
 		cExpiry, err := utl.ConvertDateFormat(utl.Str(pw["endDateTime"]), time.RFC3339Nano, "2006-01-02 15:04")
 		if err != nil {
-			utl.Die(utl.Trace() + err.Error() + "\n")
+			return err
 		}
 
 		// Check if expiring soon
 		now := time.Now().Unix()
 		expiry, err := utl.DateStringToEpocInt64(utl.Str(pw["endDateTime"]), time.RFC3339Nano)
 		if err != nil {
-			utl.Die(utl.Trace() + err.Error() + "\n")
+			return err
 		}
 		daysDiff := (expiry - now) / 86400
 		if daysDiff <= 0 {
@@ -265,12 +295,13 @@ func PrintSecretList(secretsList []interface{}) {
 		fmt.Printf("  %-36s  %-30s  %-16s  %-16s  %s\n", utl.Gre(cId), utl.Gre(cName),
 			utl.Gre(cHint), utl.Gre(cStart), cExpiry)
 	}
+	return nil
 }
 
 // Prints certificate list stanza for Apps and Sps
-func PrintCertificateList(certificates []interface{}) {
+func PrintCertificateList(certificates []interface{}) error {
 	if len(certificates) < 1 {
-		return
+		return nil
 	}
 	fmt.Println(utl.Blu("certificates") + ":")
 	for _, i := range certificates {
@@ -281,17 +312,17 @@ func PrintCertificateList(certificates []interface{}) {
 		// Reformat date strings for better readability
 		cStart, err := utl.ConvertDateFormat(utl.Str(a["startDateTime"]), time.RFC3339Nano, "2006-01-02 15:04")
 		if err != nil {
-			utl.Die(utl.Trace() + err.Error() + "\n")
+			return err
 		}
 		cExpiry, err := utl.ConvertDateFormat(utl.Str(a["endDateTime"]), time.RFC3339Nano, "2006-01-02 15:04")
 		if err != nil {
-			utl.Die(utl.Trace() + err.Error() + "\n")
+			return err
 		}
 		// Check if expiring soon
 		now := time.Now().Unix()
 		expiry, err := utl.DateStringToEpocInt64(utl.Str(a["endDateTime"]), time.RFC3339Nano)
 		if err != nil {
-			utl.Die(utl.Trace() + err.Error() + "\n")
+			return err
 		}
 		daysDiff := (expiry - now) / 86400
 		if daysDiff <= 0 {
@@ -309,6 +340,7 @@ func PrintCertificateList(certificates []interface{}) {
 			utl.Gre(cType), utl.Gre(cStart), cExpiry)
 	}
 	// https://learn.microsoft.com/en-us/graph/api/application-addkey
+	return nil
 }
 
 // Print owners stanza for Apps and Sps
@@ -347,31 +379,39 @@ func PrintStringMapColor(strMap map[string]string) {
 }
 
 // Prints all objects that match on given specifier
-func PrintMatching(printFormat, t, specifier string, z Bundle) {
+func PrintMatching(printFormat, t, specifier string, z Bundle) error {
 	if utl.ValidUuid(specifier) {
 		// If valid UUID string, get object direct from Azure
-		x := GetAzObjectByUuid(t, specifier, z)
+		x, err := GetAzObjectByUuid(t, specifier, z)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
 		if x != nil {
 			if printFormat == "json" {
 				utl.PrintJsonColor(x)
 			} else if printFormat == "reg" {
-				PrintObject(t, x, z)
+				return PrintObject(t, x, z)
 			}
-			return
+			return nil
 		}
 	}
-	matchingObjects := GetObjects(t, specifier, false, z)
+	matchingObjects, err := GetObjects(t, specifier, false, z)
+	if err != nil {
+		return err
+	}
 	if len(matchingObjects) == 1 {
 		// If it's only one object, try getting it direct from Azure instead of using the local cache
 		x := matchingObjects[0].(map[string]interface{})
 		uuid := utl.Str(x["id"])
 		if utl.ValidUuid(uuid) {
-			x = GetAzObjectByUuid(t, uuid, z) // Replace object with version directly in Azure
+			if y, err := GetAzObjectByUuid(t, uuid, z); err == nil && y != nil {
+				x = y // Replace object with version directly in Azure
+			}
 		}
 		if printFormat == "json" {
 			utl.PrintJsonColor(x)
 		} else if printFormat == "reg" {
-			PrintObject(t, x, z)
+			return PrintObject(t, x, z)
 		}
 	} else if len(matchingObjects) > 1 {
 		if printFormat == "json" {
@@ -383,4 +423,5 @@ func PrintMatching(printFormat, t, specifier string, z Bundle) {
 			}
 		}
 	}
+	return nil
 }
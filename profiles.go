@@ -0,0 +1,263 @@
+package maz
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/queone/utl"
+)
+
+// The credentials file can hold multiple named login profiles, for instance one per tenant:
+//
+//	default_profile: prod
+//	profiles:
+//	  prod:
+//	    tenant_id: 3f050090-20b0-40a0-a060-c05060104010
+//	    client_id: f1110121-7111-4171-a181-e1614131e181
+//	    client_secret: <client-secret>
+//	  gov:
+//	    tenant_id: 5a0a0e16-7c52-4b1e-9a3e-3a8dbd1e0c2d
+//	    username: user1@domain.us
+//	    interactive: true
+//	    cloud: AzureUSGov
+//
+// A flat file, without a 'profiles' entry, is treated as a single profile named "default".
+
+const ConstDefaultProfile = "default"
+
+// Returns the profile name to use: MAZ_PROFILE has precedence over z.Profile, which has precedence
+// over the file's default_profile. If there's still no name, it's the only profile, or "default".
+func selectProfile(z Bundle, file map[string]interface{}) string {
+	if v := os.Getenv("MAZ_PROFILE"); v != "" {
+		return v
+	}
+	if z.Profile != "" {
+		return z.Profile
+	}
+	if v := utl.Str(file["default_profile"]); v != "" {
+		return v
+	}
+	if profiles, ok := file["profiles"].(map[string]interface{}); ok && len(profiles) == 1 {
+		for name := range profiles {
+			return name
+		}
+	}
+	return ConstDefaultProfile
+}
+
+// Loads the credentials file. A missing file is returned as an empty one.
+func loadCredsFile(filePath string) (map[string]interface{}, error) {
+	if utl.FileNotExist(filePath) || utl.FileSize(filePath) < 1 {
+		return map[string]interface{}{}, nil
+	}
+	credsRaw, err := utl.LoadFileYaml(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %w", filePath, err)
+	}
+	file, ok := credsRaw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("[%s] not a valid credentials file", filePath)
+	}
+	return file, nil
+}
+
+// Returns the profiles in given credentials file, converting a flat file into a single profile
+func fileProfiles(file map[string]interface{}) map[string]interface{} {
+	if profiles, ok := file["profiles"].(map[string]interface{}); ok {
+		return profiles
+	}
+	if len(file) == 0 {
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{ConstDefaultProfile: file}
+}
+
+// Loads the login settings of the selected profile from the credentials file, and returns them
+// along with the name of the profile.
+func loadProfile(z Bundle) (creds map[string]interface{}, name string, err error) {
+	filePath := filepath.Join(z.ConfDir, z.CredsFile) // credentials.yaml
+	if utl.FileNotExist(filePath) && utl.FileSize(filePath) < 1 {
+		return nil, "", fmt.Errorf("missing credentials file: %s", filePath)
+	}
+	file, err := loadCredsFile(filePath)
+	if err != nil {
+		return nil, "", err
+	}
+	name = selectProfile(z, file)
+	creds, ok := fileProfiles(file)[name].(map[string]interface{})
+	if !ok {
+		return nil, name, fmt.Errorf("[%s] no profile named '%s'", filePath, name)
+	}
+	return creds, name, nil
+}
+
+// Returns the names of all profiles in the credentials file, and which one is the default
+func ListProfiles(z Bundle) (names []string, defaultName string, err error) {
+	file, err := loadCredsFile(filepath.Join(z.ConfDir, z.CredsFile))
+	if err != nil {
+		return nil, "", err
+	}
+	for name := range fileProfiles(file) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		defaultName = utl.Str(file["default_profile"])
+		if defaultName == "" && len(names) == 1 {
+			defaultName = names[0]
+		}
+	}
+	return names, defaultName, nil
+}
+
+// Adds, or replaces, the named profile in the credentials file, using the login settings in z. A
+// flat credentials file is first converted into one with a single "default" profile. The very
+// first profile becomes the default one.
+func AddProfile(z Bundle, name string) error {
+	if name == "" {
+		return fmt.Errorf("profile name cannot be empty")
+	}
+	if !utl.ValidUuid(z.TenantId) {
+		return fmt.Errorf("tenant_id '%s' is not a valid UUID", z.TenantId)
+	}
+	settings, err := loginSettings(z)
+	if err != nil {
+		return err
+	}
+	filePath := filepath.Join(z.ConfDir, z.CredsFile)
+	return updateCredsFile(filePath, func(file map[string]interface{}) (string, map[string]interface{}, error) {
+		_, hasProfiles := file["profiles"]
+		isFlat := !hasProfiles && len(file) > 0
+		profiles := fileProfiles(file)
+		profiles[name] = settings
+		defaultName := utl.Str(file["default_profile"])
+		if isFlat {
+			defaultName = ConstDefaultProfile // Keep using the converted flat file entries by default
+		} else if defaultName == "" && len(profiles) == 1 {
+			defaultName = name
+		}
+		return defaultName, profiles, nil
+	})
+}
+
+// Removes the named profile from the credentials file. If it was the default, then the remaining
+// profile becomes the default if there's only one left, otherwise there's no default.
+func RemoveProfile(z Bundle, name string) error {
+	filePath := filepath.Join(z.ConfDir, z.CredsFile)
+	return updateCredsFile(filePath, func(file map[string]interface{}) (string, map[string]interface{}, error) {
+		profiles := fileProfiles(file)
+		if _, ok := profiles[name]; !ok {
+			return "", nil, fmt.Errorf("[%s] no profile named '%s'", filePath, name)
+		}
+		delete(profiles, name)
+		defaultName := utl.Str(file["default_profile"])
+		if defaultName == name || defaultName == "" {
+			defaultName = ""
+			if len(profiles) == 1 {
+				for remaining := range profiles {
+					defaultName = remaining
+				}
+			}
+		}
+		return defaultName, profiles, nil
+	})
+}
+
+// Makes the named profile the default one
+func SetDefaultProfile(z Bundle, name string) error {
+	filePath := filepath.Join(z.ConfDir, z.CredsFile)
+	return updateCredsFile(filePath, func(file map[string]interface{}) (string, map[string]interface{}, error) {
+		profiles := fileProfiles(file)
+		if _, ok := profiles[name]; !ok {
+			return "", nil, fmt.Errorf("[%s] no profile named '%s'", filePath, name)
+		}
+		return name, profiles, nil
+	})
+}
+
+// Updates the credentials file while holding an exclusive lock on it, from reading it to writing it
+// back, so that concurrent updates can't undo each other. Given function gets the current contents,
+// and returns the default profile name and the profiles to write in profiles format.
+func updateCredsFile(filePath string, update func(file map[string]interface{}) (defaultName string, profiles map[string]interface{}, err error)) error {
+	unlock, err := lockFile(filePath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	file, err := loadCredsFile(filePath)
+	if err != nil {
+		return err
+	}
+	defaultName, profiles, err := update(file)
+	if err != nil {
+		return err
+	}
+	file = map[string]interface{}{"profiles": profiles}
+	if defaultName != "" {
+		file["default_profile"] = defaultName
+	}
+	content, err := utl.YamlToBytes(file)
+	if err != nil {
+		return fmt.Errorf("[%s] %w", filePath, err)
+	}
+	if err := writeFileAtomic(filePath, content, 0600); err != nil { // Already holding the lock
+		return fmt.Errorf("[%s] %w", filePath, err)
+	}
+	return nil
+}
+
+// Returns the login settings in z, as credentials file entries. Secrets are saved in the secret
+// store instead, if there is one.
+func loginSettings(z Bundle) (map[string]interface{}, error) {
+	creds := map[string]interface{}{"tenant_id": z.TenantId}
+	if z.Cloud.Name != "" {
+		creds["cloud"] = z.Cloud.Name
+	}
+	if len(z.CacheSelect) > 0 {
+		cacheSelect := map[string]interface{}{}
+		for name, attrs := range z.CacheSelect {
+			cacheSelect[name] = strings.Join(attrs, ",")
+		}
+		creds["cache_select"] = cacheSelect
+	}
+	switch {
+	case z.ManagedIdentity:
+		creds["managed_identity"] = true
+		if z.ClientId != "" {
+			creds["client_id"] = z.ClientId
+		}
+		if z.ManagedIdentityUrl != "" {
+			creds["managed_identity_url"] = z.ManagedIdentityUrl
+		}
+	case z.Interactive || z.DeviceCode:
+		creds["username"] = z.Username
+		creds["interactive"] = true
+		if z.DeviceCode {
+			creds["interactive_mode"] = "devicecode"
+		}
+	default:
+		creds["client_id"] = z.ClientId
+		if z.ClientCertPath != "" {
+			creds["client_cert_path"] = z.ClientCertPath
+			if z.ClientCertPassword != "" {
+				password, err := storeSecret(z, "client_cert_password", z.ClientCertPassword)
+				if err != nil {
+					return nil, err
+				}
+				creds["client_cert_password"] = password
+			}
+		} else if z.FederatedTokenFile != "" {
+			creds["federated_token_file"] = z.FederatedTokenFile
+		} else {
+			secret, err := storeSecret(z, "client_secret", z.ClientSecret)
+			if err != nil {
+				return nil, err
+			}
+			creds["client_secret"] = secret
+		}
+	}
+	return creds, nil
+}
@@ -0,0 +1,96 @@
+package maz
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how ApiCall retries requests that were throttled (429) or that hit a
+// temporarily unavailable service (503). Assign one to Bundle.Retry to override the default.
+type RetryPolicy struct {
+	MaxAttempts int                // Total attempts, including the first one. 1 disables retries
+	BaseDelay   time.Duration      // Initial backoff delay, doubled on each subsequent attempt
+	MaxDelay    time.Duration      // Upper bound for any single delay, including Retry-After values
+	OnRetry     func(e RetryEvent) // Optional observer, called right before sleeping for each retry. Must be goroutine-safe
+}
+
+// RetryEvent describes a single retry, and is passed to RetryPolicy.OnRetry
+type RetryEvent struct {
+	Method     string
+	Url        string
+	Attempt    int           // The attempt that just failed, starting at 1
+	StatusCode int           // HTTP status code of the failed attempt
+	Delay      time.Duration // How long ApiCall will wait before the next attempt
+	Err        error         // The *ApiError of the failed attempt
+	Header     http.Header   // Response headers, including any x-ms-ratelimit-remaining-* ones
+}
+
+// The policy used when Bundle.Retry is nil
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   1 * time.Second,
+	MaxDelay:    60 * time.Second,
+}
+
+// Returns the retry policy in effect for this bundle
+func (z Bundle) retryPolicy() RetryPolicy {
+	if z.Retry != nil {
+		return *z.Retry
+	}
+	return DefaultRetryPolicy
+}
+
+// Returns true if a response with this status code is worth retrying
+func retryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// Returns how long to wait before the next attempt. A Retry-After header from the API takes
+// precedence, otherwise it is exponential backoff with full jitter, capped at MaxDelay.
+func (p RetryPolicy) delay(attempt int, r *http.Response) time.Duration {
+	if d, ok := retryAfter(r); ok {
+		if p.MaxDelay > 0 && d > p.MaxDelay {
+			return p.MaxDelay
+		}
+		return d
+	}
+	backoff := p.BaseDelay << (attempt - 1)
+	if backoff <= 0 || (p.MaxDelay > 0 && backoff > p.MaxDelay) {
+		backoff = p.MaxDelay // Also guards against shift overflow
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// Parses the retry hint headers Azure may return. Graph and ARM both use the standard Retry-After,
+// in either delay-seconds or HTTP-date form, while some services use the milliseconds variants.
+func retryAfter(r *http.Response) (time.Duration, bool) {
+	if r == nil {
+		return 0, false
+	}
+	for _, h := range []string{"retry-after-ms", "x-ms-retry-after-ms"} {
+		if v := r.Header.Get(h); v != "" {
+			if ms, err := strconv.ParseInt(v, 10, 64); err == nil && ms >= 0 {
+				return time.Duration(ms) * time.Millisecond, true
+			}
+		}
+	}
+	v := r.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,281 @@
+package maz
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/scrypt"
+)
+
+// SecretStore keeps sensitive values, like the MSAL token cache and client secrets, out of plain
+// text files. Get returns ErrSecretNotFound if there's nothing stored under given key.
+type SecretStore interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	Delete(key string) error
+}
+
+var ErrSecretNotFound = errors.New("secret not found")
+
+const (
+	ConstSecretRefPrefix  = "secretstore:" // Credentials file values with this prefix are read from the SecretStore
+	ConstKeyringService   = "maz"          // Service name under which the keyring entries are stored
+	fileSecretMagic       = "MAZ1"         // Format marker at the start of every encrypted file
+	fileSecretExt         = ".enc"
+	fileSecretSaltSize    = 16
+	fileSecretScryptCostN = 1 << 15
+)
+
+// Returns the SecretStore with given name, either "file" or "keyring". The "file" store keeps
+// encrypted files in z.ConfDir, using the key from MAZ_SECRET_KEY or the MAZ_SECRET_KEY_FILE file.
+func SecretStoreByName(name string, z Bundle) (SecretStore, error) {
+	switch strings.ToLower(name) {
+	case "file":
+		key, err := SecretKeyFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewFileSecretStore(z.ConfDir, key), nil
+	case "keyring":
+		return NewKeyringSecretStore(ConstKeyringService), nil
+	}
+	return nil, fmt.Errorf("unknown secret store '%s', must be 'file' or 'keyring'", name)
+}
+
+// Returns the encryption key for the file SecretStore, from the MAZ_SECRET_KEY environment variable,
+// or from the file named by MAZ_SECRET_KEY_FILE
+func SecretKeyFromEnv() ([]byte, error) {
+	if v := os.Getenv("MAZ_SECRET_KEY"); v != "" {
+		return []byte(v), nil
+	}
+	if keyFile := os.Getenv("MAZ_SECRET_KEY_FILE"); keyFile != "" {
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("[MAZ_SECRET_KEY_FILE] %w", err)
+		}
+		key = bytes.TrimSpace(key)
+		if len(key) == 0 {
+			return nil, fmt.Errorf("[MAZ_SECRET_KEY_FILE] %s is empty", keyFile)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("no secret key, set either MAZ_SECRET_KEY or MAZ_SECRET_KEY_FILE")
+}
+
+// Sets z.SecretStore to the one named by MAZ_SECRET_STORE, unless it's already set
+func setupSecretStore(z *Bundle) error {
+	if z.SecretStore != nil {
+		return nil
+	}
+	name := os.Getenv("MAZ_SECRET_STORE")
+	if name == "" {
+		return nil
+	}
+	store, err := SecretStoreByName(name, *z)
+	if err != nil {
+		return fmt.Errorf("[MAZ_SECRET_STORE] %w", err)
+	}
+	z.SecretStore = store
+	return nil
+}
+
+// Saves given secret in the secret store, if there is one, and returns the credentials file value
+// to use for it: a reference to the stored secret, or the secret itself if there's no store. The
+// secret is keyed by its name and the client ID, so that profiles for other apps don't clash.
+func storeSecret(z Bundle, name, value string) (string, error) {
+	if err := setupSecretStore(&z); err != nil {
+		return "", err
+	}
+	if z.SecretStore == nil || value == "" || strings.HasPrefix(value, ConstSecretRefPrefix) {
+		return value, nil
+	}
+	key := name + "." + z.ClientId
+	if err := z.SecretStore.Set(key, []byte(value)); err != nil {
+		return "", fmt.Errorf("saving %s: %w", name, err)
+	}
+	return ConstSecretRefPrefix + key, nil
+}
+
+// Returns the secret stored under the key in given credentials file value if it has the
+// ConstSecretRefPrefix, or the value itself otherwise
+func resolveSecret(store SecretStore, value string) (string, error) {
+	key, isRef := strings.CutPrefix(value, ConstSecretRefPrefix)
+	if !isRef {
+		return value, nil
+	}
+	if store == nil {
+		return "", fmt.Errorf("'%s' needs a secret store, set MAZ_SECRET_STORE", value)
+	}
+	secret, err := store.Get(key)
+	if err != nil {
+		return "", fmt.Errorf("'%s': %w", value, err)
+	}
+	return string(secret), nil
+}
+
+// FileSecretStore keeps each secret in its own AES-256-GCM encrypted file. The encryption key is
+// derived from the given passphrase with scrypt, using a random salt picked once per store. Since
+// scrypt is slow by design, derived keys are cached, so it only runs once per salt.
+type FileSecretStore struct {
+	dir        string
+	passphrase []byte
+	mu         sync.Mutex
+	salt       []byte                 // Salt for all writes, picked on the first one
+	ciphers    map[string]cipher.AEAD // Ciphers derived so far, keyed by salt
+}
+
+// Returns a file SecretStore keeping its files in given directory
+func NewFileSecretStore(dir string, passphrase []byte) *FileSecretStore {
+	return &FileSecretStore{dir: dir, passphrase: passphrase, ciphers: make(map[string]cipher.AEAD)}
+}
+
+// Returns the path of the file for given key
+func (s *FileSecretStore) path(key string) string {
+	return filepath.Join(s.dir, key+fileSecretExt)
+}
+
+// Returns the 256-bit AES-GCM cipher for the passphrase and salt, deriving it on first use
+func (s *FileSecretStore) cipher(salt []byte) (cipher.AEAD, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if aead, ok := s.ciphers[string(salt)]; ok {
+		return aead, nil
+	}
+	if s.salt == nil {
+		s.salt = bytes.Clone(salt) // Reuse it for writes, see writeSalt
+	}
+	key, err := scrypt.Key(s.passphrase, salt, fileSecretScryptCostN, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s.ciphers[string(salt)] = aead
+	return aead, nil
+}
+
+// Returns the salt for new writes, which is the first one read or else a random one, so that
+// rewriting a secret just read needs no other key derivation
+func (s *FileSecretStore) writeSalt() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.salt == nil {
+		salt := make([]byte, fileSecretSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		s.salt = salt
+	}
+	return s.salt, nil
+}
+
+// Decrypts and returns the secret stored under given key
+func (s *FileSecretStore) Get(key string) ([]byte, error) {
+	data, err := readFileLocked(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", key, ErrSecretNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	header := len(fileSecretMagic) + fileSecretSaltSize
+	if len(data) < header || string(data[:len(fileSecretMagic)]) != fileSecretMagic {
+		return nil, fmt.Errorf("[%s] not an encrypted secret file", s.path(key))
+	}
+	salt := data[len(fileSecretMagic):header]
+	aead, err := s.cipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	data = data[header:]
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("[%s] truncated secret file", s.path(key))
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, ciphertext, []byte(key)) // The key is authenticated too
+	if err != nil {
+		return nil, fmt.Errorf("[%s] decrypting secret, wrong key? %w", s.path(key), err)
+	}
+	return value, nil
+}
+
+// Encrypts and stores the secret under given key
+func (s *FileSecretStore) Set(key string, value []byte) error {
+	salt, err := s.writeSalt()
+	if err != nil {
+		return err
+	}
+	aead, err := s.cipher(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data := append([]byte(fileSecretMagic), salt...)
+	data = append(data, nonce...)
+	data = aead.Seal(data, nonce, value, []byte(key))
+	return writeFileLocked(s.path(key), data, 0600)
+}
+
+// Removes the secret stored under given key, if any
+func (s *FileSecretStore) Delete(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// KeyringSecretStore keeps secrets in the OS keyring: the Secret Service (GNOME Keyring, KWallet)
+// on Linux, the Keychain on macOS, and the Credential Manager on Windows. Note that the macOS and
+// Windows keyrings limit the size of each secret to a few kilobytes.
+type KeyringSecretStore struct {
+	service string
+}
+
+// Returns a keyring SecretStore, keeping its entries under given service name
+func NewKeyringSecretStore(service string) *KeyringSecretStore {
+	return &KeyringSecretStore{service: service}
+}
+
+// Returns the secret stored under given key
+func (s *KeyringSecretStore) Get(key string) ([]byte, error) {
+	value, err := keyring.Get(s.service, key)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return nil, fmt.Errorf("%s: %w", key, ErrSecretNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("keyring: %w", err)
+	}
+	return []byte(value), nil
+}
+
+// Stores the secret under given key
+func (s *KeyringSecretStore) Set(key string, value []byte) error {
+	if err := keyring.Set(s.service, key, string(value)); err != nil {
+		return fmt.Errorf("keyring: %w", err)
+	}
+	return nil
+}
+
+// Removes the secret stored under given key, if any
+func (s *KeyringSecretStore) Delete(key string) error {
+	if err := keyring.Delete(s.service, key); err != nil && !errors.Is(err, keyring.ErrNotFound) {
+		return fmt.Errorf("keyring: %w", err)
+	}
+	return nil
+}
@@ -8,11 +8,11 @@ import (
 	"github.com/queone/utl"
 )
 
-// Creates specfile skeleton/scaffold files
-func CreateSkeletonFile(t string) {
+// Creates specfile skeleton/scaffold files in the current directory
+func CreateSkeletonFile(t string) error {
 	pwd, err := os.Getwd()
 	if err != nil {
-		utl.Die(utl.Trace() + "Error: Getting CWD\n")
+		return fmt.Errorf("getting current directory: %w", err)
 	}
 	fileName, fileContent := "init-file-name.extension", []byte("init-file-content\n")
 	switch t {
@@ -79,13 +79,7 @@ func CreateSkeletonFile(t string) {
 	}
 	filePath := filepath.Join(pwd, fileName)
 	if utl.FileExist(filePath) {
-		utl.Die("Error: File " + fileName + " already exists.\n")
+		return fmt.Errorf("[%s] file already exists", filePath)
 	}
-	f, err := os.Create(filePath) // Create the file
-	if err != nil {
-		fmt.Println(err)
-	}
-	defer f.Close()
-	f.Write(fileContent) // Write the content
-	os.Exit(0)
+	return os.WriteFile(filePath, fileContent, 0644)
 }
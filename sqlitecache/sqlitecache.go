@@ -0,0 +1,410 @@
+// Package sqlitecache provides a maz.CacheStore that keeps the local object cache in an embedded
+// SQLite database, using a pure Go driver, so no cgo is needed. Each object type gets a table of its
+// own, with indexed id, displayName, appId and userPrincipalName columns, plus a trigram full-text
+// index over all the string values of each object. Delta query results are applied in place, and
+// the GetMatching* and GetIdMap* functions of the big MS Graph types become indexed queries.
+//
+//	store, err := sqlitecache.Open(filepath.Join(z.ConfDir, "cache.db"))
+//	if err != nil {
+//	    return err
+//	}
+//	defer store.Close()
+//	z.Cache = store
+package sqlitecache
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/queone/maz"
+	"github.com/queone/utl"
+	_ "modernc.org/sqlite" // Registers the "sqlite" driver
+)
+
+// Store is a maz.CacheStore, maz.CacheUpdater and maz.CacheQuerier backed by a SQLite database
+type Store struct {
+	db     *sql.DB
+	mu     sync.Mutex      // Guards tables
+	tables map[string]bool // Object types whose tables are known to exist
+}
+
+var (
+	_ maz.CacheStore   = (*Store)(nil)
+	_ maz.CacheUpdater = (*Store)(nil)
+	_ maz.CacheQuerier = (*Store)(nil)
+)
+
+// Object types become table names, so they are restricted to plain identifiers
+var validObjectType = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+// Opens, or creates, the SQLite database at given path
+func Open(path string) (*Store, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %w", path, err)
+	}
+	db.SetMaxOpenConns(1) // SQLite allows a single writer anyway, and this avoids SQLITE_BUSY within the process
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS cache_meta (
+		tenant_id   TEXT NOT NULL,
+		object_type TEXT NOT NULL,
+		saved_at    INTEGER,
+		delta_link  TEXT,
+		selection   TEXT,
+		linked_at   INTEGER,
+		PRIMARY KEY (tenant_id, object_type))`)
+	if err == nil {
+		err = addSelectionColumn(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("[%s] %w", path, err)
+	}
+	return &Store{db: db, tables: make(map[string]bool)}, nil
+}
+
+// Adds the selection column to a cache_meta table created before it existed
+func addSelectionColumn(db *sql.DB) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('cache_meta') WHERE name = 'selection'`).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE cache_meta ADD COLUMN selection TEXT`)
+	return err
+}
+
+// Closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Creates the table, indexes and full-text index of given object type, unless they already exist
+func (s *Store) ensureTable(objectType string) error {
+	if !validObjectType.MatchString(objectType) {
+		return fmt.Errorf("invalid object type '%s'", objectType)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tables[objectType] {
+		return nil
+	}
+	t := objectType
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS "` + t + `" (
+			seq                 INTEGER PRIMARY KEY,
+			tenant_id           TEXT NOT NULL,
+			id                  TEXT NOT NULL,
+			display_name        TEXT,
+			app_id              TEXT,
+			user_principal_name TEXT,
+			search              TEXT NOT NULL,
+			data                TEXT NOT NULL,
+			UNIQUE (tenant_id, id))`,
+		`CREATE INDEX IF NOT EXISTS "` + t + `_display_name" ON "` + t + `" (tenant_id, display_name)`,
+		`CREATE INDEX IF NOT EXISTS "` + t + `_app_id" ON "` + t + `" (tenant_id, app_id)`,
+		`CREATE INDEX IF NOT EXISTS "` + t + `_user_principal_name" ON "` + t + `" (tenant_id, user_principal_name)`,
+		// The full-text index reads its content from the table, and triggers keep it in step
+		`CREATE VIRTUAL TABLE IF NOT EXISTS "` + t + `_fts" USING fts5(search, content='` + t + `',
+			content_rowid='seq', tokenize='trigram')`,
+		`CREATE TRIGGER IF NOT EXISTS "` + t + `_ai" AFTER INSERT ON "` + t + `" BEGIN
+			INSERT INTO "` + t + `_fts" (rowid, search) VALUES (new.seq, new.search);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS "` + t + `_ad" AFTER DELETE ON "` + t + `" BEGIN
+			INSERT INTO "` + t + `_fts" ("` + t + `_fts", rowid, search) VALUES ('delete', old.seq, old.search);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS "` + t + `_au" AFTER UPDATE ON "` + t + `" BEGIN
+			INSERT INTO "` + t + `_fts" ("` + t + `_fts", rowid, search) VALUES ('delete', old.seq, old.search);
+			INSERT INTO "` + t + `_fts" (rowid, search) VALUES (new.seq, new.search);
+		END`,
+	}
+	for _, stmt := range statements {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("[%s] %w", t, err)
+		}
+	}
+	s.tables[t] = true
+	return nil
+}
+
+func (s *Store) Load(tenantId, objectType string) ([]interface{}, error) {
+	if err := s.ensureTable(objectType); err != nil {
+		return nil, err
+	}
+	if s.Age(tenantId, objectType) == 0 {
+		return nil, nil
+	}
+	return s.query(`SELECT data FROM "`+objectType+`" WHERE tenant_id = ? ORDER BY seq`, tenantId)
+}
+
+func (s *Store) Save(tenantId, objectType string, list []interface{}) error {
+	return s.write(tenantId, objectType, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM "`+objectType+`" WHERE tenant_id = ?`, tenantId); err != nil {
+			return err
+		}
+		return upsert(tx, tenantId, objectType, list, false)
+	})
+}
+
+// Applies the changes of a delta query in place. See maz.CacheUpdater.
+func (s *Store) Update(tenantId, objectType string, mergeSet []interface{}, deletedIds []string) error {
+	return s.write(tenantId, objectType, func(tx *sql.Tx) error {
+		for _, id := range deletedIds {
+			if _, err := tx.Exec(`DELETE FROM "`+objectType+`" WHERE tenant_id = ? AND id = ?`, tenantId, id); err != nil {
+				return err
+			}
+		}
+		return upsert(tx, tenantId, objectType, mergeSet, true)
+	})
+}
+
+// Runs given changes to an object type's table in a single transaction, recording the save time
+func (s *Store) write(tenantId, objectType string, changes func(tx *sql.Tx) error) error {
+	if err := s.ensureTable(objectType); err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("[%s] %w", objectType, err)
+	}
+	defer tx.Rollback() // No-op once committed
+	if err := changes(tx); err != nil {
+		return fmt.Errorf("[%s] %w", objectType, err)
+	}
+	_, err = tx.Exec(`INSERT INTO cache_meta (tenant_id, object_type, saved_at) VALUES (?, ?, ?)
+		ON CONFLICT (tenant_id, object_type) DO UPDATE SET saved_at = excluded.saved_at`,
+		tenantId, objectType, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("[%s] %w", objectType, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("[%s] %w", objectType, err)
+	}
+	return nil
+}
+
+// Inserts given objects, replacing any existing ones with the same ID, or merging into them if
+// merge is true. Replaced and merged objects keep their place in the list order.
+func upsert(tx *sql.Tx, tenantId, objectType string, list []interface{}, merge bool) error {
+	stmt, err := tx.Prepare(`INSERT INTO "` + objectType + `"
+		(tenant_id, id, display_name, app_id, user_principal_name, search, data) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (tenant_id, id) DO UPDATE SET display_name = excluded.display_name,
+		app_id = excluded.app_id, user_principal_name = excluded.user_principal_name,
+		search = excluded.search, data = excluded.data`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, i := range list {
+		x, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id := objectId(x)
+		if merge {
+			var data string
+			var existing map[string]interface{} // Stays nil for new objects
+			err := tx.QueryRow(`SELECT data FROM "`+objectType+`" WHERE tenant_id = ? AND id = ?`, tenantId, id).Scan(&data)
+			if err == nil {
+				if err := json.Unmarshal([]byte(data), &existing); err != nil {
+					return err
+				}
+			} else if err != sql.ErrNoRows {
+				return err
+			}
+			x = maz.MergeDeltaObject(existing, x)
+		}
+		data, err := json.Marshal(x)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.Exec(tenantId, id, nullString(x["displayName"]), nullString(x["appId"]),
+			nullString(x["userPrincipalName"]), searchText(x), string(data))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) DeltaLink(tenantId, objectType string) (string, string, int64, error) {
+	var deltaLink, selection sql.NullString
+	var linkedAt sql.NullInt64
+	err := s.db.QueryRow(`SELECT delta_link, selection, linked_at FROM cache_meta WHERE tenant_id = ? AND object_type = ?`,
+		tenantId, objectType).Scan(&deltaLink, &selection, &linkedAt)
+	if err == sql.ErrNoRows || (err == nil && !linkedAt.Valid) {
+		return "", "", 0, nil
+	} else if err != nil {
+		return "", "", 0, fmt.Errorf("[%s] %w", objectType, err)
+	}
+	return deltaLink.String, selection.String, time.Now().Unix() - linkedAt.Int64, nil
+}
+
+func (s *Store) SaveDeltaLink(tenantId, objectType, deltaLink, selection string) error {
+	_, err := s.db.Exec(`INSERT INTO cache_meta (tenant_id, object_type, delta_link, selection, linked_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (tenant_id, object_type) DO UPDATE SET delta_link = excluded.delta_link,
+			selection = excluded.selection, linked_at = excluded.linked_at`,
+		tenantId, objectType, deltaLink, selection, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("[%s] %w", objectType, err)
+	}
+	return nil
+}
+
+func (s *Store) Age(tenantId, objectType string) int64 {
+	var savedAt sql.NullInt64
+	err := s.db.QueryRow(`SELECT saved_at FROM cache_meta WHERE tenant_id = ? AND object_type = ?`,
+		tenantId, objectType).Scan(&savedAt)
+	if err != nil || !savedAt.Valid {
+		return 0
+	}
+	return max(time.Now().Unix()-savedAt.Int64, 1) // Zero would mean not cached
+}
+
+func (s *Store) Remove(tenantId, objectType string) error {
+	objectTypes := []string{objectType}
+	if objectType == "" {
+		rows, err := s.db.Query(`SELECT object_type FROM cache_meta WHERE tenant_id = ?`, tenantId)
+		if err != nil {
+			return err
+		}
+		objectTypes = nil
+		for rows.Next() {
+			var t string
+			if err := rows.Scan(&t); err != nil {
+				rows.Close()
+				return err
+			}
+			objectTypes = append(objectTypes, t)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	for _, t := range objectTypes {
+		if err := s.ensureTable(t); err != nil {
+			return err
+		}
+		if _, err := s.db.Exec(`DELETE FROM "`+t+`" WHERE tenant_id = ?`, tenantId); err != nil {
+			return fmt.Errorf("[%s] %w", t, err)
+		}
+		if _, err := s.db.Exec(`DELETE FROM cache_meta WHERE tenant_id = ? AND object_type = ?`, tenantId, t); err != nil {
+			return fmt.Errorf("[%s] %w", t, err)
+		}
+	}
+	return nil
+}
+
+// Returns the objects with any string value containing filter, ignoring case. Filters of three or
+// more characters use the trigram index, shorter ones scan the table. See maz.CacheQuerier.
+func (s *Store) Search(tenantId, objectType, filter string) ([]interface{}, error) {
+	if err := s.ensureTable(objectType); err != nil {
+		return nil, err
+	}
+	pattern := "*" + globEscaper.Replace(strings.ToLower(filter)) + "*"
+	return s.query(searchQuery(objectType, len([]rune(filter)) >= 3), tenantId, pattern)
+}
+
+// Returns the query Search runs, taking the tenant ID and GLOB pattern as arguments, which goes
+// through the trigram index if indexed is true. It's GLOB rather than LIKE, since SQLite doesn't let
+// the index handle a LIKE with an ESCAPE clause, and the search text is lowercased anyway.
+func searchQuery(objectType string, indexed bool) string {
+	if indexed {
+		return `SELECT data FROM "` + objectType + `" WHERE tenant_id = ? AND seq IN
+			(SELECT rowid FROM "` + objectType + `_fts" WHERE search GLOB ?) ORDER BY seq`
+	}
+	return `SELECT data FROM "` + objectType + `" WHERE tenant_id = ? AND search GLOB ? ORDER BY seq`
+}
+
+// Returns the id:displayName pairs of all objects having a displayName. See maz.CacheQuerier.
+func (s *Store) IdMap(tenantId, objectType string) (map[string]string, error) {
+	if err := s.ensureTable(objectType); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT id, display_name FROM "`+objectType+`"
+		WHERE tenant_id = ? AND display_name IS NOT NULL`, tenantId)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %w", objectType, err)
+	}
+	defer rows.Close()
+	nameMap := make(map[string]string)
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, fmt.Errorf("[%s] %w", objectType, err)
+		}
+		nameMap[id] = name
+	}
+	return nameMap, rows.Err()
+}
+
+// Runs given query, which must select a single data column, and returns the decoded objects
+func (s *Store) query(query string, args ...interface{}) ([]interface{}, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []interface{} = nil
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var x map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &x); err != nil {
+			return nil, err
+		}
+		list = append(list, x)
+	}
+	return list, rows.Err()
+}
+
+// Escapes the GLOB wildcards, so filters match literally
+var globEscaper = strings.NewReplacer(`*`, `[*]`, `?`, `[?]`, `[`, `[[]`)
+
+// Returns the ID of given object. Azure RBAC objects all have one, but MS Graph ones may lack it in
+// some delta results, in which case the name is the next best thing.
+func objectId(x map[string]interface{}) string {
+	if id := utl.Str(x["id"]); id != "" {
+		return id
+	}
+	return utl.Str(x["name"])
+}
+
+// Returns given value as a string, or nil if it's not one, so it's stored as NULL
+func nullString(v interface{}) interface{} {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return nil
+}
+
+// Returns the lowercased string values of given object, one per line, for the full-text index
+func searchText(x interface{}) string {
+	var b strings.Builder
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch value := v.(type) {
+		case string:
+			b.WriteString(strings.ToLower(value))
+			b.WriteByte('\n')
+		case []interface{}:
+			for _, i := range value {
+				walk(i)
+			}
+		case map[string]interface{}:
+			for _, i := range value {
+				walk(i)
+			}
+		}
+	}
+	walk(x)
+	return b.String()
+}
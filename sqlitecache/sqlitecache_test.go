@@ -0,0 +1,160 @@
+package sqlitecache
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/queone/maz"
+	"github.com/queone/utl"
+)
+
+const tenantId = "11111111-1111-1111-1111-111111111111"
+
+// Returns a new store in a temporary directory, which is closed when the test ends
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// Returns the IDs of given objects, in order
+func objectIds(list []interface{}) (ids []string) {
+	for _, i := range list {
+		ids = append(ids, utl.Str(i.(map[string]interface{})["id"]))
+	}
+	return ids
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	s := openTestStore(t)
+	member := func(id string, removed bool) map[string]interface{} {
+		m := map[string]interface{}{"id": id, "@odata.type": "#microsoft.graph.user"}
+		if removed {
+			m["@removed"] = map[string]interface{}{"reason": "deleted"}
+		}
+		return m
+	}
+	baseSet := []interface{}{
+		map[string]interface{}{"id": "a", "displayName": "Alpha", "mail": "alpha@contoso.com"},
+		map[string]interface{}{"id": "b", "displayName": "Bravo",
+			"members@delta": []interface{}{member("u1", false), member("u2", false)}},
+		map[string]interface{}{"id": "c", "displayName": "Charlie"},
+		map[string]interface{}{"id": "d", "displayName": "Dev*Ops"},
+	}
+	if err := s.Save(tenantId, "groups", baseSet); err != nil {
+		t.Fatal(err)
+	}
+	if s.Age(tenantId, "groups") == 0 {
+		t.Error("Age = 0 after Save")
+	}
+	list, err := s.Load(tenantId, "groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, baseSet) {
+		t.Errorf("Load = %v, want %v", list, baseSet)
+	}
+
+	deltaSet := []interface{}{
+		map[string]interface{}{"id": "a", "displayName": "Alpha2"},
+		map[string]interface{}{"id": "b", "members@delta": []interface{}{member("u1", true), member("u3", false)}},
+		map[string]interface{}{"id": "c", "@removed": map[string]interface{}{"reason": "deleted"}},
+		map[string]interface{}{"id": "d", "@removed": map[string]interface{}{"reason": "changed"}},
+		map[string]interface{}{"id": "e", "displayName": "DevXOps"},
+	}
+	mergeSet, deletedIds := maz.SplitDeltaSet(deltaSet)
+	if err := s.Update(tenantId, "groups", mergeSet, deletedIds); err != nil {
+		t.Fatal(err)
+	}
+	list, err = s.Load(tenantId, "groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := objectIds(list); !reflect.DeepEqual(got, []string{"a", "b", "e"}) {
+		t.Fatalf("ids = %v, want [a b e]", got)
+	}
+	a := list[0].(map[string]interface{})
+	if a["displayName"] != "Alpha2" || a["mail"] != "alpha@contoso.com" {
+		t.Errorf("a = %v, want displayName updated and mail kept", a)
+	}
+	b := list[1].(map[string]interface{})
+	if got := objectIds(b["members@delta"].([]interface{})); !reflect.DeepEqual(got, []string{"u2", "u3"}) {
+		t.Errorf("b members = %v, want [u2 u3]", got)
+	}
+
+	for _, tt := range []struct {
+		filter string
+		want   []string
+	}{
+		{"ALPHA2", []string{"a"}},           // Indexed, ignoring case
+		{"contoso.com", []string{"a"}},      // Any string value
+		{"ops", []string{"e"}},              // The removed d is gone from the index too
+		{"x", []string{"e"}},                // Too short for the index
+		{"v*o", nil},                        // Wildcards match literally
+		{"charlie", nil},                    // Deleted
+		{"#microsoft.graph", []string{"b"}}, // Nested values
+	} {
+		list, err := s.Search(tenantId, "groups", tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := objectIds(list); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Search(%q) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	nameMap, err := s.IdMap(tenantId, "groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "Alpha2", "b": "Bravo", "e": "DevXOps"}
+	if !reflect.DeepEqual(nameMap, want) {
+		t.Errorf("IdMap = %v, want %v", nameMap, want)
+	}
+
+	if err := s.SaveDeltaLink(tenantId, "groups", "https://graph/delta?token=x", "displayName,id"); err != nil {
+		t.Fatal(err)
+	}
+	deltaLink, selection, _, err := s.DeltaLink(tenantId, "groups")
+	if err != nil || deltaLink != "https://graph/delta?token=x" || selection != "displayName,id" {
+		t.Errorf("DeltaLink = %q, %q, %v", deltaLink, selection, err)
+	}
+	if err := s.Remove(tenantId, ""); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := s.Load(tenantId, "groups"); list != nil {
+		t.Errorf("Load after Remove = %v, want nil", list)
+	}
+}
+
+func TestSearchUsesTrigramIndex(t *testing.T) {
+	s := openTestStore(t)
+	if err := s.ensureTable("users"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := s.db.Query("EXPLAIN QUERY PLAN "+searchQuery("users", true), tenantId, "*abc*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			t.Fatal(err)
+		}
+		plan = append(plan, detail)
+	}
+	// FTS5 reports a GLOB constraint it handles as "G" plus the column number in its index string,
+	// whereas a bare "INDEX 0:" means it scans the whole full-text table
+	if !strings.Contains(strings.Join(plan, "\n"), "users_fts VIRTUAL TABLE INDEX 0:G0") {
+		t.Errorf("Search doesn't use the trigram index, plan:\n%s", strings.Join(plan, "\n"))
+	}
+}
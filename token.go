@@ -2,40 +2,52 @@ package maz
 
 import (
 	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
 	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
 	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/public"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/queone/utl"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 // Initiates an Azure JWT token acquisition with provided parameters, using a Username and a browser
 // pop up window. This is the 'Public' app auth flow and is documented at:
 // https://github.com/AzureAD/microsoft-authentication-library-for-go/blob/dev/apps/public/public.go
 func GetTokenInteractively(scopes []string, confDir, tokenFile, authorityUrl, username string) (token string, err error) {
-	// Set up token cache storage file and accessor
-	cacheFilePath := filepath.Join(confDir, tokenFile)
-	cacheAccessor := &TokenCache{cacheFilePath}
-	ctx := context.Background()
+	return GetTokenInteractivelyCtx(context.Background(), scopes, confDir, tokenFile, authorityUrl, username)
+}
+
+// Context-aware version of GetTokenInteractively
+func GetTokenInteractivelyCtx(ctx context.Context, scopes []string, confDir, tokenFile, authorityUrl, username string) (token string, err error) {
+	cacheAccessor, err := newTokenCache(confDir, tokenFile)
+	if err != nil {
+		return "", err
+	}
+	return getTokenInteractively(ctx, scopes, cacheAccessor, authorityUrl, username, false)
+}
 
+// Interactive login, keeping the MSAL token cache in given accessor. If forceRefresh is true, the
+// cached token is skipped and the user logs in again.
+func getTokenInteractively(ctx context.Context, scopes []string, cacheAccessor cache.ExportReplace, authorityUrl, username string, forceRefresh bool) (token string, err error) {
 	// Note we're using constant ConstAzPowerShellClientId for interactive login
 	app, err := public.New(ConstAzPowerShellClientId, public.WithAuthority(authorityUrl), public.WithCache(cacheAccessor))
 	if err != nil {
-		PrintApiErrMsg(err.Error())
-		utl.Die("")
+		return "", fmt.Errorf("creating public client: %w", err)
 	}
 
 	// Use 'username' variable to locate/select the cached account
 	var targetAccount public.Account
 	accounts, err := app.Accounts(ctx)
 	if err != nil {
-		PrintApiErrMsg(err.Error())
-		utl.Die("")
+		return "", fmt.Errorf("reading cached accounts: %w", err)
 	}
 	for _, i := range accounts {
 		if strings.ToLower(i.PreferredUsername) == username {
@@ -44,21 +56,81 @@ func GetTokenInteractively(scopes []string, confDir, tokenFile, authorityUrl, us
 		}
 	}
 
-	// Try getting cached token 1st
-	result, err := app.AcquireTokenSilent(ctx, scopes, public.WithSilentAccount(targetAccount))
-	if err != nil {
+	// Try getting cached token 1st, unless it was rejected
+	var result public.AuthResult
+	if !forceRefresh {
+		result, err = app.AcquireTokenSilent(ctx, scopes, public.WithSilentAccount(targetAccount))
+	}
+	if forceRefresh || err != nil {
 		// If for whatever reason getting a cached token didn't work, then let's get a fresh token
 		result, err = app.AcquireTokenInteractive(ctx, scopes)
 		// app.AcquireTokenInteractive uses the default web browser to select the account and acquire a
 		// security token from the authority.
 
-		// Note that this obviously does not work from within a VM environment.
-		// TODO: Allow use of app.AcquireByDeviceCodeOption or app.AcquireByAuthCodeOption, which
-		// would allow interactive login from a virtualize environment.
+		// Note that this obviously does not work from within a VM environment, for which
+		// GetTokenByDeviceCode should be used instead.
+
+		if err != nil {
+			return "", fmt.Errorf("acquiring token interactively: %w", err)
+		}
+	}
+	return result.AccessToken, nil // Return only the AccessToken, which is of type string
+}
+
+// Initiates an Azure JWT token acquisition with provided parameters, using the device code flow. It
+// prints the verification URL and code, then polls until the user completes the login from any
+// other device with a browser. Useful in VMs, containers, or over SSH. It shares the same token
+// cache file as GetTokenInteractively.
+func GetTokenByDeviceCode(scopes []string, confDir, tokenFile, authorityUrl, username string) (token string, err error) {
+	return GetTokenByDeviceCodeCtx(context.Background(), scopes, confDir, tokenFile, authorityUrl, username)
+}
+
+// Context-aware version of GetTokenByDeviceCode. Cancelling the context stops the polling.
+func GetTokenByDeviceCodeCtx(ctx context.Context, scopes []string, confDir, tokenFile, authorityUrl, username string) (token string, err error) {
+	cacheAccessor, err := newTokenCache(confDir, tokenFile)
+	if err != nil {
+		return "", err
+	}
+	return getTokenByDeviceCode(ctx, scopes, cacheAccessor, authorityUrl, username, false)
+}
+
+// Device code login, keeping the MSAL token cache in given accessor. If forceRefresh is true, the
+// cached token is skipped and the user logs in again.
+func getTokenByDeviceCode(ctx context.Context, scopes []string, cacheAccessor cache.ExportReplace, authorityUrl, username string, forceRefresh bool) (token string, err error) {
+	// Note we're using constant ConstAzPowerShellClientId, same as for browser interactive login
+	app, err := public.New(ConstAzPowerShellClientId, public.WithAuthority(authorityUrl), public.WithCache(cacheAccessor))
+	if err != nil {
+		return "", fmt.Errorf("creating public client: %w", err)
+	}
+
+	// Use 'username' variable to locate/select the cached account
+	var targetAccount public.Account
+	accounts, err := app.Accounts(ctx)
+	if err != nil {
+		return "", fmt.Errorf("reading cached accounts: %w", err)
+	}
+	for _, i := range accounts {
+		if strings.ToLower(i.PreferredUsername) == username {
+			targetAccount = i
+			break
+		}
+	}
 
+	// Try getting cached token 1st, unless it was rejected
+	var result public.AuthResult
+	if !forceRefresh {
+		result, err = app.AcquireTokenSilent(ctx, scopes, public.WithSilentAccount(targetAccount))
+	}
+	if forceRefresh || err != nil {
+		// If for whatever reason getting a cached token didn't work, then let's get a fresh token
+		deviceCode, err := app.AcquireTokenByDeviceCode(ctx, scopes)
+		if err != nil {
+			return "", fmt.Errorf("requesting device code: %w", err)
+		}
+		fmt.Println(utl.Yel(deviceCode.Result.Message))    // Tells the user which URL to visit and code to enter
+		result, err = deviceCode.AuthenticationResult(ctx) // Blocks, polling until login completes or expires
 		if err != nil {
-			PrintApiErrMsg(err.Error())
-			utl.Die("")
+			return "", fmt.Errorf("acquiring token by device code: %w", err)
 		}
 	}
 	return result.AccessToken, nil // Return only the AccessToken, which is of type string
@@ -68,40 +140,154 @@ func GetTokenInteractively(scopes []string, confDir, tokenFile, authorityUrl, us
 // Client Secret. This is the 'Confidential' app auth flow and is documented at:
 // https://github.com/AzureAD/microsoft-authentication-library-for-go/blob/dev/apps/confidential/confidential.go
 func GetTokenByCredentials(scopes []string, confDir, tokenFile, authorityUrl, clientId, clientSecret string) (token string, err error) {
-	// Set up token cache storage file and accessor
-	cacheFilePath := filepath.Join(confDir, tokenFile)
-	cacheAccessor := &TokenCache{cacheFilePath}
-	ctx := context.Background()
+	return GetTokenByCredentialsCtx(context.Background(), scopes, confDir, tokenFile, authorityUrl, clientId, clientSecret)
+}
 
+// Context-aware version of GetTokenByCredentials
+func GetTokenByCredentialsCtx(ctx context.Context, scopes []string, confDir, tokenFile, authorityUrl, clientId, clientSecret string) (token string, err error) {
 	// Initializing the client credential
 	cred, err := confidential.NewCredFromSecret(clientSecret)
 	if err != nil {
-		fmt.Println("Could not create a cred object from client_secret.")
+		return "", fmt.Errorf("creating credential from client_secret: %w", err)
+	}
+	cacheAccessor, err := newTokenCache(confDir, tokenFile)
+	if err != nil {
+		return "", err
+	}
+	return getConfidentialToken(ctx, scopes, cacheAccessor, authorityUrl, clientId, false, cred)
+}
+
+// Initiates an Azure JWT token acquisition with provided parameters, using a Client ID plus a
+// certificate, in PEM or PFX/PKCS#12 format, optionally password protected. The x5c certificate
+// chain is always sent, so that apps configured for subject name + issuer auth also work.
+func GetTokenByCertificate(scopes []string, confDir, tokenFile, authorityUrl, clientId, certPath, certPassword string) (token string, err error) {
+	return GetTokenByCertificateCtx(context.Background(), scopes, confDir, tokenFile, authorityUrl, clientId, certPath, certPassword)
+}
+
+// Context-aware version of GetTokenByCertificate
+func GetTokenByCertificateCtx(ctx context.Context, scopes []string, confDir, tokenFile, authorityUrl, clientId, certPath, certPassword string) (token string, err error) {
+	cred, err := certificateCredential(certPath, certPassword)
+	if err != nil {
+		return "", err
+	}
+	cacheAccessor, err := newTokenCache(confDir, tokenFile)
+	if err != nil {
+		return "", err
+	}
+	return getConfidentialToken(ctx, scopes, cacheAccessor, authorityUrl, clientId, false, cred, confidential.WithX5C())
+}
+
+// Returns the accessor for the MSAL token cache in given file, keeping it in the secret store set up
+// through MAZ_SECRET_STORE, if any, same as the logins driven by a Bundle do
+func newTokenCache(confDir, tokenFile string) (*TokenCache, error) {
+	z := Bundle{ConfDir: confDir}
+	if err := setupSecretStore(&z); err != nil {
+		return nil, err
+	}
+	return NewTokenCache(filepath.Join(confDir, tokenFile), z.SecretStore), nil
+}
+
+// Returns a confidential client credential for given certificate file
+func certificateCredential(certPath, certPassword string) (confidential.Credential, error) {
+	certs, key, err := LoadCertificate(certPath, certPassword)
+	if err != nil {
+		return confidential.Credential{}, err
 	}
+	cred, err := confidential.NewCredFromCert(certs, key)
+	if err != nil {
+		return confidential.Credential{}, fmt.Errorf("creating credential from certificate: %w", err)
+	}
+	return cred, nil
+}
+
+// Initiates an Azure JWT token acquisition with provided parameters, using a Client ID plus a
+// federated token (OIDC workload identity federation), as provided by Kubernetes or GitHub Actions.
+// The federated token file is re-read on every token request, since those tokens are short lived
+// and get rotated by the platform.
+func GetTokenByFederatedToken(scopes []string, confDir, tokenFile, authorityUrl, clientId, federatedTokenFile string) (token string, err error) {
+	return GetTokenByFederatedTokenCtx(context.Background(), scopes, confDir, tokenFile, authorityUrl, clientId, federatedTokenFile)
+}
+
+// Context-aware version of GetTokenByFederatedToken
+func GetTokenByFederatedTokenCtx(ctx context.Context, scopes []string, confDir, tokenFile, authorityUrl, clientId, federatedTokenFile string) (token string, err error) {
+	cacheAccessor, err := newTokenCache(confDir, tokenFile)
+	if err != nil {
+		return "", err
+	}
+	return getConfidentialToken(ctx, scopes, cacheAccessor, authorityUrl, clientId, false, federatedTokenCredential(federatedTokenFile))
+}
+
+// Returns a confidential client credential that re-reads given federated token file every time
+func federatedTokenCredential(federatedTokenFile string) confidential.Credential {
+	return confidential.NewCredFromAssertionCallback(func(context.Context, confidential.AssertionRequestOptions) (string, error) {
+		assertion, err := os.ReadFile(federatedTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("reading federated token: %w", err)
+		}
+		return strings.TrimSpace(string(assertion)), nil
+	})
+}
 
+// Acquires a token with given confidential client credential, trying the token cache first, unless
+// forceRefresh is true. This is the 'Confidential' app auth flow shared by all automated login methods.
+func getConfidentialToken(ctx context.Context, scopes []string, cacheAccessor cache.ExportReplace, authorityUrl, clientId string, forceRefresh bool, cred confidential.Credential, opts ...confidential.Option) (token string, err error) {
 	// Automated login obviously uses the registered app client_id (App ID)
-	app, err := confidential.New(authorityUrl, clientId, cred, confidential.WithCache(cacheAccessor))
+	opts = append(opts, confidential.WithCache(cacheAccessor))
+	app, err := confidential.New(authorityUrl, clientId, cred, opts...)
 	if err != nil {
-		PrintApiErrMsg(err.Error())
-		utl.Die("")
+		return "", fmt.Errorf("creating confidential client: %w", err)
 	}
 
-	// Try getting cached token 1st
+	// Try getting cached token 1st, unless it was rejected
 	// targetAccount not required, as it appears to locate existing cached tokens without it
-	result, err := app.AcquireTokenSilent(ctx, scopes)
-	if err != nil {
+	var result confidential.AuthResult
+	if !forceRefresh {
+		result, err = app.AcquireTokenSilent(ctx, scopes)
+	}
+	if forceRefresh || err != nil {
 		// If for whatever reason getting a cached token didn't work, then let's get a fresh token
 		result, err = app.AcquireTokenByCredential(ctx, scopes)
 		// AcquireTokenByCredential acquires a security token from the authority, using the client credentials grant
 		if err != nil {
-			PrintApiErrMsg(err.Error())
-			utl.Die("")
+			return "", fmt.Errorf("acquiring token by credential: %w", err)
 		}
 	}
 	return result.AccessToken, nil // Return only the AccessToken, which is of type string
 }
 
+// Loads the certificate chain and private key from a PEM, or a PFX/PKCS#12 file (.pfx or .p12
+// extension). The password can be empty if the file is not protected.
+func LoadCertificate(certPath, certPassword string) (certs []*x509.Certificate, key crypto.PrivateKey, err error) {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading certificate: %w", err)
+	}
+	ext := strings.ToLower(filepath.Ext(certPath))
+	if ext == ".pfx" || ext == ".p12" {
+		return decodePfx(certPath, data, certPassword)
+	}
+	certs, key, err = confidential.CertFromPEM(data, certPassword)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[%s] decoding PEM certificate: %w", certPath, err)
+	}
+	return certs, key, nil
+}
+
+// Decodes the certificate chain and private key from PFX/PKCS#12 data. Only RSA keys are accepted,
+// since those are the only ones MSAL can sign client assertions with.
+func decodePfx(certPath string, data []byte, certPassword string) (certs []*x509.Certificate, key crypto.PrivateKey, err error) {
+	key, cert, caCerts, err := pkcs12.DecodeChain(data, certPassword)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[%s] decoding PFX certificate: %w", certPath, err)
+	}
+	if _, ok := key.(*rsa.PrivateKey); !ok {
+		return nil, nil, fmt.Errorf("[%s] PFX certificate has a %T private key, but only RSA keys are supported", certPath, key)
+	}
+	return append([]*x509.Certificate{cert}, caCerts...), key, nil
+}
+
 // Does a very basic validation of the JWT token as defined in https://tools.ietf.org/html/rfc7519
+// Use a TokenVerifier to actually verify a token's signature and claims.
 func TokenValid(tokenString string) bool {
 	if tokenString == "" || (!strings.HasPrefix(tokenString, "eyJ") && !strings.Contains(tokenString, ".")) {
 		return false
@@ -109,39 +295,20 @@ func TokenValid(tokenString string) bool {
 	return true
 }
 
-// Decode and dump token string, trusting without formaly verification and validation
-func DecodeJwtToken(tokenString string) {
+// Decode and dump token string, trusting without formaly verification and validation. Use
+// ParseToken to inspect the claims programmatically.
+func DecodeJwtToken(tokenString string) error {
 
 	// A JSON Web Token (JWT) consists of three parts which are separated using .(dot):
 	// Header: It indicates the token’s type and which signing algorithm has been used.
 	// Payload: It consists of the claims. And claims comprise of application’s data( email id,
 	//          username, role), the expiration period of a token (Exp), and so on.
 	// Signature: It is generated using the secret (provided by the user), encoded header, and payload.
-	//
-	// Token struct fields:
-	//   Raw       string                 // The raw token. Populated when you Parse a token
-	//   Method    SigningMethod          // The signing method used or to be used
-	//   Header    map[string]interface{} // The first segment of the token
-	//   Claims    Claims                 // The second segment of the token
-	//   Signature string                 // The third segment of the token. Populated when you Parse a token
-	//   Valid     bool                   // Is the token valid? Populated when you Parse/Verify a token
-
-	if !TokenValid(tokenString) {
-		utl.Die(utl.Red("Invalid token: Does not start with 'eyJ', contain any '.', or it's empty.\n"))
-	}
-
-	// Parse the token without verifying the signature
-	claims := jwt.MapClaims{} // claims are actually a map[string]interface{}
-	token, _ := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte("<YOUR VERIFICATION KEY>"), nil
-	})
-	// // Below no yet needed, since this is only printing claims in an unverified way
-	// if err != nil {
-	// 	fmt.Println(utl.Red("Token is invalid: " + err.Error()))
-	// }
-	// if token == nil {
-	// 	fmt.Println(utl.Red("Error parsing token: " + err.Error()))
-	// }
+
+	token, err := ParseToken(tokenString)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println(utl.Blu("header") + ":")
 
@@ -152,9 +319,9 @@ func DecodeJwtToken(tokenString string) {
 	}
 
 	fmt.Println(utl.Blu("claims") + ":")
-	sortedKeys = utl.SortObjStringKeys(token.Claims.(jwt.MapClaims))
+	sortedKeys = utl.SortObjStringKeys(token.Claims)
 	for _, k := range sortedKeys {
-		v := token.Claims.(jwt.MapClaims)[k]
+		v := token.Claims[k]
 		vType := utl.GetType(v)
 		switch vType {
 		case "string":
@@ -176,20 +343,19 @@ func DecodeJwtToken(tokenString string) {
 	}
 
 	fmt.Println(utl.Blu("signature") + ":")
-	if string(token.Signature) != "" {
+	if token.Signature != "" {
 		k := "signature"
 		fmt.Printf("  %s:%s %s\n", utl.Blu(k), utl.PadSpaces(20, len(k)), utl.Gre(token.Signature))
 	}
 
 	fmt.Println(utl.Blu("status") + ":")
 	k := "valid"
-	vStr := ""
-	if token.Valid {
-		vStr = utl.Gre("true")
-	} else {
-		vStr = utl.Gre("false") + "  # Since this parsing isn't verifying it"
+	vStr := utl.Gre("false") + "  # Since this parsing isn't verifying it"
+	if token.Expired() {
+		vStr = utl.Red("false") + "  # Expired, or not valid yet"
 	}
 	fmt.Printf("  %s:%s %s\n", utl.Blu(k), utl.PadSpaces(20, len(k)), vStr)
-
-	os.Exit(0)
+	k = "expires_in"
+	fmt.Printf("  %s:%s %s\n", utl.Blu(k), utl.PadSpaces(20, len(k)), utl.Gre(token.ExpiresIn().Round(time.Second).String()))
+	return nil
 }
@@ -4,7 +4,8 @@
 // One can base one's own cache accessor on below examples:
 //   https://github.com/AzureAD/microsoft-authentication-library-for-go/blob/v1.2.2/apps/tests/integration/cache_accessor.go
 //   https://github.com/AzureAD/microsoft-authentication-library-for-go/blob/v1.2.2/apps/tests/devapps/sample_cache_accessor.go
-// This file is just a verbatim copy of above 'cache_accessor.go'.
+// This file started as a verbatim copy of above 'cache_accessor.go', and can now also keep the
+// cache in a SecretStore instead of a plain text file.
 
 // Copyright (c) Microsoft Corporation.
 // Licensed under the MIT license.
@@ -12,35 +13,188 @@
 package maz
 
 import (
+	"bytes"
 	"context"
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
 )
 
 type TokenCache struct {
-	file string
+	file   string
+	store  SecretStore // If set, the cache is kept in here, under the base name of file
+	mu     sync.Mutex
+	loaded []byte // Cache data as last loaded by Replace, to merge with any changes made since
+}
+
+// Returns a token cache accessor for given file, which is kept in the store instead if not nil
+func NewTokenCache(file string, store SecretStore) *TokenCache {
+	return &TokenCache{file: file, store: store}
+}
+
+// Returns the cache data, from the store if there is one. A missing cache is returned as empty.
+func (t *TokenCache) read() ([]byte, error) {
+	if t.store != nil {
+		return t.readStore()
+	}
+	data, err := readFileLocked(t.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil // No cache yet
+	}
+	return data, err
+}
+
+// Returns the cache data from the store. A missing cache is returned as empty.
+func (t *TokenCache) readStore() ([]byte, error) {
+	data, err := t.store.Get(filepath.Base(t.file))
+	if errors.Is(err, ErrSecretNotFound) {
+		return nil, nil // No cache yet
+	}
+	return data, err
 }
 
 func (t *TokenCache) Replace(ctx context.Context, cache cache.Unmarshaler, hints cache.ReplaceHints) error {
-	data, err := os.ReadFile(t.file)
+	data, err := t.read()
 	if err != nil {
-		log.Println(err)
+		return fmt.Errorf("reading token cache: %w", err)
 	}
-	return cache.Unmarshal(data)
+	t.mu.Lock()
+	t.loaded = data
+	t.mu.Unlock()
+	if len(data) == 0 {
+		return nil // Nothing to load, which MSAL treats as an empty cache
+	}
+	if err := cache.Unmarshal(data); err != nil {
+		return fmt.Errorf("[%s] loading token cache: %w", t.file, err)
+	}
+	return nil
 }
 
+// MSAL calls Replace before every cache access, but Export only after changing the cache, and
+// not necessarily at all, so no lock can be held between the two. Instead, the cache is re-read
+// under an exclusive lock here, and if another process changed it since Replace, its changes are
+// merged with ours before writing it back, still under the same lock.
 func (t *TokenCache) Export(ctx context.Context, cache cache.Marshaler, hints cache.ExportHints) error {
 	data, err := cache.Marshal()
 	if err != nil {
-		log.Println(err)
+		return fmt.Errorf("saving token cache: %w", err)
+	}
+	unlock, err := lockFile(t.file, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	var current []byte
+	if t.store != nil {
+		current, err = t.readStore()
+	} else {
+		current, err = os.ReadFile(t.file) // Already holding the lock
+		if errors.Is(err, os.ErrNotExist) {
+			current, err = nil, nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("reading token cache: %w", err)
+	}
+	t.mu.Lock()
+	loaded := t.loaded
+	t.mu.Unlock()
+	if len(current) > 0 && !bytes.Equal(current, loaded) {
+		if data, err = mergeTokenCache(loaded, current, data); err != nil {
+			return fmt.Errorf("[%s] merging token cache: %w", t.file, err)
+		}
+	}
+	if t.store != nil {
+		err = t.store.Set(filepath.Base(t.file), data)
+	} else if err = writeFileAtomic(t.file, data, 0600); err != nil {
+		err = fmt.Errorf("[%s] %w", t.file, err)
+	}
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.loaded = data
+	t.mu.Unlock()
+	return nil
+}
+
+// Merges our changes to the serialized MSAL cache into the current one, which another process
+// changed since we loaded the base one. The cache has a section per credential type, each mapping
+// cache keys to entries, so entries we have are taken from ours, and those we dropped since the
+// base are dropped, while all others stay as they are in the current cache. Anything else at the
+// top level is taken from ours.
+func mergeTokenCache(base, current, ours []byte) ([]byte, error) {
+	baseSections, err := tokenCacheSections(base)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := tokenCacheSections(current)
+	if err != nil {
+		return nil, err
+	}
+	ourSections, err := tokenCacheSections(ours)
+	if err != nil {
+		return nil, err
+	}
+	names := maps.Clone(ourSections)
+	maps.Copy(names, baseSections) // Sections we emptied since the base are left out of ours
+	for name := range names {
+		raw, ok := ourSections[name]
+		if !ok {
+			raw = json.RawMessage("{}")
+		}
+		var entries, mergedEntries map[string]json.RawMessage
+		if _, inCurrent := merged[name]; !inCurrent {
+			merged[name] = json.RawMessage("{}")
+		}
+		if json.Unmarshal(raw, &entries) != nil || json.Unmarshal(merged[name], &mergedEntries) != nil {
+			if ok {
+				merged[name] = raw // Not a section of entries
+			}
+			continue
+		}
+		if mergedEntries == nil {
+			mergedEntries = make(map[string]json.RawMessage)
+		}
+		var baseEntries map[string]json.RawMessage
+		if b, inBase := baseSections[name]; inBase {
+			json.Unmarshal(b, &baseEntries) // Not a section means nothing was dropped
+		}
+		for key := range baseEntries {
+			if _, kept := entries[key]; !kept {
+				delete(mergedEntries, key)
+			}
+		}
+		for key, entry := range entries {
+			mergedEntries[key] = entry
+		}
+		if merged[name], err = json.Marshal(mergedEntries); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// Returns the top level entries of given serialized MSAL cache
+func tokenCacheSections(data []byte) (map[string]json.RawMessage, error) {
+	sections := make(map[string]json.RawMessage)
+	if len(data) == 0 {
+		return sections, nil
+	}
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return nil, err
 	}
-	return os.WriteFile(t.file, data, 0600)
+	return sections, nil
 }
 
 func (t *TokenCache) Print() string {
-	data, err := os.ReadFile(t.file)
+	data, err := t.read()
 	if err != nil {
 		return err.Error()
 	}
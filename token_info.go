@@ -0,0 +1,136 @@
+package maz
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/queone/utl"
+)
+
+// TokenInfo holds the commonly used claims of an Azure access token. See
+// https://learn.microsoft.com/en-us/entra/identity-platform/access-token-claims-reference
+type TokenInfo struct {
+	TenantId  string    // tid
+	ObjectId  string    // oid, of the user or service principal
+	AppId     string    // appid in v1.0 tokens, azp in v2.0 ones
+	Upn       string    // upn, or unique_name if the former is missing. Empty for app-only tokens
+	Roles     []string  // roles, the app roles granted to an app-only token
+	Scopes    []string  // scp, the delegated permissions of a user token
+	Wids      []string  // wids, the Entra ID built-in role template IDs of the user
+	Audience  []string  // aud, usually a single API, like "https://graph.microsoft.com"
+	Issuer    string    // iss
+	ExpiresAt time.Time // exp
+	NotBefore time.Time // nbf
+	IssuedAt  time.Time // iat
+
+	Header    map[string]interface{} // All header entries, like alg and kid
+	Claims    map[string]interface{} // All claims, including the ones above
+	Signature string                 // Signature segment, still base64url encoded
+}
+
+// Parses given JWT token and returns its claims, without verifying its signature. Only use it to
+// inspect tokens the program got itself, or to fail fast on unsuitable ones.
+func ParseToken(tokenString string) (*TokenInfo, error) {
+	if !TokenValid(tokenString) {
+		return nil, fmt.Errorf("invalid token: does not start with 'eyJ', contain any '.', or it's empty")
+	}
+	claims := jwt.MapClaims{}
+	token, parts, err := jwt.NewParser().ParseUnverified(tokenString, claims)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	info := &TokenInfo{
+		TenantId:  claimString(claims, "tid"),
+		ObjectId:  claimString(claims, "oid"),
+		AppId:     claimString(claims, "appid"),
+		Upn:       claimString(claims, "upn"),
+		Roles:     claimStrings(claims, "roles"),
+		Scopes:    strings.Fields(claimString(claims, "scp")),
+		Wids:      claimStrings(claims, "wids"),
+		Issuer:    claimString(claims, "iss"),
+		ExpiresAt: claimTime(claims, "exp"),
+		NotBefore: claimTime(claims, "nbf"),
+		IssuedAt:  claimTime(claims, "iat"),
+		Header:    token.Header,
+		Claims:    claims,
+	}
+	if info.AppId == "" {
+		info.AppId = claimString(claims, "azp") // v2.0 tokens
+	}
+	if info.Upn == "" {
+		info.Upn = claimString(claims, "unique_name")
+	}
+	if aud, err := claims.GetAudience(); err == nil {
+		info.Audience = aud
+	}
+	if len(parts) > 2 {
+		info.Signature = parts[2]
+	}
+	return info, nil
+}
+
+// Returns how long until the token expires, which is negative if it already has. Zero means the
+// token has no expiry time.
+func (t *TokenInfo) ExpiresIn() time.Duration {
+	if t.ExpiresAt.IsZero() {
+		return 0
+	}
+	return time.Until(t.ExpiresAt)
+}
+
+// Returns true if the token has expired, or is not valid yet
+func (t *TokenInfo) Expired() bool {
+	now := time.Now()
+	return (!t.ExpiresAt.IsZero() && now.After(t.ExpiresAt)) || (!t.NotBefore.IsZero() && now.Before(t.NotBefore))
+}
+
+// Returns true if the token was granted given app role, e.g. "User.Read.All"
+func (t *TokenInfo) HasRole(role string) bool {
+	return slices.ContainsFunc(t.Roles, func(r string) bool { return strings.EqualFold(r, role) })
+}
+
+// Returns true if the token was granted given delegated permission, e.g. "User.Read"
+func (t *TokenInfo) HasScope(scope string) bool {
+	return slices.ContainsFunc(t.Scopes, func(s string) bool { return strings.EqualFold(s, scope) })
+}
+
+// Returns true if the token's user holds given Entra ID built-in role, by role template ID
+func (t *TokenInfo) HasWid(roleTemplateId string) bool {
+	return slices.ContainsFunc(t.Wids, func(w string) bool { return strings.EqualFold(w, roleTemplateId) })
+}
+
+// Returns true if the token is for given audience, ignoring any trailing slash
+func (t *TokenInfo) HasAudience(audience string) bool {
+	audience = strings.TrimSuffix(audience, "/")
+	return slices.ContainsFunc(t.Audience, func(a string) bool { return strings.EqualFold(strings.TrimSuffix(a, "/"), audience) })
+}
+
+// Returns the string value of given claim, or empty if it's missing or not a string
+func claimString(claims jwt.MapClaims, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// Returns the list of strings in given claim, which may also be a single string
+func claimStrings(claims jwt.MapClaims, name string) (list []string) {
+	switch v := claims[name].(type) {
+	case string:
+		list = append(list, v)
+	case []interface{}:
+		for _, i := range v {
+			list = append(list, utl.Str(i))
+		}
+	}
+	return list
+}
+
+// Returns the time in given NumericDate claim, or zero if it's missing
+func claimTime(claims jwt.MapClaims, name string) time.Time {
+	if n, ok := claims[name].(float64); ok {
+		return time.Unix(int64(n), 0)
+	}
+	return time.Time{}
+}
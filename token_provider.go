@@ -0,0 +1,101 @@
+package maz
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long before a token's expiry it gets refreshed, to avoid racing an in-flight request
+const ConstTokenRefreshMargin = 5 * time.Minute
+
+// AccessToken is an API access token along with its expiry time
+type AccessToken struct {
+	Token     string
+	ExpiresOn time.Time // Zero if unknown
+}
+
+// Returns true if the token is empty, or will expire within given duration
+func (t AccessToken) ExpiresWithin(d time.Duration) bool {
+	if t.Token == "" {
+		return true
+	}
+	return !t.ExpiresOn.IsZero() && time.Now().Add(d).After(t.ExpiresOn)
+}
+
+// TokenProvider supplies API access tokens for given scopes. ApiCall asks it for a token on every
+// request, so implementations are expected to cache tokens and only refresh them when needed. If
+// forceRefresh is true, any cached token must be discarded, which ApiCall does after getting a 401.
+// Implementations must be safe for concurrent use.
+type TokenProvider interface {
+	GetToken(ctx context.Context, scopes []string, forceRefresh bool) (AccessToken, error)
+}
+
+// Default TokenProvider, which acquires tokens with whichever login method the bundle is set up
+// for, and keeps them in memory until they are about to expire
+type bundleTokenProvider struct {
+	mu       sync.Mutex
+	z        Bundle                 // Copy of the bundle, for its login settings
+	tokens   map[string]AccessToken // Cached tokens, keyed by space-separated scopes
+	supplied map[string]AccessToken // Tokens supplied via z.MgToken and z.AzToken, which are never refreshed
+}
+
+// Returns a TokenProvider that acquires tokens using the login method z is set up for, relying on
+// the MSAL token cache file to silently refresh them. Each token is only acquired when first asked
+// for. Valid tokens already in z.MgToken or z.AzToken are used as is for their API, which is how
+// MAZ_MG_TOKEN and MAZ_AZ_TOKEN work. SetupApiTokens uses this one if the bundle does not already
+// have a TokenProvider.
+func NewTokenProvider(z Bundle) TokenProvider {
+	z.TokenProvider = nil // Avoid holding on to any previous provider
+	p := &bundleTokenProvider{z: z, tokens: make(map[string]AccessToken), supplied: make(map[string]AccessToken)}
+	if TokenValid(z.MgToken) {
+		p.supplied[z.mgScope()] = AccessToken{Token: z.MgToken, ExpiresOn: tokenExpiry(z.MgToken)}
+	}
+	if TokenValid(z.AzToken) {
+		p.supplied[z.azScope()] = AccessToken{Token: z.AzToken, ExpiresOn: tokenExpiry(z.AzToken)}
+	}
+	return p
+}
+
+// Returns a cached token for given scopes, or acquires a new one if it's about to expire
+func (p *bundleTokenProvider) GetToken(ctx context.Context, scopes []string, forceRefresh bool) (AccessToken, error) {
+	key := strings.Join(scopes, " ")
+	if t, ok := p.supplied[key]; ok {
+		if !forceRefresh && !t.ExpiresWithin(0) {
+			return t, nil
+		}
+		if !p.z.canLogin() {
+			return AccessToken{}, fmt.Errorf("supplied token for %s expired or was rejected, and no login method set up to get a new one", key)
+		}
+		// Otherwise fall back to getting a new one below
+	} else if !p.z.canLogin() {
+		return AccessToken{}, fmt.Errorf("no token supplied for %s, and no login method set up to get one", key)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock() // Holding the lock while acquiring means concurrent callers share one refresh
+	if t, ok := p.tokens[key]; ok && !forceRefresh && !t.ExpiresWithin(ConstTokenRefreshMargin) {
+		return t, nil
+	}
+	token, err := acquireTokenFunc(ctx, &p.z, scopes, forceRefresh) // Bypassing the MSAL cache too, if forced
+	if err != nil {
+		return AccessToken{}, err
+	}
+	t := AccessToken{Token: token, ExpiresOn: tokenExpiry(token)}
+	p.tokens[key] = t
+	return t, nil
+}
+
+// The function the default TokenProvider acquires tokens with, which tests can swap out
+var acquireTokenFunc = acquireToken
+
+// Returns the expiry time from the token's 'exp' claim, or zero if it cannot be determined. The
+// token is not verified, since we only need to know when to get a new one.
+func tokenExpiry(token string) time.Time {
+	info, err := ParseToken(token)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ExpiresAt
+}
@@ -0,0 +1,50 @@
+package maz
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestApiCallRefreshesRejectedToken(t *testing.T) {
+	calls := 0
+	forced := 0
+	acquireTokenFunc = func(ctx context.Context, z *Bundle, scopes []string, forceRefresh bool) (string, error) {
+		calls++
+		if forceRefresh {
+			forced++
+			return fmt.Sprintf("token-%d", calls), nil
+		}
+		return "token-1", nil // What a cache that is never bypassed would keep returning
+	}
+	defer func() { acquireTokenFunc = acquireToken }()
+
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") == "Bearer token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id": "x"}`)
+	}))
+	defer srv.Close()
+
+	z := Bundle{ClientId: "client", MgEndpoint: srv.URL, MgHeaders: map[string]string{}}
+	z.TokenProvider = NewTokenProvider(z)
+	_, rsc, err := ApiCall("GET", srv.URL+"/v1.0/me", z, nil, nil, false)
+	if err != nil || rsc != http.StatusOK {
+		t.Fatalf("ApiCall = %d, %v; want 200", rsc, err)
+	}
+	if calls != 2 || forced != 1 {
+		t.Errorf("acquired %d tokens, %d of them forced; want 2, 1", calls, forced)
+	}
+	want := []string{"Bearer token-1", "Bearer token-2"}
+	if !slices.Equal(seen, want) {
+		t.Errorf("Authorization headers = %v; want %v", seen, want)
+	}
+}
@@ -0,0 +1,296 @@
+package maz
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	ConstJwksCacheTtl      = 24 * time.Hour  // How long fetched signing keys are trusted
+	ConstJwksRefreshPeriod = 5 * time.Minute // Minimum time between refetches for unknown key IDs
+	ConstTokenLeeway       = 5 * time.Minute // Allowed clock skew when checking token lifetimes
+	jwksMaxResponseSize    = 1 << 20         // Sanity limit on discovery and key responses
+)
+
+// Returned, wrapped, by TokenVerifier.Verify for any token that fails verification
+var ErrInvalidToken = errors.New("invalid token")
+
+// TokenVerifier verifies the signature, issuer, audience and lifetime of access tokens issued by
+// the tenant's authority, typically to APIs that accept tokens forwarded by maz-based tools. Note
+// that MS Graph tokens can't be verified, since Graph uses a signing scheme of its own.
+//
+// The signing keys are fetched from the tenant's OpenID configuration, and cached. Tokens signed
+// with a key ID that's not in the cache trigger a refetch, to pick up rotated keys. A verifier is
+// safe for concurrent use.
+type TokenVerifier struct {
+	ConfigUrl  string        // OpenID configuration URL. Defaults to the tenant's v2.0 one
+	KeysUrl    string        // Signing keys (JWKS) URL. Defaults to jwks_uri from the configuration
+	Issuers    []string      // Accepted issuers. Defaults to the v1.0 and v2.0 ones of the tenant
+	Audiences  []string      // Accepted audiences, e.g. "api://my-api". At least one is required
+	Leeway     time.Duration // Allowed clock skew. Defaults to ConstTokenLeeway
+	HttpClient *http.Client  // Client for fetching configuration and keys. Defaults to the shared one
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey // Cached signing keys, by key ID
+	fetchedAt time.Time                   // When the keys were last fetched
+}
+
+// Returns a verifier for tokens issued by z's tenant, in z's cloud, to any of given audiences
+func NewTokenVerifier(z Bundle, audiences ...string) *TokenVerifier {
+	authority := z.AuthUrl() + z.TenantId
+	return &TokenVerifier{
+		ConfigUrl:  authority + "/v2.0/.well-known/openid-configuration",
+		Audiences:  audiences,
+		HttpClient: z.HttpClient,
+	}
+}
+
+// Verifies given token, returning its claims if it's valid, or an error wrapping ErrInvalidToken
+// if it's not
+func (v *TokenVerifier) Verify(tokenString string) (*TokenInfo, error) {
+	return v.VerifyCtx(context.Background(), tokenString)
+}
+
+// Context-aware version of Verify. The context only applies to fetching the signing keys.
+func (v *TokenVerifier) VerifyCtx(ctx context.Context, tokenString string) (*TokenInfo, error) {
+	if len(v.Audiences) < 1 {
+		return nil, fmt.Errorf("token verifier: no audience configured")
+	}
+	leeway := v.Leeway
+	if leeway == 0 {
+		leeway = ConstTokenLeeway
+	}
+	var keyErr error
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(leeway),
+	)
+	_, err := parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := v.key(ctx, kid)
+		keyErr = err // Fetch failures are not the token's fault, so they are reported as such below
+		return key, err
+	})
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	info, err := ParseToken(tokenString)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	issuers, err := v.issuers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(issuers, info.Issuer) {
+		return nil, fmt.Errorf("%w: issuer '%s' is not accepted", ErrInvalidToken, info.Issuer)
+	}
+	if !slices.ContainsFunc(v.Audiences, info.HasAudience) {
+		return nil, fmt.Errorf("%w: audience '%s' is not accepted", ErrInvalidToken, strings.Join(info.Audience, " "))
+	}
+	return info, nil
+}
+
+// Returns the signing key with given ID, fetching the keys if they aren't cached yet, have expired,
+// or don't include that ID
+func (v *TokenVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	age := time.Since(v.fetchedAt)
+	key, ok := v.keys[kid]
+	if ok && age < ConstJwksCacheTtl {
+		return key, nil
+	}
+	if !ok && v.keys != nil && age < ConstJwksRefreshPeriod {
+		// Don't let tokens with bogus key IDs hammer the keys endpoint
+		return nil, fmt.Errorf("%w: unknown signing key '%s'", ErrInvalidToken, kid)
+	}
+	keys, err := v.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.keys, v.fetchedAt = keys, time.Now()
+	if key, ok = v.keys[kid]; !ok {
+		return nil, fmt.Errorf("%w: unknown signing key '%s'", ErrInvalidToken, kid)
+	}
+	return key, nil
+}
+
+// Returns the accepted issuers, which unless set are the v2.0 one from the OpenID configuration,
+// plus the v1.0 one from the equivalent v1.0 configuration
+func (v *TokenVerifier) issuers(ctx context.Context) ([]string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.Issuers) > 0 {
+		return v.Issuers, nil
+	}
+	config, err := v.fetchConfig(ctx, v.ConfigUrl)
+	if err != nil {
+		return nil, err
+	}
+	issuers := []string{config.Issuer}
+	if v1Url := strings.Replace(v.ConfigUrl, "/v2.0/.well-known/", "/.well-known/", 1); v1Url != v.ConfigUrl {
+		if v1Config, err := v.fetchConfig(ctx, v1Url); err == nil {
+			issuers = append(issuers, v1Config.Issuer)
+		}
+	}
+	v.Issuers = issuers
+	return v.Issuers, nil
+}
+
+type openIdConfig struct {
+	Issuer  string `json:"issuer"`
+	JwksUri string `json:"jwks_uri"`
+}
+
+// Fetches the OpenID configuration at given URL
+func (v *TokenVerifier) fetchConfig(ctx context.Context, configUrl string) (config openIdConfig, err error) {
+	if err := v.fetchJson(ctx, configUrl, &config); err != nil {
+		return config, err
+	}
+	if config.Issuer == "" || config.JwksUri == "" {
+		return config, fmt.Errorf("[%s] OpenID configuration lacks issuer or jwks_uri", configUrl)
+	}
+	return config, nil
+}
+
+// Fetches the signing keys, looking up their URL in the OpenID configuration if not set
+func (v *TokenVerifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	if v.KeysUrl == "" {
+		config, err := v.fetchConfig(ctx, v.ConfigUrl)
+		if err != nil {
+			return nil, err
+		}
+		v.KeysUrl = config.JwksUri
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.fetchJson(ctx, v.KeysUrl, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		} // Skip key types we don't support, rather than failing on all keys
+	}
+	if len(keys) < 1 {
+		return nil, fmt.Errorf("[%s] no usable signing keys", v.KeysUrl)
+	}
+	return keys, nil
+}
+
+// Does a GET on given URL and decodes the JSON response into result
+func (v *TokenVerifier) fetchJson(ctx context.Context, url string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("[%s] %w", url, err)
+	}
+	client := v.HttpClient
+	if client == nil {
+		client = defaultHttpClient
+	}
+	r, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("[%s] %w", url, err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("[%s] %d %s", url, r.StatusCode, http.StatusText(r.StatusCode))
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, jwksMaxResponseSize)).Decode(result); err != nil {
+		return fmt.Errorf("[%s] decoding response: %w", url, err)
+	}
+	return nil
+}
+
+// A JSON Web Key, as defined in https://www.rfc-editor.org/rfc/rfc7517, limited to public RSA and
+// EC keys
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`   // RSA modulus
+	E   string `json:"e"`   // RSA exponent
+	Crv string `json:"crv"` // EC curve
+	X   string `json:"x"`   // EC point
+	Y   string `json:"y"`
+}
+
+// Returns the RSA or ECDSA public key of the JWK
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("key %s: RSA exponent too large", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("key %s: unsupported curve '%s'", k.Kid, k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("key %s: point is not on curve", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("key %s: unsupported key type '%s'", k.Kid, k.Kty)
+}
+
+// Decodes a base64url encoded big-endian integer
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}